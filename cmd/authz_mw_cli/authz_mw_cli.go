@@ -9,133 +9,564 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 
 	opamw "github.com/infobloxopen/atlas-authz-middleware/grpc_opa"
 	opacl "github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+	"github.com/infobloxopen/seal/pkg/compiler/sql"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
 	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
 
-	logrus "github.com/sirupsen/logrus"
+	"github.com/open-policy-agent/opa/server/types"
 
 	"google.golang.org/grpc/metadata"
 )
 
-func usageAndExit() {
+// command is a CLI subcommand, returning the process exit code
+type command struct {
+	run     func(args []string, settings flagSettings) int
+	summary string
+}
+
+var commands = map[string]command{
+	`validate`: {validate,
+		`validate authorization of an endpoint (exit 0 if allowed, 1 if denied, 2 on error)`},
+	`obligations_sql`: {obligations_sql,
+		`validate, and preview the obligations tree, its SQL predicate and entitled features JSONB array`},
+	`replay`: {replay,
+		`replay recorded decisions against OPA or a Rego directory, reporting differing decisions (exit 1 if any)`},
+	`bench`: {bench,
+		`benchmark authorization latency, error rate and throughput`},
+	`acct_entitlements`: {acct_entitlements,
+		`get entitled features of accounts`},
+	`current_user_compartments`: {current_user_compartments,
+		`get compartments of the JWT user`},
+	`filter_compartment_permissions`: {filter_compartment_permissions,
+		`filter permissions by the compartments of the JWT user`},
+	`filter_compartment_features`: {filter_compartment_features,
+		`filter features by the compartments of the JWT user`},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, strings.Replace(`
+Usage: AUTHZ_MW_CLI <command> [flags]
+Use "AUTHZ_MW_CLI <command> -h" for the flags of a command.
+Flags default to AUTHZ_MW_<FLAG_NAME> environment variables, if set (eg: AUTHZ_MW_OPA, AUTHZ_MW_JWT).
+
+Commands:
+`, `AUTHZ_MW_CLI`, os.Args[0], -1))
+
+	cmdNames := make([]string, 0, len(commands))
+	for cmdName := range commands {
+		cmdNames = append(cmdNames, cmdName)
+	}
+	sort.Strings(cmdNames)
+	for _, cmdName := range cmdNames {
+		fmt.Fprintf(os.Stderr, "  %-32s%s\n", cmdName, commands[cmdName].summary)
+	}
+
 	fmt.Fprintf(os.Stderr, strings.Replace(`
-Usage: AUTHZ_MW_CLI <ip:port> validate <decisionDoc> <app> <endpoint> <jwt>
-Usage: AUTHZ_MW_CLI <ip:port> acct_entitlements <acct_id,...> <service,...>
-<ip:port> can be empty string, which will default to 'localhost:8181'
-<decisionDoc> can be empty string, which will default to OPA's configured default decision doc
+Exit codes: 0 allowed/success, 1 denied (or replay differences), 2 error
 
 Example:
 $ kubectl -n authz port-forward pod/authz-dbapi-5d7ff9fb49-ghz5c 18181:8181
-$ AUTHZ_MW_CLI localhost:18181 validate '' authz EffectivePermissions.GetEffectivePermissions <jwt>
-$ AUTHZ_MW_CLI localhost:18181 validate '/v1/data/authz/rbac/validate_v1' authz EffectivePermissions.GetEffectivePermissions <jwt>
-$ AUTHZ_MW_CLI localhost:18181 acct_entitlements 16,40 ddi,rpz
+$ export AUTHZ_MW_OPA=localhost:18181 AUTHZ_MW_JWT=<jwt>
+$ AUTHZ_MW_CLI validate --app authz --endpoint EffectivePermissions.GetEffectivePermissions
+$ AUTHZ_MW_CLI validate --decision-doc /v1/data/authz/rbac/validate_v1 --app authz --endpoint EffectivePermissions.GetEffectivePermissions --query-options metrics,explain=notes
+$ AUTHZ_MW_CLI validate --decision-doc /v1/data/authz/rbac/validate_v1 --app ddi --endpoint Ipam.ListAddresses --type ddi.ipam --verb list --ctx '[{"tags": {"dc": "dc-1"}}]' --output sql
+$ AUTHZ_MW_CLI obligations_sql --decision-doc /v1/data/authz/rbac/validate_v1 --app ddi --endpoint Ipam.ListAddresses --type ddi.ipam --verb list --type-mapping mapping.json --output table
+$ AUTHZ_MW_CLI replay --input decisions.jsonl --rego-dir ./policies --output table
+$ AUTHZ_MW_CLI bench --app ddi --endpoints Ipam.ListAddresses,Ipam.GetAddress --jwts-file jwts.txt --concurrency 20 --rate 500 --duration 30s --mode interceptor --output table
+$ AUTHZ_MW_CLI repl --history-file ~/.authz_mw_cli_history
+$ echo <jwt> | AUTHZ_MW_CLI current_user_compartments --jwt-file - --output table
+$ AUTHZ_MW_CLI acct_entitlements --accounts 16,40 --services ddi,rpz --output table
+$ AUTHZ_MW_CLI filter_compartment_permissions --permissions ddi.dns.read,ddi.dhcp.write
+$ AUTHZ_MW_CLI filter_compartment_features --features ddi:dns,ddi:dhcp,rpz:threat
 
 `, `AUTHZ_MW_CLI`, os.Args[0], -1))
-	logrus.Exit(0)
 }
 
 func main() {
-	if len(os.Args) < 3 {
-		usageAndExit()
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitError)
 	}
 
-	opaIpPort := os.Args[1]
-	if len(opaIpPort) <= 0 {
-		opaIpPort = opacl.DefaultAddress
-	}
-	if !strings.HasPrefix(opaIpPort, `http://`) {
-		opaIpPort = `http://` + opaIpPort
+	cmd, ok := commands[strings.ToLower(os.Args[1])]
+	if !ok {
+		usage()
+		os.Exit(exitError)
 	}
 
-	stdLoggr := logrus.StandardLogger()
-	stdLoggr.SetLevel(logrus.TraceLevel)
-	ctx, cancelCtxFn := context.WithCancel(context.Background())
-	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
-	defer func() {
-		cancelCtxFn()
-	}()
+	os.Exit(cmd.run(os.Args[2:], nil))
+}
 
-	switch strings.ToLower(os.Args[2]) {
-	case `validate`:
-		validate(ctx, opaIpPort)
-	case `acct_entitlements`:
-		acct_entitlements(ctx, opaIpPort)
-	default:
-		usageAndExit()
+// exitCode prints err (other than errUsage, already printed) and returns exitError,
+// or returns exitAllow if err is nil
+func exitCode(err error) int {
+	if err == nil {
+		return exitAllow
 	}
+	if !errors.Is(err, errUsage) {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	}
+	return exitError
 }
 
-func validate(ctx context.Context, opaIpPort string) {
-	loggr := ctxlogrus.Extract(ctx)
+// validateResult is the output of the validate command
+type validateResult struct {
+	Allow            bool                   `json:"allow"`
+	RequestID        string                 `json:"request_id,omitempty"`
+	DecisionID       string                 `json:"decision_id,omitempty"`
+	DenyReasons      []opamw.DenyReason     `json:"deny_reasons,omitempty"`
+	Obligations      *opamw.ObligationsNode `json:"obligations,omitempty"`
+	EntitledFeatures interface{}            `json:"entitled_features,omitempty"`
+
+	sqlc *sqlcompiler.SQLCompiler
+}
+
+// validateFlags are the flags of the validate flow
+type validateFlags struct {
+	commonFlags
+	decisionDoc string
+	app         string
+	fullMethod  string
+	sealType    string
+	sealVerb    string
+	sealCtx     string
+	qryOptArgs  commaListValue
+	typeMapping string
+}
+
+// newValidateFlagSet returns a FlagSet for cmdName with the validate flow flags registered
+func newValidateFlagSet(cmdName string, vf *validateFlags) *flag.FlagSet {
+	fs := newFlagSet(cmdName, true, &vf.commonFlags)
+	fs.StringVar(&vf.decisionDoc, `decision-doc`, ``, `OPA decision document (default: OPA's configured default decision doc)`)
+	fs.StringVar(&vf.app, `app`, ``, `application`)
+	fs.StringVar(&vf.fullMethod, `endpoint`, ``, `endpoint <Service.Method> or grpc full method </pkg.Service/Method> (required)`)
+	fs.StringVar(&vf.sealType, `type`, ``, `ABAC object/resource type (eg: ddi.ipam)`)
+	fs.StringVar(&vf.sealVerb, `verb`, ``, `ABAC verb (eg: list)`)
+	fs.StringVar(&vf.sealCtx, `ctx`, ``, `ABAC context data: JSON array (or object)`)
+	fs.Var(&vf.qryOptArgs, `query-options`, `comma-separated query-options (require --decision-doc): `+
+		`metrics, instrument, provenance, strict-builtin-errors, explain=notes|fails|full|debug`)
+	fs.StringVar(&vf.typeMapping, `type-mapping`, ``, `SEAL type-mapping JSON file for SQL output, eg: {"ddi.*": {"table": "*", "properties": {"*": {"column": "*"}}}}`)
+	return fs
+}
 
-	if len(os.Args) < 7 {
-		usageAndExit()
+func validate(args []string, settings flagSettings) int {
+	var vf validateFlags
+	fs := newValidateFlagSet(`validate`, &vf)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
 	}
 
-	decisionDoc := os.Args[3]
-	app := os.Args[4]
-	fullMethod := os.Args[5]
-	jwt := os.Args[6]
+	result, _, err := vf.evaluate(fs)
+	if err != nil {
+		return exitCode(err)
+	}
 
-	// Ensure fullMethod is in GRPC fullMethod format acceptable by middleware
-	if matched, _ := regexp.MatchString(`^[[:alnum:]]+\.[[:alnum:]]+$`, fullMethod); matched {
-		fullMethod = strings.Replace(fullMethod, `.`, `/`, -1)
-		fullMethod = `/service.` + fullMethod
+	if err := writeOutput(vf.output, result, result.table, result.sql); err != nil {
+		return exitCode(err)
 	}
 
-	// Middleware will add `/` prefix to decisionDoc document, so remove it
-	decisionDoc = strings.TrimPrefix(decisionDoc, `/`)
+	return result.exitCode()
+}
 
-	// From https://github.com/grpc-ecosystem/go-grpc-middleware/blob/master/auth/metadata_test.go
-	bearer := fmt.Sprintf(`bearer %s`, jwt)
-	md := metadata.Pairs(`authorization`, bearer)
-	ctx = metautils.NiceMD(md).ToIncoming(ctx)
+// evaluate performs the validate flow,
+// returning the validateResult and the result context of DefaultAuthorizer.Evaluate.
+// Returns error unless allowed or denied.
+func (vf *validateFlags) evaluate(fs *flag.FlagSet) (*validateResult, context.Context, error) {
+	if len(vf.fullMethod) == 0 {
+		return nil, nil, usageErrorf(fs, "--endpoint is required")
+	}
 
-	loggr.Infof("opaIpPort=`%s`\n", opaIpPort)
-	loggr.Infof("decisionDoc=`%s`\n", decisionDoc)
-	loggr.Infof("app=`%s`\n", app)
-	loggr.Infof("fullMethod=`%s`\n", fullMethod)
+	ctx, err := vf.newContext(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	loggr := ctxlogrus.Extract(ctx)
+
+	sqlc, err := loadSQLCompiler(vf.typeMapping)
+	if err != nil {
+		return nil, nil, usageErrorf(fs, "invalid --type-mapping: %s", err)
+	}
+
+	fullMethod := grpcFullMethod(vf.fullMethod)
+
+	// Middleware will add `/` prefix to decisionDoc document, so remove it
+	decisionDoc := strings.TrimPrefix(vf.decisionDoc, `/`)
+
+	if len(vf.qryOptArgs) > 0 {
+		qryOpts, err := parseQueryOptions(vf.qryOptArgs)
+		if err != nil {
+			return nil, nil, usageErrorf(fs, "%s", err)
+		}
+		loggr.Infof("qryOpts=%+v\n", qryOpts)
+		ctx = opacl.ContextWithQueryOptions(ctx, qryOpts)
+	}
 
 	var decInputr MyDecisionInputr
 	decInputr.DecisionInput.DecisionDocument = decisionDoc
+	decInputr.DecisionInput.Type = vf.sealType
+	decInputr.DecisionInput.Verb = vf.sealVerb
+	decInputr.DecisionInput.SealCtx, err = parseSealCtx(vf.sealCtx)
+	if err != nil {
+		return nil, nil, usageErrorf(fs, "invalid --ctx: %s", err)
+	}
+
+	loggr.Infof("opaIpPort=`%s`\n", vf.opaAddress())
+	loggr.Infof("decisionDoc=`%s`\n", decisionDoc)
+	loggr.Infof("app=`%s`\n", vf.app)
+	loggr.Infof("fullMethod=`%s`\n", fullMethod)
+	loggr.Infof("decisionInput=%+v\n", decInputr.DecisionInput)
 
-	authzr := opamw.NewDefaultAuthorizer(app,
-		opamw.WithAddress(opaIpPort),
+	authzr := opamw.NewDefaultAuthorizer(vf.app,
+		opamw.WithAddress(vf.opaAddress()),
 		opamw.WithDecisionInputHandler(&decInputr),
 	)
 
-	resultCtx, resultErr := authzr.AffirmAuthorization(ctx, fullMethod, nil)
-
+	ok, resultCtx, resultErr := authzr.Evaluate(ctx, fullMethod, nil, authzr.OpaQuery)
 	loggr.Infof("resultErr=%#v", resultErr)
-	loggr.Infof("resultCtx=%#v", resultCtx)
+
+	denied := errors.Is(resultErr, opamw.ErrForbidden) || errors.Is(resultErr, opacl.ErrUndefined)
+	if resultErr != nil && !denied {
+		return nil, nil, resultErr
+	}
+	if resultCtx == nil {
+		resultCtx = ctx
+	}
+
+	result := newValidateResult(ok && resultErr == nil, resultCtx)
+	result.sqlc = sqlc
+	return result, resultCtx, nil
 }
 
-func acct_entitlements(ctx context.Context, opaIpPort string) {
-	loggr := ctxlogrus.Extract(ctx)
+func newValidateResult(allow bool, resultCtx context.Context) *validateResult {
+	result := &validateResult{
+		Allow: allow,
+	}
+	if resultCtx == nil {
+		return result
+	}
+
+	if authzResult, ok := opamw.AuthzResultFromContext(resultCtx); ok {
+		result.RequestID = authzResult.RequestID
+		result.DecisionID = authzResult.DecisionID
+		result.DenyReasons = authzResult.DenyReasons
+	}
+	result.Obligations, _ = resultCtx.Value(opamw.ObKey).(*opamw.ObligationsNode)
+	result.EntitledFeatures = resultCtx.Value(opamw.EntitledFeaturesKey)
+
+	return result
+}
+
+func (r *validateResult) table() ([]string, [][]string) {
+	rows := [][]string{
+		{`allow`, fmt.Sprint(r.Allow)},
+	}
+	if len(r.RequestID) > 0 {
+		rows = append(rows, []string{`request_id`, r.RequestID})
+	}
+	if len(r.DecisionID) > 0 {
+		rows = append(rows, []string{`decision_id`, r.DecisionID})
+	}
+	for _, reason := range r.DenyReasons {
+		rows = append(rows, []string{`deny_reason`, reason.Reason + `: ` + reason.Message})
+	}
+	if !r.Obligations.IsShallowEmpty() {
+		rows = append(rows, []string{`obligations`, obligationsExpr(r.Obligations)})
+	}
+	if feats, err := opamw.FlattenRawEntitledFeatures(r.EntitledFeatures); err == nil && len(feats) > 0 {
+		rows = append(rows, []string{`entitled_features`, strings.Join(feats, `,`)})
+	}
+	return []string{`KEY`, `VALUE`}, rows
+}
+
+// sql returns the obligations as SQL predicate,
+// or TRUE if allowed without obligations, or FALSE if denied
+func (r *validateResult) sql() (string, error) {
+	if !r.Allow {
+		return `FALSE`, nil
+	}
+	if r.Obligations.IsShallowEmpty() {
+		return `TRUE`, nil
+	}
+
+	return r.Obligations.ToSQLPredicate(r.sqlc)
+}
+
+// exitCode returns exitAllow if allowed, otherwise exitDeny
+func (r *validateResult) exitCode() int {
+	if !r.Allow {
+		return exitDeny
+	}
+	return exitAllow
+}
 
-	if len(os.Args) < 5 {
-		usageAndExit()
+// obligationsExpr returns the obligations as a single-line boolean expression of its conditions
+func obligationsExpr(o8n *opamw.ObligationsNode) string {
+	if o8n.Kind == opamw.ObligationsCondition {
+		return o8n.Condition
 	}
 
-	acct_idsComma := os.Args[3]
-	servicesComma := os.Args[4]
+	joinStr := ` OR `
+	if o8n.Kind == opamw.ObligationsAnd {
+		joinStr = ` AND `
+	}
+
+	childExprs := make([]string, 0, len(o8n.Children))
+	for _, childNode := range o8n.Children {
+		if childNode.IsShallowEmpty() {
+			continue
+		}
+		childExprs = append(childExprs, obligationsExpr(childNode))
+	}
+
+	if len(childExprs) == 1 {
+		return childExprs[0]
+	}
+	return `(` + strings.Join(childExprs, joinStr) + `)`
+}
 
-	acct_ids := strings.Split(acct_idsComma, `,`)
-	services := strings.Split(servicesComma, `,`)
+// parseSealCtx parses the --ctx JSON array (or a single JSON object) into DecisionInput.SealCtx
+func parseSealCtx(sealCtx string) ([]interface{}, error) {
+	if len(sealCtx) == 0 {
+		return nil, nil
+	}
 
-	loggr.Infof("opaIpPort=`%s`\n", opaIpPort)
+	var val interface{}
+	if err := json.Unmarshal([]byte(sealCtx), &val); err != nil {
+		return nil, err
+	}
+
+	switch v := val.(type) {
+	case []interface{}:
+		return v, nil
+	case map[string]interface{}:
+		return []interface{}{v}, nil
+	}
+	return nil, fmt.Errorf("must be JSON array or object")
+}
+
+func acct_entitlements(args []string, settings flagSettings) int {
+	var cf commonFlags
+	var acct_ids, services commaListValue
+
+	fs := newFlagSet(`acct_entitlements`, false, &cf)
+	fs.Var(&acct_ids, `accounts`, `comma-separated account ids (default: all accounts)`)
+	fs.Var(&services, `services`, `comma-separated services (default: all services)`)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
+	}
+
+	ctx, err := cf.newContext(fs)
+	if err != nil {
+		return exitCode(err)
+	}
+	loggr := ctxlogrus.Extract(ctx)
+
+	loggr.Infof("opaIpPort=`%s`\n", cf.opaAddress())
 	loggr.Infof("acct_ids=%s\n", acct_ids)
 	loggr.Infof("services=%s\n", services)
 
-	fmt.Fprintf(os.Stderr, "acct_entitlements not implemented yet\n")
+	authzr := opamw.NewDefaultAuthorizer(``,
+		opamw.WithAddress(cf.opaAddress()),
+	)
+
+	result, resultErr := authzr.GetAcctEntitlements(ctx, acct_ids, services)
+	loggr.Infof("resultErr=%#v", resultErr)
+	if resultErr != nil {
+		return exitCode(resultErr)
+	}
+
+	toTable := func() ([]string, [][]string) {
+		rows := [][]string{}
+		if result != nil {
+			for acctID, svcFeats := range *result {
+				for _, row := range mapOfListsRows(svcFeats) {
+					rows = append(rows, append([]string{acctID}, row...))
+				}
+			}
+		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			return rows[i][0] < rows[j][0]
+		})
+		return []string{`ACCOUNT`, `SERVICE`, `FEATURES`}, rows
+	}
+
+	return exitCode(writeOutput(cf.output, result, toTable, nil))
+}
+
+func current_user_compartments(args []string, settings flagSettings) int {
+	var cf commonFlags
+
+	fs := newFlagSet(`current_user_compartments`, true, &cf)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
+	}
+
+	ctx, err := cf.newContext(fs)
+	if err != nil {
+		return exitCode(err)
+	}
+	loggr := ctxlogrus.Extract(ctx)
+
+	loggr.Infof("opaIpPort=`%s`\n", cf.opaAddress())
+
+	authzr := opamw.NewDefaultAuthorizer(``,
+		opamw.WithAddress(cf.opaAddress()),
+	)
+
+	result, resultErr := authzr.GetCurrentUserCompartments(ctx)
+	loggr.Infof("resultErr=%#v", resultErr)
+	if resultErr != nil {
+		return exitCode(resultErr)
+	}
+
+	toTable := func() ([]string, [][]string) {
+		return []string{`COMPARTMENT`}, listRows(result)
+	}
+
+	return exitCode(writeOutput(cf.output, result, toTable, nil))
+}
+
+func filter_compartment_permissions(args []string, settings flagSettings) int {
+	var cf commonFlags
+	var permissions commaListValue
+
+	fs := newFlagSet(`filter_compartment_permissions`, true, &cf)
+	fs.Var(&permissions, `permissions`, `comma-separated permissions to filter`)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
+	}
+
+	ctx, err := cf.newContext(fs)
+	if err != nil {
+		return exitCode(err)
+	}
+	loggr := ctxlogrus.Extract(ctx)
+
+	loggr.Infof("opaIpPort=`%s`\n", cf.opaAddress())
+	loggr.Infof("permissions=%s\n", permissions)
+
+	authzr := opamw.NewDefaultAuthorizer(``,
+		opamw.WithAddress(cf.opaAddress()),
+	)
+
+	result, resultErr := authzr.FilterCompartmentPermissions(ctx, opamw.FilterCompartmentPermissionsType(permissions))
+	loggr.Infof("resultErr=%#v", resultErr)
+	if resultErr != nil {
+		return exitCode(resultErr)
+	}
+
+	toTable := func() ([]string, [][]string) {
+		return []string{`PERMISSION`}, listRows(result)
+	}
+
+	return exitCode(writeOutput(cf.output, result, toTable, nil))
+}
+
+func filter_compartment_features(args []string, settings flagSettings) int {
+	var cf commonFlags
+	var appFeats commaListValue
+
+	fs := newFlagSet(`filter_compartment_features`, true, &cf)
+	fs.Var(&appFeats, `features`, `comma-separated <app>:<feature> to filter`)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
+	}
+
+	features := opamw.FilterCompartmentFeaturesType{}
+	for _, appFeat := range appFeats {
+		app, feat, found := strings.Cut(appFeat, `:`)
+		if !found || len(app) == 0 || len(feat) == 0 {
+			return exitCode(usageErrorf(fs, "invalid <app>:<feature> `%s`", appFeat))
+		}
+		features[app] = append(features[app], feat)
+	}
+
+	ctx, err := cf.newContext(fs)
+	if err != nil {
+		return exitCode(err)
+	}
+	loggr := ctxlogrus.Extract(ctx)
+
+	loggr.Infof("opaIpPort=`%s`\n", cf.opaAddress())
+	loggr.Infof("features=%v\n", features)
+
+	authzr := opamw.NewDefaultAuthorizer(``,
+		opamw.WithAddress(cf.opaAddress()),
+	)
+
+	result, resultErr := authzr.FilterCompartmentFeatures(ctx, features)
+	loggr.Infof("resultErr=%#v", resultErr)
+	if resultErr != nil {
+		return exitCode(resultErr)
+	}
+
+	toTable := func() ([]string, [][]string) {
+		return []string{`APP`, `FEATURES`}, mapOfListsRows(result)
+	}
+
+	return exitCode(writeOutput(cf.output, result, toTable, nil))
+}
+
+// contextWithJWT returns a new context with the jwt as incoming authorization bearer metadata
+func contextWithJWT(ctx context.Context, jwt string) context.Context {
+	// From https://github.com/grpc-ecosystem/go-grpc-middleware/blob/master/auth/metadata_test.go
+	bearer := fmt.Sprintf(`bearer %s`, jwt)
+	md := metadata.Pairs(`authorization`, bearer)
+	return metautils.NiceMD(md).ToIncoming(ctx)
+}
+
+// grpcFullMethod returns endpoint in GRPC fullMethod format acceptable by middleware,
+// ie: Service.Method is returned as /service.Service/Method
+func grpcFullMethod(endpoint string) string {
+	if matched, _ := regexp.MatchString(`^[[:alnum:]]+\.[[:alnum:]]+$`, endpoint); matched {
+		return `/service.` + strings.Replace(endpoint, `.`, `/`, -1)
+	}
+	return endpoint
+}
+
+// splitComma splits comma-separated arg, ignoring empty values
+func splitComma(arg string) []string {
+	vals := []string{}
+	for _, val := range strings.Split(arg, `,`) {
+		if len(val) > 0 {
+			vals = append(vals, val)
+		}
+	}
+	return vals
+}
+
+// parseQueryOptions parses query-option args into opa_client.QueryOptions
+func parseQueryOptions(args []string) (opacl.QueryOptions, error) {
+	var qryOpts opacl.QueryOptions
+	for _, arg := range args {
+		switch {
+		case arg == types.ParamMetricsV1:
+			qryOpts.Metrics = true
+		case arg == types.ParamInstrumentV1:
+			qryOpts.Instrument = true
+		case arg == types.ParamProvenanceV1:
+			qryOpts.Provenance = true
+		case arg == types.ParamStrictBuiltinErrors:
+			qryOpts.StrictBuiltinErrors = true
+		case strings.HasPrefix(arg, types.ParamExplainV1+`=`):
+			qryOpts.Explain = types.ExplainModeV1(strings.TrimPrefix(arg, types.ParamExplainV1+`=`))
+		default:
+			return qryOpts, fmt.Errorf("unknown query-option `%s`", arg)
+		}
+	}
+	return qryOpts, nil
 }
 
 type MyDecisionInputr struct {
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	opamw "github.com/infobloxopen/atlas-authz-middleware/grpc_opa"
+	opacl "github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+const (
+	benchModeEvaluate    = `evaluate`
+	benchModeInterceptor = `interceptor`
+
+	// maxBenchErrorMessages is the max number of distinct error messages counted,
+	// further distinct error messages are counted as "other"
+	maxBenchErrorMessages = 20
+)
+
+// benchOutcome is the outcome of a bench request
+type benchOutcome int
+
+const (
+	benchAllowed benchOutcome = iota
+	benchDenied
+	benchError
+)
+
+// benchRequestFn performs a bench request for fullMethod with jwt
+type benchRequestFn func(ctx context.Context, fullMethod, jwt string) (benchOutcome, error)
+
+type benchFlags struct {
+	commonFlags
+	decisionDoc string
+	app         string
+	endpoints   commaListValue
+	jwtsFile    string
+	mode        string
+	concurrency int
+	rate        int
+	duration    time.Duration
+	requests    int64
+}
+
+// benchLatency is the latency distribution of bench requests, in milliseconds
+type benchLatency struct {
+	Min  float64 `json:"min_ms"`
+	Mean float64 `json:"mean_ms"`
+	P50  float64 `json:"p50_ms"`
+	P95  float64 `json:"p95_ms"`
+	P99  float64 `json:"p99_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+// benchResult is the output of the bench command
+type benchResult struct {
+	Mode            string         `json:"mode"`
+	Concurrency     int            `json:"concurrency"`
+	Rate            int            `json:"rate,omitempty"`
+	Requests        int64          `json:"requests"`
+	Allowed         int64          `json:"allowed"`
+	Denied          int64          `json:"denied"`
+	Errors          int64          `json:"errors"`
+	DenyRate        float64        `json:"deny_rate"`
+	ErrorRate       float64        `json:"error_rate"`
+	ElapsedSeconds  float64        `json:"elapsed_seconds"`
+	Throughput      float64        `json:"throughput_rps"`
+	Latency         benchLatency   `json:"latency"`
+	ErrorsByMessage map[string]int `json:"errors_by_message,omitempty"`
+}
+
+// benchWorkerResult is the result of one bench worker goroutine
+type benchWorkerResult struct {
+	latencies []time.Duration
+	outcomes  [3]int64
+	errMsgs   map[string]int
+}
+
+func bench(args []string, settings flagSettings) int {
+	var bf benchFlags
+	fs := newFlagSet(`bench`, true, &bf.commonFlags)
+	fs.StringVar(&bf.decisionDoc, `decision-doc`, ``, `OPA decision document (default: OPA's configured default decision doc)`)
+	fs.StringVar(&bf.app, `app`, ``, `application`)
+	fs.Var(&bf.endpoints, `endpoints`, `comma-separated endpoints <Service.Method> or grpc full methods </pkg.Service/Method> (required), used round-robin`)
+	fs.StringVar(&bf.jwtsFile, `jwts-file`, ``, `file of JWT bearers, one per line, used round-robin (in addition to --jwt/--jwt-file)`)
+	fs.StringVar(&bf.mode, `mode`, benchModeEvaluate, `evaluate: call DefaultAuthorizer.Evaluate, `+
+		`interceptor: call the unary server interceptor of an in-memory gRPC server`)
+	fs.IntVar(&bf.concurrency, `concurrency`, 10, `number of concurrent requests`)
+	fs.IntVar(&bf.rate, `rate`, 0, `max total requests per second (0 for unlimited)`)
+	fs.DurationVar(&bf.duration, `duration`, 10*time.Second, `duration of the benchmark (ignored if --requests)`)
+	fs.Int64Var(&bf.requests, `requests`, 0, `total number of requests (0 to run for --duration)`)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
+	}
+
+	if len(bf.endpoints) == 0 {
+		return exitCode(usageErrorf(fs, "--endpoints is required"))
+	}
+	if bf.mode != benchModeEvaluate && bf.mode != benchModeInterceptor {
+		return exitCode(usageErrorf(fs, "invalid --mode `%s`", bf.mode))
+	}
+	if bf.concurrency <= 0 || bf.rate < 0 || bf.duration <= 0 || bf.requests < 0 {
+		return exitCode(usageErrorf(fs, "--concurrency, --rate, --duration and --requests must be positive"))
+	}
+	// The rate ticker interval cannot be shorter than a nanosecond
+	if bf.rate > int(time.Second) {
+		return exitCode(usageErrorf(fs, "--rate must be at most %d", time.Second))
+	}
+
+	ctx, err := bf.newContext(fs)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	jwts, err := bf.readJWTs()
+	if err != nil {
+		return exitCode(err)
+	}
+
+	fullMethods := make([]string, 0, len(bf.endpoints))
+	for _, endpoint := range bf.endpoints {
+		fullMethods = append(fullMethods, grpcFullMethod(endpoint))
+	}
+
+	var decInputr MyDecisionInputr
+	decInputr.DecisionInput.DecisionDocument = strings.TrimPrefix(bf.decisionDoc, `/`)
+	opts := []opamw.Option{
+		opamw.WithAddress(bf.opaAddress()),
+		opamw.WithDecisionInputHandler(&decInputr),
+	}
+
+	var requestFn benchRequestFn
+	if bf.mode == benchModeInterceptor {
+		var stop func()
+		requestFn, stop, err = interceptorBenchRequestFn(bf.app, fullMethods, opts)
+		if err != nil {
+			return exitCode(err)
+		}
+		defer stop()
+	} else {
+		requestFn = evaluateBenchRequestFn(bf.app, opts)
+	}
+
+	result := bf.run(ctx, requestFn, fullMethods, jwts)
+
+	toTable := func() ([]string, [][]string) {
+		rows := [][]string{
+			{`mode`, result.Mode},
+			{`concurrency`, fmt.Sprint(result.Concurrency)},
+			{`rate`, fmt.Sprint(result.Rate)},
+			{`requests`, fmt.Sprint(result.Requests)},
+			{`allowed`, fmt.Sprint(result.Allowed)},
+			{`denied`, fmt.Sprint(result.Denied)},
+			{`errors`, fmt.Sprint(result.Errors)},
+			{`deny_rate`, fmt.Sprintf("%.4f", result.DenyRate)},
+			{`error_rate`, fmt.Sprintf("%.4f", result.ErrorRate)},
+			{`elapsed_seconds`, fmt.Sprintf("%.3f", result.ElapsedSeconds)},
+			{`throughput_rps`, fmt.Sprintf("%.1f", result.Throughput)},
+			{`latency_min_ms`, fmt.Sprintf("%.3f", result.Latency.Min)},
+			{`latency_mean_ms`, fmt.Sprintf("%.3f", result.Latency.Mean)},
+			{`latency_p50_ms`, fmt.Sprintf("%.3f", result.Latency.P50)},
+			{`latency_p95_ms`, fmt.Sprintf("%.3f", result.Latency.P95)},
+			{`latency_p99_ms`, fmt.Sprintf("%.3f", result.Latency.P99)},
+			{`latency_max_ms`, fmt.Sprintf("%.3f", result.Latency.Max)},
+		}
+		errMsgs := make([]string, 0, len(result.ErrorsByMessage))
+		for errMsg := range result.ErrorsByMessage {
+			errMsgs = append(errMsgs, errMsg)
+		}
+		sort.Strings(errMsgs)
+		for _, errMsg := range errMsgs {
+			rows = append(rows, []string{`error`, fmt.Sprintf("%d x %s", result.ErrorsByMessage[errMsg], errMsg)})
+		}
+		return []string{`KEY`, `VALUE`}, rows
+	}
+
+	if err := writeOutput(bf.output, result, toTable, nil); err != nil {
+		return exitCode(err)
+	}
+
+	return exitAllow
+}
+
+// readJWTs returns the --jwt (or --jwt-file) JWT and the --jwts-file JWTs,
+// or a single empty JWT (no credentials) if none
+func (bf *benchFlags) readJWTs() ([]string, error) {
+	jwts := []string{}
+
+	jwt, err := bf.readJWT()
+	if err != nil {
+		return nil, fmt.Errorf("read --jwt-file: %w", err)
+	}
+	if len(jwt) > 0 {
+		jwts = append(jwts, jwt)
+	}
+
+	if len(bf.jwtsFile) > 0 {
+		raw, err := ioutil.ReadFile(bf.jwtsFile)
+		if err != nil {
+			return nil, fmt.Errorf("read --jwts-file: %w", err)
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			line = strings.TrimSpace(line)
+			line = strings.TrimPrefix(line, `bearer `)
+			line = strings.TrimPrefix(line, `Bearer `)
+			if len(line) > 0 {
+				jwts = append(jwts, line)
+			}
+		}
+	}
+
+	if len(jwts) == 0 {
+		jwts = append(jwts, ``)
+	}
+	return jwts, nil
+}
+
+// run performs the bench requests with --concurrency workers,
+// at --rate if any, until --requests or --duration
+func (bf *benchFlags) run(ctx context.Context, requestFn benchRequestFn, fullMethods, jwts []string) *benchResult {
+	runCtx := ctx
+	if bf.requests == 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, bf.duration)
+		defer cancel()
+	}
+
+	var ticks <-chan time.Time
+	if bf.rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(bf.rate))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	next := int64(-1)
+	workerResults := make([]benchWorkerResult, bf.concurrency)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for idx := range workerResults {
+		wg.Add(1)
+		go func(wr *benchWorkerResult) {
+			defer wg.Done()
+			wr.errMsgs = map[string]int{}
+			for {
+				reqNum := atomic.AddInt64(&next, 1)
+				if bf.requests > 0 && reqNum >= bf.requests {
+					return
+				}
+
+				if ticks != nil {
+					select {
+					case <-ticks:
+					case <-runCtx.Done():
+						return
+					}
+				}
+				if runCtx.Err() != nil {
+					return
+				}
+
+				// Requests use ctx rather than runCtx, so in-flight requests are not cancelled at --duration
+				fullMethod := fullMethods[reqNum%int64(len(fullMethods))]
+				jwt := jwts[reqNum%int64(len(jwts))]
+				reqStart := time.Now()
+				outcome, err := requestFn(ctx, fullMethod, jwt)
+				wr.latencies = append(wr.latencies, time.Since(reqStart))
+				wr.outcomes[outcome]++
+				if outcome == benchError && err != nil {
+					wr.errMsgs[err.Error()]++
+				}
+			}
+		}(&workerResults[idx])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	result := &benchResult{
+		Mode:           bf.mode,
+		Concurrency:    bf.concurrency,
+		Rate:           bf.rate,
+		ElapsedSeconds: elapsed.Seconds(),
+	}
+
+	latencies := []time.Duration{}
+	for _, wr := range workerResults {
+		latencies = append(latencies, wr.latencies...)
+		result.Allowed += wr.outcomes[benchAllowed]
+		result.Denied += wr.outcomes[benchDenied]
+		result.Errors += wr.outcomes[benchError]
+		for errMsg, count := range wr.errMsgs {
+			if result.ErrorsByMessage == nil {
+				result.ErrorsByMessage = map[string]int{}
+			}
+			if _, ok := result.ErrorsByMessage[errMsg]; !ok && len(result.ErrorsByMessage) >= maxBenchErrorMessages {
+				errMsg = `other`
+			}
+			result.ErrorsByMessage[errMsg] += count
+		}
+	}
+
+	result.Requests = int64(len(latencies))
+	if result.Requests > 0 {
+		result.DenyRate = float64(result.Denied) / float64(result.Requests)
+		result.ErrorRate = float64(result.Errors) / float64(result.Requests)
+		result.Throughput = float64(result.Requests) / elapsed.Seconds()
+		result.Latency = newBenchLatency(latencies)
+	}
+
+	return result
+}
+
+// newBenchLatency returns the latency distribution of the non-empty latencies
+func newBenchLatency(latencies []time.Duration) benchLatency {
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+
+	// percentile returns the nearest-rank percentile
+	percentile := func(pct float64) time.Duration {
+		rank := int(math.Ceil(pct/100*float64(len(latencies)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return latencies[rank]
+	}
+
+	millis := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	return benchLatency{
+		Min:  millis(latencies[0]),
+		Mean: millis(total / time.Duration(len(latencies))),
+		P50:  millis(percentile(50)),
+		P95:  millis(percentile(95)),
+		P99:  millis(percentile(99)),
+		Max:  millis(latencies[len(latencies)-1]),
+	}
+}
+
+// evaluateBenchRequestFn returns a benchRequestFn calling DefaultAuthorizer.Evaluate
+func evaluateBenchRequestFn(app string, opts []opamw.Option) benchRequestFn {
+	authzr := opamw.NewDefaultAuthorizer(app, opts...)
+	return func(ctx context.Context, fullMethod, jwt string) (benchOutcome, error) {
+		if len(jwt) > 0 {
+			ctx = contextWithJWT(ctx, jwt)
+		}
+
+		ok, _, err := authzr.Evaluate(ctx, fullMethod, nil, authzr.OpaQuery)
+		switch {
+		case errors.Is(err, opamw.ErrForbidden), errors.Is(err, opacl.ErrUndefined):
+			return benchDenied, nil
+		case err != nil:
+			return benchError, err
+		case !ok:
+			return benchDenied, nil
+		}
+		return benchAllowed, nil
+	}
+}
+
+// interceptorBenchRequestFn returns a benchRequestFn calling fullMethods
+// of an in-memory gRPC server with the unary server interceptor,
+// and the function to stop the server.
+// The server methods accept and return google.protobuf.Empty.
+func interceptorBenchRequestFn(app string, fullMethods []string, opts []opamw.Option) (benchRequestFn, func(), error) {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(opamw.UnaryServerInterceptor(app, opts...)))
+
+	// Register the methods, grouped by service
+	svcDescs := map[string]*grpc.ServiceDesc{}
+	for _, fullMethod := range fullMethods {
+		svcMethod := strings.SplitN(strings.TrimPrefix(fullMethod, `/`), `/`, 2)
+		if len(svcMethod) != 2 || len(svcMethod[0]) == 0 || len(svcMethod[1]) == 0 {
+			return nil, nil, fmt.Errorf("invalid endpoint `%s`: expected /pkg.Service/Method", fullMethod)
+		}
+
+		svcDesc, ok := svcDescs[svcMethod[0]]
+		if !ok {
+			svcDesc = &grpc.ServiceDesc{
+				ServiceName: svcMethod[0],
+				HandlerType: (*interface{})(nil),
+			}
+			svcDescs[svcMethod[0]] = svcDesc
+		}
+		svcDesc.Methods = append(svcDesc.Methods, grpc.MethodDesc{
+			MethodName: svcMethod[1],
+			Handler:    emptyUnaryHandler(fullMethod),
+		})
+	}
+	for _, svcDesc := range svcDescs {
+		srv.RegisterService(svcDesc, nil)
+	}
+
+	lis := bufconn.Listen(1024 * 1024)
+	go srv.Serve(lis)
+
+	conn, err := grpc.NewClient(`passthrough:///bufconn`,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		srv.Stop()
+		return nil, nil, err
+	}
+
+	stop := func() {
+		conn.Close()
+		srv.Stop()
+	}
+
+	requestFn := func(ctx context.Context, fullMethod, jwt string) (benchOutcome, error) {
+		// The client context must not carry the CLI's incoming metadata
+		ctx = metadata.NewIncomingContext(ctx, nil)
+		if len(jwt) > 0 {
+			ctx = metadata.AppendToOutgoingContext(ctx, `authorization`, `bearer `+jwt)
+		}
+
+		err := conn.Invoke(ctx, fullMethod, &emptypb.Empty{}, &emptypb.Empty{})
+		switch {
+		case err == nil:
+			return benchAllowed, nil
+		case status.Code(err) == codes.PermissionDenied:
+			return benchDenied, nil
+		}
+		return benchError, err
+	}
+
+	return requestFn, stop, nil
+}
+
+// emptyUnaryHandler returns a grpc method handler of fullMethod,
+// accepting and returning google.protobuf.Empty
+func emptyUnaryHandler(fullMethod string) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := &emptypb.Empty{}
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &emptypb.Empty{}, nil
+		}
+		if interceptor == nil {
+			return handler(ctx, in)
+		}
+
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: fullMethod,
+		}
+		return interceptor(ctx, in, info, handler)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewBenchLatency(t *testing.T) {
+	millis := func(ms ...int) []time.Duration {
+		latencies := make([]time.Duration, 0, len(ms))
+		for _, m := range ms {
+			latencies = append(latencies, time.Duration(m)*time.Millisecond)
+		}
+		rand.Shuffle(len(latencies), func(i, j int) {
+			latencies[i], latencies[j] = latencies[j], latencies[i]
+		})
+		return latencies
+	}
+
+	oneToHundred := []int{}
+	for ms := 1; ms <= 100; ms++ {
+		oneToHundred = append(oneToHundred, ms)
+	}
+
+	testCases := []struct {
+		name       string
+		latencies  []time.Duration
+		expLatency benchLatency
+	}{
+		{
+			name:       "single",
+			latencies:  millis(7),
+			expLatency: benchLatency{Min: 7, Mean: 7, P50: 7, P95: 7, P99: 7, Max: 7},
+		},
+		{
+			name:       "ten",
+			latencies:  millis(1, 2, 3, 4, 5, 6, 7, 8, 9, 10),
+			expLatency: benchLatency{Min: 1, Mean: 5.5, P50: 5, P95: 10, P99: 10, Max: 10},
+		},
+		{
+			name:       "hundred",
+			latencies:  millis(oneToHundred...),
+			expLatency: benchLatency{Min: 1, Mean: 50.5, P50: 50, P95: 95, P99: 99, Max: 100},
+		},
+		{
+			name:       "outlier",
+			latencies:  millis(2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1000),
+			expLatency: benchLatency{Min: 2, Mean: 51.9, P50: 2, P95: 2, P99: 1000, Max: 1000},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newBenchLatency(tt.latencies); got != tt.expLatency {
+				t.Errorf("FAIL: newBenchLatency() got %+v expected %+v", got, tt.expLatency)
+			}
+		})
+	}
+}
+
+// stubBenchRequests is a stub benchRequestFn recording the requests,
+// returning the outcome of the fullMethod
+type stubBenchRequests struct {
+	mu        sync.Mutex
+	calls     int64
+	jwtCounts map[string]int
+	uniqueErr bool
+}
+
+func (s *stubBenchRequests) request(ctx context.Context, fullMethod, jwt string) (benchOutcome, error) {
+	calls := atomic.AddInt64(&s.calls, 1)
+
+	s.mu.Lock()
+	if s.jwtCounts == nil {
+		s.jwtCounts = map[string]int{}
+	}
+	s.jwtCounts[jwt]++
+	s.mu.Unlock()
+
+	switch fullMethod {
+	case `/service.Bench/Allow`:
+		return benchAllowed, nil
+	case `/service.Bench/Deny`:
+		return benchDenied, nil
+	}
+	if s.uniqueErr {
+		return benchError, fmt.Errorf("error #%d", calls)
+	}
+	return benchError, errors.New("opa unreachable")
+}
+
+func TestBenchRunRequests(t *testing.T) {
+	testCases := []struct {
+		name        string
+		concurrency int
+		requests    int64
+		fullMethods []string
+		jwts        []string
+		expAllowed  int64
+		expDenied   int64
+		expErrors   int64
+		expJWTCount int
+	}{
+		{
+			name:        "single worker",
+			concurrency: 1,
+			requests:    12,
+			fullMethods: []string{`/service.Bench/Allow`, `/service.Bench/Deny`, `/service.Bench/Error`},
+			jwts:        []string{`jwt1`, `jwt2`},
+			expAllowed:  4,
+			expDenied:   4,
+			expErrors:   4,
+			expJWTCount: 6,
+		},
+		{
+			name:        "more workers than requests",
+			concurrency: 20,
+			requests:    5,
+			fullMethods: []string{`/service.Bench/Allow`},
+			jwts:        []string{``},
+			expAllowed:  5,
+			expJWTCount: 5,
+		},
+		{
+			name:        "concurrent workers",
+			concurrency: 8,
+			requests:    1000,
+			fullMethods: []string{`/service.Bench/Allow`, `/service.Bench/Deny`},
+			jwts:        []string{`jwt1`, `jwt2`, `jwt3`, `jwt4`},
+			expAllowed:  500,
+			expDenied:   500,
+			expJWTCount: 250,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubBenchRequests{}
+			bf := benchFlags{
+				mode:        benchModeEvaluate,
+				concurrency: tt.concurrency,
+				requests:    tt.requests,
+				// --duration is ignored if --requests
+				duration: time.Nanosecond,
+			}
+
+			result := bf.run(context.Background(), stub.request, tt.fullMethods, tt.jwts)
+
+			if stub.calls != tt.requests || result.Requests != tt.requests {
+				t.Errorf("FAIL: got %d calls %d requests expected %d", stub.calls, result.Requests, tt.requests)
+			}
+			if result.Allowed != tt.expAllowed || result.Denied != tt.expDenied || result.Errors != tt.expErrors {
+				t.Errorf("FAIL: got allowed=%d denied=%d errors=%d expected %d %d %d",
+					result.Allowed, result.Denied, result.Errors, tt.expAllowed, tt.expDenied, tt.expErrors)
+			}
+			if expRate := float64(tt.expErrors) / float64(tt.requests); result.ErrorRate != expRate {
+				t.Errorf("FAIL: got error rate %v expected %v", result.ErrorRate, expRate)
+			}
+			for _, jwt := range tt.jwts {
+				if stub.jwtCounts[jwt] != tt.expJWTCount {
+					t.Errorf("FAIL: got %d requests with jwt `%s` expected %d", stub.jwtCounts[jwt], jwt, tt.expJWTCount)
+				}
+			}
+			if tt.expErrors > 0 && result.ErrorsByMessage[`opa unreachable`] != int(tt.expErrors) {
+				t.Errorf("FAIL: got errors by message %v expected %d", result.ErrorsByMessage, tt.expErrors)
+			}
+		})
+	}
+}
+
+func TestBenchRunErrorMessagesCap(t *testing.T) {
+	const numRequests = maxBenchErrorMessages + 15
+
+	stub := &stubBenchRequests{uniqueErr: true}
+	bf := benchFlags{
+		mode:        benchModeEvaluate,
+		concurrency: 4,
+		requests:    numRequests,
+	}
+
+	result := bf.run(context.Background(), stub.request, []string{`/service.Bench/Error`}, []string{``})
+
+	if result.Errors != numRequests {
+		t.Errorf("FAIL: got %d errors expected %d", result.Errors, numRequests)
+	}
+	if len(result.ErrorsByMessage) != maxBenchErrorMessages+1 {
+		t.Errorf("FAIL: got %d error messages expected %d", len(result.ErrorsByMessage), maxBenchErrorMessages+1)
+	}
+
+	total := 0
+	for errMsg, count := range result.ErrorsByMessage {
+		if errMsg != `other` && count != 1 {
+			t.Errorf("FAIL: got %d x `%s` expected 1", count, errMsg)
+		}
+		total += count
+	}
+	if result.ErrorsByMessage[`other`] != numRequests-maxBenchErrorMessages || total != numRequests {
+		t.Errorf("FAIL: got %d other of %d total expected %d of %d",
+			result.ErrorsByMessage[`other`], total, numRequests-maxBenchErrorMessages, numRequests)
+	}
+}
+
+func TestBenchInvalidFlags(t *testing.T) {
+	stderr := os.Stderr
+	os.Stderr, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	defer func() { os.Stderr.Close(); os.Stderr = stderr }()
+
+	for _, args := range [][]string{
+		{`--concurrency`, `0`},
+		{`--rate`, `-1`},
+		{`--rate`, `1000000001`},
+		{`--duration`, `0s`},
+		{`--requests`, `-1`},
+		{`--mode`, `bogus`},
+	} {
+		if gotCode := bench(append([]string{`--endpoints`, `Ipam.ListAddresses`}, args...), nil); gotCode != exitError {
+			t.Errorf("FAIL: bench(%q) got exit code %d expected %d", args, gotCode, exitError)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+
+	opacl "github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+const (
+	// envPrefix is the prefix of the environment variables used as flag defaults,
+	// eg: AUTHZ_MW_OPA for --opa, AUTHZ_MW_DECISION_DOC for --decision-doc
+	envPrefix = `AUTHZ_MW_`
+
+	outputJSON  = `json`
+	outputTable = `table`
+	outputSQL   = `sql`
+)
+
+// Exit codes
+const (
+	exitAllow = 0 // allowed, or command succeeded
+	exitDeny  = 1 // denied (validate only)
+	exitError = 2 // error, including usage error
+)
+
+// errUsage is returned for invalid command-line flags or args
+var errUsage = errors.New("usage error")
+
+// commonFlags are the flags shared by all commands
+type commonFlags struct {
+	opa      string
+	logLevel string
+	output   string
+	jwt      string
+	jwtFile  string
+}
+
+// newFlagSet returns a FlagSet for cmdName with the common flags registered.
+// The --jwt and --jwt-file flags are only registered if withJWT.
+func newFlagSet(cmdName string, withJWT bool, cf *commonFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmdName, flag.ContinueOnError)
+	fs.StringVar(&cf.opa, `opa`, opacl.DefaultAddress, `OPA address <ip:port>`)
+	fs.StringVar(&cf.logLevel, `log-level`, logrus.WarnLevel.String(), `log level (trace, debug, info, warn, error)`)
+	fs.StringVar(&cf.output, `output`, outputJSON, `output format: json, table or sql`)
+	if withJWT {
+		fs.StringVar(&cf.jwt, `jwt`, ``, `JWT bearer`)
+		fs.StringVar(&cf.jwtFile, `jwt-file`, ``, `file containing JWT bearer ('-' for stdin)`)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n", os.Args[0], cmdName)
+		fmt.Fprintf(fs.Output(), "Flags default to %s<FLAG_NAME> environment variables, if set.\n", envPrefix)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// flagSettings are flag values by flag name, eg: the settings of a repl session
+type flagSettings map[string]string
+
+// parseFlags parses args with fs, defaulting flags not in args to their settings (if any),
+// otherwise to their environment variables (see envPrefix), if set.
+func parseFlags(fs *flag.FlagSet, args []string, settings flagSettings) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || err != nil {
+			return
+		}
+		if val, ok := settings[f.Name]; ok {
+			if setErr := fs.Set(f.Name, val); setErr != nil {
+				err = fmt.Errorf("invalid %s setting: %w", f.Name, setErr)
+			}
+			return
+		}
+		envName := flagEnvName(f.Name)
+		if val, ok := os.LookupEnv(envName); ok {
+			if setErr := fs.Set(f.Name, val); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", envName, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return usageErrorf(fs, "%s", err)
+	}
+
+	if fs.NArg() > 0 {
+		return usageErrorf(fs, "unexpected args %q", fs.Args())
+	}
+
+	return nil
+}
+
+// flagEnvName returns the environment variable of flag name, eg: AUTHZ_MW_DECISION_DOC for decision-doc
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, `-`, `_`, -1))
+}
+
+// usageErrorf prints the error and fs usage, and returns errUsage
+func usageErrorf(fs *flag.FlagSet, format string, args ...interface{}) error {
+	fmt.Fprintf(fs.Output(), format+"\n", args...)
+	fs.Usage()
+	return errUsage
+}
+
+// opaAddress returns the --opa address as URL
+func (cf *commonFlags) opaAddress() string {
+	opaIpPort := cf.opa
+	if len(opaIpPort) <= 0 {
+		opaIpPort = opacl.DefaultAddress
+	}
+	if !strings.HasPrefix(opaIpPort, `http://`) && !strings.HasPrefix(opaIpPort, `https://`) {
+		opaIpPort = `http://` + opaIpPort
+	}
+	return opaIpPort
+}
+
+// readJWT returns the --jwt, otherwise the JWT read from --jwt-file
+func (cf *commonFlags) readJWT() (string, error) {
+	if len(cf.jwt) > 0 || len(cf.jwtFile) == 0 {
+		return cf.jwt, nil
+	}
+
+	var raw []byte
+	var err error
+	if cf.jwtFile == `-` {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(cf.jwtFile)
+	}
+	if err != nil {
+		return ``, err
+	}
+
+	jwt := strings.TrimSpace(string(raw))
+	jwt = strings.TrimPrefix(jwt, `bearer `)
+	jwt = strings.TrimPrefix(jwt, `Bearer `)
+	return jwt, nil
+}
+
+// newContext returns the command context with a logger at --log-level,
+// and the JWT (if any) as incoming authorization bearer metadata.
+func (cf *commonFlags) newContext(fs *flag.FlagSet) (context.Context, error) {
+	lvl, err := logrus.ParseLevel(cf.logLevel)
+	if err != nil {
+		return nil, usageErrorf(fs, "invalid --log-level: %s", err)
+	}
+
+	switch cf.output {
+	case outputJSON, outputTable, outputSQL:
+	default:
+		return nil, usageErrorf(fs, "invalid --output `%s`", cf.output)
+	}
+
+	stdLoggr := logrus.StandardLogger()
+	stdLoggr.SetLevel(lvl)
+	ctx := ctxlogrus.ToContext(context.Background(), logrus.NewEntry(stdLoggr))
+
+	jwt, err := cf.readJWT()
+	if err != nil {
+		return nil, fmt.Errorf("read --jwt-file: %w", err)
+	}
+	if len(jwt) > 0 {
+		ctx = contextWithJWT(ctx, jwt)
+	}
+
+	return ctx, nil
+}
+
+// commaListValue is a flag.Value of comma-separated values, ignoring empty values
+type commaListValue []string
+
+func (c *commaListValue) String() string {
+	if c == nil {
+		return ``
+	}
+	return strings.Join(*c, `,`)
+}
+
+func (c *commaListValue) Set(arg string) error {
+	*c = splitComma(arg)
+	return nil
+}
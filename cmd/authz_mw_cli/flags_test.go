@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	opacl "github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+	atlas_claims "github.com/infobloxopen/atlas-claims"
+)
+
+func TestParseFlags(t *testing.T) {
+	testCases := []struct {
+		name       string
+		env        map[string]string
+		settings   flagSettings
+		args       []string
+		expErr     error
+		expOpa     string
+		expOutput  string
+		expDecDoc  string
+		expQryOpts []string
+	}{
+		{
+			name:      "defaults",
+			expOpa:    opacl.DefaultAddress,
+			expOutput: outputJSON,
+		},
+		{
+			name:      "env fallback",
+			env:       map[string]string{`AUTHZ_MW_OPA`: `opa:8181`, `AUTHZ_MW_DECISION_DOC`: `v1/data/authz`},
+			expOpa:    `opa:8181`,
+			expOutput: outputJSON,
+			expDecDoc: `v1/data/authz`,
+		},
+		{
+			name:       "flags take precedence over env",
+			env:        map[string]string{`AUTHZ_MW_OPA`: `opa:8181`, `AUTHZ_MW_OUTPUT`: outputSQL},
+			args:       []string{`--opa`, `flag:8181`, `--query-options`, `metrics,,explain=notes`},
+			expOpa:     `flag:8181`,
+			expOutput:  outputSQL,
+			expQryOpts: []string{`metrics`, `explain=notes`},
+		},
+		{
+			name:       "comma list from env",
+			env:        map[string]string{`AUTHZ_MW_QUERY_OPTIONS`: `metrics,instrument`},
+			expOpa:     opacl.DefaultAddress,
+			expOutput:  outputJSON,
+			expQryOpts: []string{`metrics`, `instrument`},
+		},
+		{
+			name:      "settings take precedence over env",
+			env:       map[string]string{`AUTHZ_MW_OPA`: `opa:8181`, `AUTHZ_MW_DECISION_DOC`: `v1/data/authz`},
+			settings:  flagSettings{`opa`: `setting:8181`, `decision-doc`: ``},
+			expOpa:    `setting:8181`,
+			expOutput: outputJSON,
+		},
+		{
+			name:      "flags take precedence over settings",
+			settings:  flagSettings{`opa`: `setting:8181`, `output`: outputTable},
+			args:      []string{`--opa`, `flag:8181`},
+			expOpa:    `flag:8181`,
+			expOutput: outputTable,
+		},
+		{
+			name:       "settings of flags not registered are ignored",
+			settings:   flagSettings{`query-options`: `metrics`, `bogus`: `ignored`},
+			expOpa:     opacl.DefaultAddress,
+			expOutput:  outputJSON,
+			expQryOpts: []string{`metrics`},
+		},
+		{
+			name:   "unknown flag",
+			args:   []string{`--bogus`},
+			expErr: errUsage,
+		},
+		{
+			name:   "unexpected args",
+			args:   []string{`--opa`, `flag:8181`, `extra`},
+			expErr: errUsage,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, envName := range []string{`AUTHZ_MW_OPA`, `AUTHZ_MW_OUTPUT`, `AUTHZ_MW_DECISION_DOC`, `AUTHZ_MW_QUERY_OPTIONS`} {
+				t.Setenv(envName, ``)
+				os.Unsetenv(envName)
+			}
+			for envName, val := range tt.env {
+				t.Setenv(envName, val)
+			}
+
+			var vf validateFlags
+			fs := newValidateFlagSet(`validate`, &vf)
+			fs.SetOutput(ioutil.Discard)
+
+			gotErr := parseFlags(fs, tt.args, tt.settings)
+			if gotErr != tt.expErr {
+				t.Fatalf("FAIL: parseFlags() got err=%v expected %v", gotErr, tt.expErr)
+			}
+			if gotErr != nil {
+				return
+			}
+
+			if vf.opa != tt.expOpa || vf.output != tt.expOutput || vf.decisionDoc != tt.expDecDoc {
+				t.Errorf("FAIL: got opa=%q output=%q decision-doc=%q expected %q %q %q",
+					vf.opa, vf.output, vf.decisionDoc, tt.expOpa, tt.expOutput, tt.expDecDoc)
+			}
+			if strings.Join(vf.qryOptArgs, `|`) != strings.Join(tt.expQryOpts, `|`) {
+				t.Errorf("FAIL: got query-options %q expected %q", vf.qryOptArgs, tt.expQryOpts)
+			}
+		})
+	}
+}
+
+func TestFlagEnvName(t *testing.T) {
+	for name, expEnvName := range map[string]string{
+		`opa`:          `AUTHZ_MW_OPA`,
+		`decision-doc`: `AUTHZ_MW_DECISION_DOC`,
+		`jwt-file`:     `AUTHZ_MW_JWT_FILE`,
+	} {
+		if got := flagEnvName(name); got != expEnvName {
+			t.Errorf("FAIL: flagEnvName(%s) got %s expected %s", name, got, expEnvName)
+		}
+	}
+}
+
+func TestReadJWT(t *testing.T) {
+	dir := t.TempDir()
+
+	testCases := []struct {
+		name        string
+		jwt         string
+		fileContent string
+		noFile      bool
+		expJWT      string
+		expErr      bool
+	}{
+		{
+			name:   "no jwt",
+			noFile: true,
+		},
+		{
+			name:        "jwt takes precedence over jwt-file",
+			jwt:         `flag.jwt.value`,
+			fileContent: `file.jwt.value`,
+			expJWT:      `flag.jwt.value`,
+		},
+		{
+			name:        "jwt-file",
+			fileContent: "file.jwt.value\n",
+			expJWT:      `file.jwt.value`,
+		},
+		{
+			name:        "jwt-file lower-case bearer",
+			fileContent: " bearer file.jwt.value\n",
+			expJWT:      `file.jwt.value`,
+		},
+		{
+			name:        "jwt-file upper-case bearer",
+			fileContent: "Bearer file.jwt.value\n",
+			expJWT:      `file.jwt.value`,
+		},
+		{
+			name:   "jwt-file missing",
+			expErr: true,
+		},
+	}
+
+	for idx, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cf := commonFlags{jwt: tt.jwt}
+			if !tt.noFile {
+				cf.jwtFile = filepath.Join(dir, strings.Replace(tt.name, ` `, `_`, -1))
+				if len(tt.fileContent) > 0 {
+					if err := ioutil.WriteFile(cf.jwtFile, []byte(tt.fileContent), 0600); err != nil {
+						t.Fatalf("FAIL: test case #%d WriteFile() unexpected err=%v", idx, err)
+					}
+				}
+			}
+
+			gotJWT, gotErr := cf.readJWT()
+			if (gotErr != nil) != tt.expErr {
+				t.Fatalf("FAIL: readJWT() got err=%v expected err=%v", gotErr, tt.expErr)
+			}
+			if gotJWT != tt.expJWT {
+				t.Errorf("FAIL: readJWT() got %q expected %q", gotJWT, tt.expJWT)
+			}
+		})
+	}
+}
+
+func TestOpaAddress(t *testing.T) {
+	for opa, expAddr := range map[string]string{
+		``:                  opacl.DefaultAddress,
+		`opa:8181`:          `http://opa:8181`,
+		`https://opa:8181`:  `https://opa:8181`,
+		`http://opa:8181`:   `http://opa:8181`,
+		`127.0.0.1:18181`:   `http://127.0.0.1:18181`,
+		`https://opa/proxy`: `https://opa/proxy`,
+	} {
+		cf := commonFlags{opa: opa}
+		if got := cf.opaAddress(); got != expAddr {
+			t.Errorf("FAIL: opaAddress(%q) got %q expected %q", opa, got, expAddr)
+		}
+	}
+}
+
+func TestValidateExitCode(t *testing.T) {
+	jwt, err := atlas_claims.BuildJwt(&atlas_claims.Claims{AccountId: "40"}, "some-hmac-key-we-dont-care", time.Hour*9)
+	if err != nil {
+		t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		args       []string
+		respStatus int
+		respBody   string
+		expCode    int
+		expOutput  string
+	}{
+		{
+			name:      "allowed",
+			respBody:  `{"result":{"allow":true}}`,
+			expCode:   exitAllow,
+			expOutput: `"allow": true`,
+		},
+		{
+			name:      "denied",
+			respBody:  `{"result":{"allow":false}}`,
+			expCode:   exitDeny,
+			expOutput: `"allow": false`,
+		},
+		{
+			name:      "undefined decision is denied",
+			respBody:  `{}`,
+			expCode:   exitDeny,
+			expOutput: `"allow": false`,
+		},
+		{
+			name:      "denied sql output",
+			args:      []string{`--output`, outputSQL},
+			respBody:  `{"result":{"allow":false}}`,
+			expCode:   exitDeny,
+			expOutput: `FALSE`,
+		},
+		{
+			name:       "opa error",
+			respStatus: http.StatusInternalServerError,
+			respBody:   `{"code":"internal_error","message":"boom"}`,
+			expCode:    exitError,
+		},
+		{
+			name:    "missing endpoint",
+			args:    []string{`--endpoint`, ``},
+			expCode: exitError,
+		},
+		{
+			name:    "invalid output",
+			args:    []string{`--output`, `yaml`},
+			expCode: exitError,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.respStatus != 0 {
+					w.WriteHeader(tt.respStatus)
+				}
+				w.Write([]byte(tt.respBody))
+			}))
+			defer svr.Close()
+
+			var out bytes.Buffer
+			defer func(w io.Writer) { stdout = w }(stdout)
+			stdout = &out
+			stderr := os.Stderr
+			os.Stderr, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			defer func() { os.Stderr.Close(); os.Stderr = stderr }()
+
+			args := append([]string{
+				`--opa`, svr.URL,
+				`--jwt`, jwt,
+				`--decision-doc`, `v1/data/authz/rbac/validate_v1`,
+				`--endpoint`, `Ipam.ListAddresses`,
+			}, tt.args...)
+			if gotCode := validate(args, nil); gotCode != tt.expCode {
+				t.Errorf("FAIL: validate() got exit code %d expected %d", gotCode, tt.expCode)
+			}
+			if !strings.Contains(out.String(), tt.expOutput) {
+				t.Errorf("FAIL: validate() got output %q expected to contain %q", out.String(), tt.expOutput)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// stdout is the writer of command results (replaced by tests)
+var stdout io.Writer = os.Stdout
+
+// tableFn returns the header and rows of a result for --output table
+type tableFn func() (header []string, rows [][]string)
+
+// sqlFn returns the SQL of a result for --output sql
+type sqlFn func() (string, error)
+
+// writeOutput writes result to stdout in the --output format.
+// toTable and toSQL may be nil if the result does not support the format.
+func writeOutput(format string, result interface{}, toTable tableFn, toSQL sqlFn) error {
+	w := stdout
+	switch {
+	case format == outputJSON:
+		resultJSON, err := json.MarshalIndent(result, ``, `  `)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(resultJSON))
+		return err
+
+	case format == outputTable && toTable != nil:
+		header, rows := toTable()
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+
+	case format == outputSQL && toSQL != nil:
+		sqlStr, err := toSQL()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, sqlStr)
+		return err
+	}
+
+	return fmt.Errorf("--output %s is not supported by this command", format)
+}
+
+// mapOfListsRows returns sorted table rows of key and comma-joined values
+func mapOfListsRows(m map[string][]string) [][]string {
+	rows := [][]string{}
+	for k, vals := range m {
+		sorted := append([]string{}, vals...)
+		sort.Strings(sorted)
+		rows = append(rows, []string{k, strings.Join(sorted, `,`)})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i][0] < rows[j][0]
+	})
+	return rows
+}
+
+// listRows returns table rows of one value each
+func listRows(vals []string) [][]string {
+	rows := make([][]string, 0, len(vals))
+	for _, val := range vals {
+		rows = append(rows, []string{val})
+	}
+	return rows
+}
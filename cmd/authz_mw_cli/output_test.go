@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestWriteOutput(t *testing.T) {
+	result := map[string][]string{
+		`ddi`: {`ipam`, `dns`},
+		`rpz`: {`threat`},
+	}
+	toTable := func() ([]string, [][]string) {
+		return []string{`APP`, `FEATURES`}, mapOfListsRows(result)
+	}
+	toSQL := func() (string, error) {
+		return `(ipam.compartment_id = 'red.')`, nil
+	}
+	sqlErr := errors.New("sql fail")
+
+	testCases := []struct {
+		name      string
+		format    string
+		toTable   tableFn
+		toSQL     sqlFn
+		expOutput string
+		expErr    error
+	}{
+		{
+			name:   "json",
+			format: outputJSON,
+			expOutput: `{
+  "ddi": [
+    "ipam",
+    "dns"
+  ],
+  "rpz": [
+    "threat"
+  ]
+}
+`,
+		},
+		{
+			name:    "table",
+			format:  outputTable,
+			toTable: toTable,
+			expOutput: "APP  FEATURES\n" +
+				"ddi  dns,ipam\n" +
+				"rpz  threat\n",
+		},
+		{
+			name:      "sql",
+			format:    outputSQL,
+			toSQL:     toSQL,
+			expOutput: "(ipam.compartment_id = 'red.')\n",
+		},
+		{
+			name:   "sql error",
+			format: outputSQL,
+			toSQL:  func() (string, error) { return ``, sqlErr },
+			expErr: sqlErr,
+		},
+		{
+			name:   "table not supported",
+			format: outputTable,
+			toSQL:  toSQL,
+			expErr: errors.New("--output table is not supported by this command"),
+		},
+		{
+			name:    "sql not supported",
+			format:  outputSQL,
+			toTable: toTable,
+			expErr:  errors.New("--output sql is not supported by this command"),
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			defer func(w io.Writer) { stdout = w }(stdout)
+			stdout = &out
+
+			gotErr := writeOutput(tt.format, result, tt.toTable, tt.toSQL)
+			if (gotErr == nil) != (tt.expErr == nil) || (gotErr != nil && gotErr.Error() != tt.expErr.Error()) {
+				t.Fatalf("FAIL: writeOutput() got err=%v expected %v", gotErr, tt.expErr)
+			}
+			if out.String() != tt.expOutput {
+				t.Errorf("FAIL: writeOutput() got output:\n%s\nexpected:\n%s", out.String(), tt.expOutput)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const replPrompt = `authz> `
+
+// replSettingRegexp matches valid setting names, ie: flag names
+var replSettingRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// repl is registered in init, as it runs the other commands
+func init() {
+	commands[`repl`] = command{repl,
+		`interactive session: set the JWT, endpoint, decision input... once, then run commands repeatedly`}
+}
+
+// replJWTArgRegexp matches the --jwt (or -jwt) flag of a command line, and its value
+var replJWTArgRegexp = regexp.MustCompile(`(?:^|[ \t])--?jwt(?:=|[ \t]+)("[^"]*"|'[^']*'|[^ \t]+)`)
+
+// replSession is an interactive session of the repl command.
+// Its settings are the flag defaults of the commands run in the session,
+// taking precedence over the AUTHZ_MW_<FLAG_NAME> environment variables (see parseFlags).
+type replSession struct {
+	settings    flagSettings
+	history     []string
+	historyFile *os.File
+	out         io.Writer
+}
+
+func repl(args []string, settings flagSettings) int {
+	var cf commonFlags
+	var historyPath string
+	fs := newFlagSet(`repl`, true, &cf)
+	fs.StringVar(&historyPath, `history-file`, ``, `file to load and save the command history`)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
+	}
+
+	// The JWT cannot be read from stdin, which is the input of the session
+	if cf.jwtFile == `-` {
+		return exitCode(usageErrorf(fs, "--jwt-file - is not supported by repl, stdin is the repl input"))
+	}
+
+	// Flags of the repl command are the initial settings of the session
+	sess := &replSession{settings: flagSettings{}, out: os.Stderr}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != `history-file` {
+			sess.settings[f.Name] = f.Value.String()
+		}
+	})
+	if len(historyPath) > 0 {
+		if raw, err := ioutil.ReadFile(historyPath); err == nil {
+			for _, line := range strings.Split(string(raw), "\n") {
+				if len(line) > 0 {
+					sess.history = append(sess.history, line)
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return exitCode(fmt.Errorf("read --history-file: %w", err))
+		}
+
+		historyFile, err := os.OpenFile(historyPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return exitCode(fmt.Errorf("open --history-file: %w", err))
+		}
+		defer historyFile.Close()
+		sess.historyFile = historyFile
+	}
+
+	fmt.Fprintln(sess.out, `Type "help" for help, "exit" to exit.`)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for {
+		fmt.Fprint(sess.out, replPrompt)
+		if !scanner.Scan() {
+			fmt.Fprintln(sess.out)
+			break
+		}
+
+		if done := sess.exec(scanner.Text()); done {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return exitCode(err)
+	}
+
+	return exitAllow
+}
+
+// exec executes a line of the session, returning true if the session is done
+func (sess *replSession) exec(line string) bool {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return false
+	}
+
+	// History expansion: !! is the previous line, !N is the Nth line of history
+	if strings.HasPrefix(line, `!`) {
+		expanded, err := sess.expandHistory(line)
+		if err != nil {
+			fmt.Fprintf(sess.out, "error: %s\n", err)
+			return false
+		}
+		line = expanded
+		fmt.Fprintln(sess.out, abbrevHistoryLine(line))
+	}
+
+	sess.addHistory(line)
+
+	name, rest := line, ``
+	if idx := strings.IndexAny(line, " \t"); idx >= 0 {
+		name, rest = line[:idx], strings.TrimSpace(line[idx+1:])
+	}
+
+	switch strings.ToLower(name) {
+	case `exit`, `quit`:
+		return true
+	case `help`:
+		sess.help()
+	case `history`:
+		for idx, histLine := range sess.history {
+			fmt.Fprintf(sess.out, "%5d  %s\n", idx+1, abbrevHistoryLine(histLine))
+		}
+	case `show`:
+		sess.show()
+	case `set`:
+		sess.set(rest)
+	case `unset`:
+		sess.unset(rest)
+	case `repl`:
+		fmt.Fprintln(sess.out, `error: already in repl`)
+	default:
+		cmd, ok := commands[strings.ToLower(name)]
+		if !ok {
+			fmt.Fprintf(sess.out, "error: unknown command `%s`, type \"help\" for help\n", name)
+			return false
+		}
+
+		args, err := splitArgs(rest)
+		if err != nil {
+			fmt.Fprintf(sess.out, "error: %s\n", err)
+			return false
+		}
+		if stdinJWTFile(args) {
+			fmt.Fprintln(sess.out, `error: --jwt-file - is not supported in repl, stdin is the repl input`)
+			return false
+		}
+
+		switch code := cmd.run(args, sess.settings); code {
+		case exitDeny:
+			fmt.Fprintf(sess.out, "[exit %d: denied]\n", code)
+		case exitError:
+			fmt.Fprintf(sess.out, "[exit %d: error]\n", code)
+		}
+	}
+
+	return false
+}
+
+func (sess *replSession) help() {
+	fmt.Fprint(sess.out, `Session commands:
+  set <flag> <value>   set a flag for all commands, eg: set jwt <jwt>, set endpoint Ipam.ListAddresses,
+                       set ctx [{"tags": {"dc": "dc-1"}}], set output table
+  unset <flag>         unset a flag
+  show                 show the flags set
+  history              show the command history
+  !!, !N               rerun the previous, or the Nth, command of history
+  exit, quit           exit
+Commands (with optional flags overriding the session flags, eg: validate --verb list):
+`)
+	cmdNames := make([]string, 0, len(commands))
+	for cmdName := range commands {
+		if cmdName != `repl` {
+			cmdNames = append(cmdNames, cmdName)
+		}
+	}
+	sort.Strings(cmdNames)
+	for _, cmdName := range cmdNames {
+		fmt.Fprintf(sess.out, "  %-32s%s\n", cmdName, commands[cmdName].summary)
+	}
+}
+
+// show prints the session flags, abbreviating the JWT
+func (sess *replSession) show() {
+	lines := []string{}
+	for name, val := range sess.settings {
+		// Empty settings only override the environment variables, eg: jwt-file once jwt is set
+		if len(val) == 0 {
+			continue
+		}
+		if name == `jwt` {
+			val = abbrevJWT(val)
+		}
+		lines = append(lines, fmt.Sprintf("  %-16s%s", name, val))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(sess.out, line)
+	}
+}
+
+// set sets the flag of "<flag> <value>" for all commands
+func (sess *replSession) set(arg string) {
+	if len(arg) == 0 {
+		sess.show()
+		return
+	}
+
+	name, val := splitSetting(arg)
+	if !replSettingRegexp.MatchString(name) {
+		fmt.Fprintf(sess.out, "error: invalid flag `%s`\n", name)
+		return
+	}
+
+	// --jwt has precedence over --jwt-file, so setting one clears the other
+	// (also overriding its environment variable, if set)
+	switch name {
+	case `jwt`:
+		sess.settings[`jwt-file`] = ``
+		val = strings.TrimPrefix(strings.TrimPrefix(val, `bearer `), `Bearer `)
+	case `jwt-file`:
+		if val == `-` {
+			fmt.Fprintln(sess.out, `error: jwt-file - is not supported in repl, stdin is the repl input`)
+			return
+		}
+		sess.settings[`jwt`] = ``
+	}
+
+	sess.settings[name] = val
+}
+
+// unset unsets the flags of arg, separated by spaces
+func (sess *replSession) unset(arg string) {
+	for _, name := range strings.Fields(arg) {
+		delete(sess.settings, strings.TrimLeft(name, `-`))
+	}
+}
+
+// addHistory adds line to the history (and history file, if any),
+// unless it's the same as the previous line.
+// Lines setting the JWT are not saved to the history file,
+// and --jwt values are redacted.
+func (sess *replSession) addHistory(line string) {
+	if len(sess.history) > 0 && sess.history[len(sess.history)-1] == line {
+		return
+	}
+	sess.history = append(sess.history, line)
+	if sess.historyFile != nil && !isSetJWTLine(line) {
+		fmt.Fprintln(sess.historyFile, replaceJWTArgs(line, func(string) string { return `REDACTED` }))
+	}
+}
+
+// expandHistory returns the history line of !! or !N
+func (sess *replSession) expandHistory(line string) (string, error) {
+	if len(sess.history) == 0 {
+		return ``, errors.New("history is empty")
+	}
+	if line == `!!` {
+		return sess.history[len(sess.history)-1], nil
+	}
+
+	num, err := strconv.Atoi(strings.TrimPrefix(line, `!`))
+	if err != nil || num < 1 || num > len(sess.history) {
+		return ``, fmt.Errorf("no history `%s`", line)
+	}
+	return sess.history[num-1], nil
+}
+
+// abbrevJWT returns jwt abbreviated for display
+func abbrevJWT(jwt string) string {
+	if len(jwt) <= 32 {
+		return jwt
+	}
+	return jwt[:16] + `...` + jwt[len(jwt)-8:]
+}
+
+// abbrevHistoryLine returns the history line for display,
+// abbreviating the JWT of "set jwt <jwt>" and of --jwt flags
+func abbrevHistoryLine(line string) string {
+	if isSetJWTLine(line) {
+		_, rest := splitSetting(line)
+		_, jwt := splitSetting(rest)
+		return `set jwt ` + abbrevJWT(jwt)
+	}
+	return replaceJWTArgs(line, abbrevJWT)
+}
+
+// isSetJWTLine returns whether line is "set jwt <jwt>" (or "set --jwt <jwt>")
+func isSetJWTLine(line string) bool {
+	name, rest := splitSetting(line)
+	if strings.ToLower(name) != `set` {
+		return false
+	}
+	setting, _ := splitSetting(rest)
+	return setting == `jwt`
+}
+
+// replaceJWTArgs returns line with the values of --jwt flags replaced by replaceFn
+func replaceJWTArgs(line string, replaceFn func(jwt string) string) string {
+	var replaced strings.Builder
+	prevEnd := 0
+	for _, loc := range replJWTArgRegexp.FindAllStringSubmatchIndex(line, -1) {
+		valStart, valEnd := loc[2], loc[3]
+		replaced.WriteString(line[prevEnd:valStart])
+		replaced.WriteString(replaceFn(strings.Trim(line[valStart:valEnd], `"'`)))
+		prevEnd = valEnd
+	}
+	replaced.WriteString(line[prevEnd:])
+	return replaced.String()
+}
+
+// stdinJWTFile returns whether args read the JWT from stdin, ie: --jwt-file -
+func stdinJWTFile(args []string) bool {
+	for idx, arg := range args {
+		switch strings.TrimLeft(arg, `-`) {
+		case `jwt-file=-`:
+			return true
+		case `jwt-file`:
+			if idx+1 < len(args) && args[idx+1] == `-` {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitSetting splits "<name> <value>" at the first space or tab,
+// trimming the leading dashes of name, eg: "--jwt <jwt>"
+func splitSetting(arg string) (string, string) {
+	name, val := strings.TrimSpace(arg), ``
+	if idx := strings.IndexAny(name, " \t"); idx >= 0 {
+		name, val = name[:idx], strings.TrimSpace(name[idx+1:])
+	}
+	return strings.TrimLeft(name, `-`), val
+}
+
+// splitArgs splits line into args separated by whitespace,
+// except within single or double quotes (which are removed)
+func splitArgs(line string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+
+	for _, ch := range line {
+		switch {
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(ch)
+		case ch == '\'' || ch == '"':
+			quote = ch
+			inArg = true
+		case ch == ' ' || ch == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(ch)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplSessionSettings(t *testing.T) {
+	t.Setenv(`AUTHZ_MW_JWT`, `env.jwt.value`)
+
+	testCases := []struct {
+		name        string
+		lines       []string
+		expSettings flagSettings
+		expOut      string
+	}{
+		{
+			name:        "set",
+			lines:       []string{`set endpoint Ipam.ListAddresses`, "set\tctx\t[{\"tags\": {}}]", `set --verb list`},
+			expSettings: flagSettings{`endpoint`: `Ipam.ListAddresses`, `ctx`: `[{"tags": {}}]`, `verb`: `list`},
+		},
+		{
+			name:        "set jwt clears jwt-file",
+			lines:       []string{`set jwt-file /tmp/jwt`, `set jwt Bearer some.jwt.value`},
+			expSettings: flagSettings{`jwt`: `some.jwt.value`, `jwt-file`: ``},
+		},
+		{
+			name:        "set jwt-file clears jwt",
+			lines:       []string{`set jwt some.jwt.value`, `set jwt-file /tmp/jwt`},
+			expSettings: flagSettings{`jwt`: ``, `jwt-file`: `/tmp/jwt`},
+		},
+		{
+			name:        "set jwt-file stdin rejected",
+			lines:       []string{`set jwt-file -`},
+			expSettings: flagSettings{},
+			expOut:      `error: jwt-file - is not supported in repl`,
+		},
+		{
+			name:        "invalid flag",
+			lines:       []string{`set Bogus value`},
+			expSettings: flagSettings{},
+			expOut:      "error: invalid flag `Bogus`",
+		},
+		{
+			name:        "unset",
+			lines:       []string{`set verb list`, `set type ddi.ipam`, `unset --verb type`},
+			expSettings: flagSettings{},
+		},
+		{
+			name:        "show abbreviates jwt",
+			lines:       []string{`set jwt 0123456789abcdef0123456789abcdef.sig`, `set output table`, `show`},
+			expSettings: flagSettings{`jwt`: `0123456789abcdef0123456789abcdef.sig`, `jwt-file`: ``, `output`: `table`},
+			expOut:      "  jwt             0123456789abcdef...cdef.sig\n  output          table\n",
+		},
+		{
+			name:        "command jwt-file stdin rejected",
+			lines:       []string{`current_user_compartments --jwt-file -`, `current_user_compartments --jwt-file=-`},
+			expSettings: flagSettings{},
+			expOut: "error: --jwt-file - is not supported in repl, stdin is the repl input\n" +
+				"error: --jwt-file - is not supported in repl, stdin is the repl input\n",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			sess := &replSession{settings: flagSettings{}, out: &out}
+			for _, line := range tt.lines {
+				if done := sess.exec(line); done {
+					t.Fatalf("FAIL: exec(%q) unexpected done", line)
+				}
+			}
+
+			if !reflect.DeepEqual(sess.settings, tt.expSettings) {
+				t.Errorf("FAIL: got settings %#v expected %#v", sess.settings, tt.expSettings)
+			}
+			if !strings.Contains(out.String(), tt.expOut) {
+				t.Errorf("FAIL: got output %q expected to contain %q", out.String(), tt.expOut)
+			}
+			// Settings are not kept in the environment
+			if env := os.Getenv(`AUTHZ_MW_JWT`); env != `env.jwt.value` {
+				t.Errorf("FAIL: got AUTHZ_MW_JWT=%q expected unchanged", env)
+			}
+		})
+	}
+}
+
+func TestReplHistoryFile(t *testing.T) {
+	const jwt = `eyJhbGciOiJIUzI1NiJ9.eyJhY2NvdW50X2lkIjoiNDAifQ.signature`
+
+	historyPath := filepath.Join(t.TempDir(), `history`)
+	historyFile, err := os.Create(historyPath)
+	if err != nil {
+		t.Fatalf("FAIL: Create() unexpected err=%v", err)
+	}
+	defer historyFile.Close()
+
+	var out bytes.Buffer
+	sess := &replSession{settings: flagSettings{}, historyFile: historyFile, out: &out}
+	for _, line := range []string{
+		`set jwt ` + jwt,
+		"set\tjwt\t" + jwt,
+		`set --jwt ` + jwt,
+		`set verb list`,
+		`bogus --jwt ` + jwt + ` --verb list`,
+		`bogus --jwt=` + jwt,
+		`bogus -jwt "` + jwt + `" --app ddi`,
+		`bogus --jwt-file /tmp/jwt`,
+	} {
+		sess.exec(line)
+	}
+
+	raw, err := ioutil.ReadFile(historyPath)
+	if err != nil {
+		t.Fatalf("FAIL: ReadFile() unexpected err=%v", err)
+	}
+	expHistory := "set verb list\n" +
+		"bogus --jwt REDACTED --verb list\n" +
+		"bogus --jwt=REDACTED\n" +
+		"bogus -jwt REDACTED --app ddi\n" +
+		"bogus --jwt-file /tmp/jwt\n"
+	if string(raw) != expHistory {
+		t.Errorf("FAIL: got history file:\n%s\nexpected:\n%s", raw, expHistory)
+	}
+
+	// The session history keeps the JWT, for history expansion
+	if len(sess.history) != 8 || !strings.Contains(sess.history[4], jwt) {
+		t.Errorf("FAIL: got session history %q", sess.history)
+	}
+
+	out.Reset()
+	sess.exec(`history`)
+	if strings.Contains(out.String(), jwt) {
+		t.Errorf("FAIL: history output contains the JWT: %s", out.String())
+	}
+	if !strings.Contains(out.String(), "    2  set jwt eyJhbGciOiJIUzI1...ignature\n") {
+		t.Errorf("FAIL: history output does not abbreviate the JWT: %s", out.String())
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	testCases := []struct {
+		line    string
+		expArgs []string
+		expErr  bool
+	}{
+		{line: ``, expArgs: []string{}},
+		{line: "validate  --verb\tlist ", expArgs: []string{`validate`, `--verb`, `list`}},
+		{line: `--ctx '[{"tags": {"dc": "dc-1"}}]'`, expArgs: []string{`--ctx`, `[{"tags": {"dc": "dc-1"}}]`}},
+		{line: `--app "" --type ddi.ipam`, expArgs: []string{`--app`, ``, `--type`, `ddi.ipam`}},
+		{line: `--ctx '[{"tags"`, expErr: true},
+	}
+
+	for _, tt := range testCases {
+		gotArgs, err := splitArgs(tt.line)
+		if (err != nil) != tt.expErr {
+			t.Errorf("FAIL: splitArgs(%q) got err=%v expected err=%v", tt.line, err, tt.expErr)
+		}
+		if !tt.expErr && !reflect.DeepEqual(gotArgs, tt.expArgs) {
+			t.Errorf("FAIL: splitArgs(%q) got %q expected %q", tt.line, gotArgs, tt.expArgs)
+		}
+	}
+}
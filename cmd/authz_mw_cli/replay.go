@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"github.com/open-policy-agent/opa/rego"
+
+	opamw "github.com/infobloxopen/atlas-authz-middleware/grpc_opa"
+	opacl "github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+const (
+	compareAllow  = `allow`
+	compareResult = `result`
+
+	// defaultDecisionPath is the decision queried by --rego-dir if no decision path,
+	// same as OPA's default decision
+	defaultDecisionPath = `system/main`
+
+	// maxRecordSize is the max size of a recorded decision line
+	maxRecordSize = 16 * 1024 * 1024
+)
+
+// replayRecord is a recorded decision: a line of the replay --input file.
+// Its fields are those of OPA decision logs, so they can be replayed as is.
+type replayRecord struct {
+	DecisionID string `json:"decision_id"`
+	// Path is the decision path (eg: authz/rbac/validate_v1), empty for the default decision
+	Path string `json:"path"`
+	// Input is the Payload sent by the middleware
+	Input interface{} `json:"input"`
+	// Result is the decision document, absent if undefined
+	Result interface{} `json:"result"`
+}
+
+// replayDiff is a replayed decision that differs from the recorded decision, or failed
+type replayDiff struct {
+	Line       int         `json:"line"`
+	DecisionID string      `json:"decision_id,omitempty"`
+	Path       string      `json:"path"`
+	Recorded   interface{} `json:"recorded"`
+	Replayed   interface{} `json:"replayed"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// replayResult is the output of the replay command
+type replayResult struct {
+	Total  int          `json:"total"`
+	Same   int          `json:"same"`
+	Differ int          `json:"differ"`
+	Errors int          `json:"errors"`
+	Diffs  []replayDiff `json:"diffs"`
+}
+
+// replayEvaluator returns the decision document at decision path for input,
+// or nil if undefined
+type replayEvaluator func(ctx context.Context, path string, input interface{}) (interface{}, error)
+
+type replayFlags struct {
+	commonFlags
+	input       string
+	regoDir     string
+	decisionDoc string
+	compare     string
+	ignore      commaListValue
+}
+
+func replay(args []string, settings flagSettings) int {
+	var rf replayFlags
+	fs := newFlagSet(`replay`, false, &rf.commonFlags)
+	fs.StringVar(&rf.input, `input`, ``, `JSON-lines file of recorded decisions ('-' for stdin) (required), `+
+		`each line in OPA decision log format: {"decision_id": ..., "path": ..., "input": <Payload>, "result": ...}`)
+	fs.StringVar(&rf.regoDir, `rego-dir`, ``, `evaluate the Rego policies (and JSON data) in this directory, instead of querying --opa`)
+	fs.StringVar(&rf.decisionDoc, `decision-doc`, ``, `decision document to replay against, instead of the recorded decision path`)
+	fs.StringVar(&rf.compare, `compare`, compareAllow, `compare the decisions by: allow, or result (entire decision document)`)
+	fs.Var(&rf.ignore, `ignore`, `comma-separated decision document fields to ignore with --compare result (eg: request_id)`)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
+	}
+
+	if len(rf.input) == 0 {
+		return exitCode(usageErrorf(fs, "--input is required"))
+	}
+	if rf.compare != compareAllow && rf.compare != compareResult {
+		return exitCode(usageErrorf(fs, "invalid --compare `%s`", rf.compare))
+	}
+
+	ctx, err := rf.newContext(fs)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	evaluator, err := rf.evaluator()
+	if err != nil {
+		return exitCode(err)
+	}
+
+	rdr := os.Stdin
+	if rf.input != `-` {
+		rdr, err = os.Open(rf.input)
+		if err != nil {
+			return exitCode(err)
+		}
+		defer rdr.Close()
+	}
+
+	result, err := rf.replay(ctx, rdr, evaluator)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	toTable := func() ([]string, [][]string) {
+		rows := [][]string{}
+		for _, diff := range result.Diffs {
+			replayed := jsonString(diff.Replayed)
+			if len(diff.Error) > 0 {
+				replayed = `error: ` + diff.Error
+			}
+			rows = append(rows, []string{fmt.Sprint(diff.Line), diff.DecisionID, diff.Path,
+				jsonString(diff.Recorded), replayed})
+		}
+		rows = append(rows, []string{fmt.Sprintf("total=%d same=%d differ=%d errors=%d",
+			result.Total, result.Same, result.Differ, result.Errors)})
+		return []string{`LINE`, `DECISION_ID`, `PATH`, `RECORDED`, `REPLAYED`}, rows
+	}
+
+	if err := writeOutput(rf.output, result, toTable, nil); err != nil {
+		return exitCode(err)
+	}
+
+	switch {
+	case result.Errors > 0:
+		return exitError
+	case result.Differ > 0:
+		return exitDeny
+	}
+	return exitAllow
+}
+
+// evaluator returns the replayEvaluator of --rego-dir, otherwise of --opa
+func (rf *replayFlags) evaluator() (replayEvaluator, error) {
+	if len(rf.regoDir) > 0 {
+		if _, err := os.Stat(rf.regoDir); err != nil {
+			return nil, fmt.Errorf("--rego-dir: %w", err)
+		}
+		return regoDirEvaluator(rf.regoDir), nil
+	}
+	return opaEvaluator(opacl.New(rf.opaAddress())), nil
+}
+
+// replay replays each recorded decision read from rdr with evaluator
+func (rf *replayFlags) replay(ctx context.Context, rdr io.Reader, evaluator replayEvaluator) (*replayResult, error) {
+	loggr := ctxlogrus.Extract(ctx)
+	result := &replayResult{Diffs: []replayDiff{}}
+
+	ignore := map[string]bool{}
+	for _, field := range rf.ignore {
+		ignore[field] = true
+	}
+
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		var record replayRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("--input line %d: %w", lineNum, err)
+		}
+		if record.Input == nil {
+			return nil, fmt.Errorf("--input line %d: missing input", lineNum)
+		}
+
+		path := decisionPath(record.Path)
+		if len(rf.decisionDoc) > 0 {
+			path = decisionPath(rf.decisionDoc)
+		}
+
+		result.Total++
+		replayed, err := evaluator(ctx, path, record.Input)
+		loggr.Debugf("line=%d path=`%s` recorded=%v replayed=%v err=%v", lineNum, path, record.Result, replayed, err)
+
+		diff := replayDiff{
+			Line:       lineNum,
+			DecisionID: record.DecisionID,
+			Path:       path,
+			Recorded:   record.Result,
+			Replayed:   replayed,
+		}
+
+		switch {
+		case err != nil:
+			result.Errors++
+			diff.Error = err.Error()
+		case rf.compare == compareAllow && decisionAllow(record.Result) == decisionAllow(replayed):
+			result.Same++
+			continue
+		case rf.compare == compareResult &&
+			reflect.DeepEqual(normalizeDecision(record.Result, ignore), normalizeDecision(replayed, ignore)):
+			result.Same++
+			continue
+		default:
+			result.Differ++
+		}
+
+		if rf.compare == compareAllow && err == nil {
+			diff.Recorded = decisionAllow(record.Result)
+			diff.Replayed = decisionAllow(replayed)
+		}
+		result.Diffs = append(result.Diffs, diff)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read --input: %w", err)
+	}
+
+	return result, nil
+}
+
+// opaEvaluator returns a replayEvaluator querying OPA with clienter
+func opaEvaluator(clienter opacl.Clienter) replayEvaluator {
+	return func(ctx context.Context, path string, input interface{}) (interface{}, error) {
+		// As the middleware does: the default decision is queried with the unencapsulated input,
+		// and returns the unencapsulated decision document (see DefaultAuthorizer.Evaluate)
+		if len(path) == 0 {
+			var doc interface{}
+			err := clienter.Query(ctx, input, &doc)
+			return doc, err
+		}
+
+		var resp map[string]interface{}
+		err := clienter.CustomQuery(ctx, `v1/data/`+path, opamw.OPARequest{Input: input}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[`result`], nil
+	}
+}
+
+// regoDirEvaluator returns a replayEvaluator evaluating the policies in regoDir.
+// The policies are loaded (and prepared) once per decision path.
+func regoDirEvaluator(regoDir string) replayEvaluator {
+	prepared := map[string]rego.PreparedEvalQuery{}
+	return func(ctx context.Context, path string, input interface{}) (interface{}, error) {
+		if len(path) == 0 {
+			path = defaultDecisionPath
+		}
+
+		query, ok := prepared[path]
+		if !ok {
+			var err error
+			query, err = rego.New(
+				rego.Query(`data.`+strings.Replace(path, `/`, `.`, -1)),
+				rego.Load([]string{regoDir}, nil),
+			).PrepareForEval(ctx)
+			if err != nil {
+				return nil, err
+			}
+			prepared[path] = query
+		}
+
+		rs, err := query.Eval(ctx, rego.EvalInput(input))
+		if err != nil {
+			return nil, err
+		}
+		if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+			return nil, nil
+		}
+		return rs[0].Expressions[0].Value, nil
+	}
+}
+
+// decisionPath returns the decision path (eg: authz/rbac/validate_v1)
+// of a decision document (eg: /v1/data/authz/rbac/validate_v1)
+func decisionPath(decisionDoc string) string {
+	path := strings.Trim(decisionDoc, `/`)
+	path = strings.TrimPrefix(path, `v1/`)
+	path = strings.TrimPrefix(path, `data/`)
+	if path == `data` {
+		return ``
+	}
+	return path
+}
+
+// decisionAllow returns the allow of a decision document: either a boolean,
+// or the "allow" field of an object. An undefined decision is not allowed.
+func decisionAllow(doc interface{}) bool {
+	switch val := doc.(type) {
+	case bool:
+		return val
+	case map[string]interface{}:
+		allow, _ := val[`allow`].(bool)
+		return allow
+	}
+	return false
+}
+
+// normalizeDecision returns doc as decoded from JSON, without the ignore fields,
+// so that recorded and replayed decision documents can be compared
+func normalizeDecision(doc interface{}, ignore map[string]bool) interface{} {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return doc
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(raw, &normalized); err != nil {
+		return doc
+	}
+
+	if docMap, ok := normalized.(map[string]interface{}); ok {
+		for field := range ignore {
+			delete(docMap, field)
+		}
+	}
+	return normalized
+}
+
+// jsonString returns the compact JSON of val
+func jsonString(val interface{}) string {
+	raw, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+	return string(raw)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+)
+
+func TestReplay(t *testing.T) {
+	ctx := ctxlogrus.ToContext(context.Background(), logrus.NewEntry(logrus.StandardLogger()))
+
+	type diffLine struct {
+		line     int
+		recorded interface{}
+		replayed interface{}
+		err      bool
+	}
+
+	testCases := []struct {
+		name        string
+		compare     string
+		ignore      []string
+		decisionDoc string
+		expTotal    int
+		expSame     int
+		expDiffer   int
+		expErrors   int
+		expDiffs    []diffLine
+	}{
+		{
+			name:      "compare allow",
+			compare:   compareAllow,
+			expTotal:  4,
+			expSame:   2,
+			expDiffer: 1,
+			expErrors: 1,
+			expDiffs: []diffLine{
+				{line: 2, recorded: true, replayed: false},
+				{line: 5, recorded: float64(1), err: true},
+			},
+		},
+		{
+			name:      "compare result",
+			compare:   compareResult,
+			expTotal:  4,
+			expSame:   1,
+			expDiffer: 2,
+			expErrors: 1,
+			expDiffs: []diffLine{
+				{line: 1,
+					recorded: map[string]interface{}{"allow": true, "request_id": "recorded-r1"},
+					replayed: map[string]interface{}{"allow": true, "request_id": "r1"}},
+				{line: 2,
+					recorded: map[string]interface{}{"allow": true, "request_id": "r2"},
+					replayed: map[string]interface{}{"allow": false, "request_id": "r2"}},
+				{line: 5, recorded: float64(1), err: true},
+			},
+		},
+		{
+			name:      "compare result ignoring request_id",
+			compare:   compareResult,
+			ignore:    []string{`request_id`},
+			expTotal:  4,
+			expSame:   2,
+			expDiffer: 1,
+			expErrors: 1,
+			expDiffs: []diffLine{
+				{line: 2,
+					recorded: map[string]interface{}{"allow": true, "request_id": "r2"},
+					replayed: map[string]interface{}{"allow": false, "request_id": "r2"}},
+				{line: 5, recorded: float64(1), err: true},
+			},
+		},
+		{
+			name:        "decision-doc overrides recorded path",
+			compare:     compareAllow,
+			decisionDoc: `/v1/data/system/main`,
+			expTotal:    4,
+			expSame:     2,
+			expDiffer:   2,
+			expDiffs: []diffLine{
+				{line: 1, recorded: true, replayed: false},
+				{line: 2, recorded: true, replayed: false},
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			rdr, err := os.Open(`testdata/replay_decisions.jsonl`)
+			if err != nil {
+				t.Fatalf("FAIL: Open() unexpected err=%v", err)
+			}
+			defer rdr.Close()
+
+			rf := replayFlags{
+				compare:     tt.compare,
+				ignore:      tt.ignore,
+				decisionDoc: tt.decisionDoc,
+			}
+			result, err := rf.replay(ctx, rdr, regoDirEvaluator(`testdata/replay`))
+			if err != nil {
+				t.Fatalf("FAIL: replay() unexpected err=%v", err)
+			}
+
+			if result.Total != tt.expTotal || result.Same != tt.expSame ||
+				result.Differ != tt.expDiffer || result.Errors != tt.expErrors {
+				t.Errorf("FAIL: got total=%d same=%d differ=%d errors=%d expected %d %d %d %d",
+					result.Total, result.Same, result.Differ, result.Errors,
+					tt.expTotal, tt.expSame, tt.expDiffer, tt.expErrors)
+			}
+
+			if len(result.Diffs) != len(tt.expDiffs) {
+				t.Fatalf("FAIL: got %d diffs expected %d: %#v", len(result.Diffs), len(tt.expDiffs), result.Diffs)
+			}
+			for idx, expDiff := range tt.expDiffs {
+				gotDiff := result.Diffs[idx]
+				if gotDiff.Line != expDiff.line || (len(gotDiff.Error) > 0) != expDiff.err {
+					t.Errorf("FAIL: diff #%d got line=%d error=%q expected line=%d error=%v",
+						idx, gotDiff.Line, gotDiff.Error, expDiff.line, expDiff.err)
+				}
+				if !reflect.DeepEqual(gotDiff.Recorded, expDiff.recorded) {
+					t.Errorf("FAIL: diff #%d got recorded %#v expected %#v", idx, gotDiff.Recorded, expDiff.recorded)
+				}
+				if !expDiff.err && !reflect.DeepEqual(normalizeDecision(gotDiff.Replayed, nil), expDiff.replayed) {
+					t.Errorf("FAIL: diff #%d got replayed %#v expected %#v", idx, gotDiff.Replayed, expDiff.replayed)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayInvalidInput(t *testing.T) {
+	ctx := ctxlogrus.ToContext(context.Background(), logrus.NewEntry(logrus.StandardLogger()))
+
+	for input, expErr := range map[string]string{
+		"{\"input\":{}}\nnot json\n":        `--input line 2:`,
+		`{"path":"authz/rbac/validate_v1"}`: `--input line 1: missing input`,
+	} {
+		rf := replayFlags{compare: compareAllow}
+		_, err := rf.replay(ctx, strings.NewReader(input), regoDirEvaluator(`testdata/replay`))
+		if err == nil || !strings.HasPrefix(err.Error(), expErr) {
+			t.Errorf("FAIL: replay(%q) got err=%v expected %s", input, err, expErr)
+		}
+	}
+}
+
+func TestDecisionPath(t *testing.T) {
+	for decisionDoc, expPath := range map[string]string{
+		``:                                ``,
+		`/v1/data`:                        ``,
+		`data`:                            ``,
+		`authz/rbac/validate_v1`:          `authz/rbac/validate_v1`,
+		`/v1/data/authz/rbac/validate_v1`: `authz/rbac/validate_v1`,
+		`v1/data/authz/rbac/validate_v1/`: `authz/rbac/validate_v1`,
+		`data/system/main`:                `system/main`,
+	} {
+		if got := decisionPath(decisionDoc); got != expPath {
+			t.Errorf("FAIL: decisionPath(%q) got %q expected %q", decisionDoc, got, expPath)
+		}
+	}
+}
+
+func TestDecisionAllow(t *testing.T) {
+	testCases := []struct {
+		doc      interface{}
+		expAllow bool
+	}{
+		{doc: nil},
+		{doc: true, expAllow: true},
+		{doc: false},
+		{doc: map[string]interface{}{"allow": true}, expAllow: true},
+		{doc: map[string]interface{}{"allow": false}},
+		{doc: map[string]interface{}{"allow": "true"}},
+		{doc: map[string]interface{}{"obligations": []interface{}{}}},
+		{doc: []interface{}{true}},
+	}
+
+	for idx, tt := range testCases {
+		if got := decisionAllow(tt.doc); got != tt.expAllow {
+			t.Errorf("FAIL: test case #%d decisionAllow(%#v) got %v expected %v", idx, tt.doc, got, tt.expAllow)
+		}
+	}
+}
+
+func TestNormalizeDecision(t *testing.T) {
+	type typedDecision struct {
+		Allow     bool   `json:"allow"`
+		RequestID string `json:"request_id"`
+		Count     int    `json:"count"`
+	}
+
+	testCases := []struct {
+		name   string
+		doc    interface{}
+		ignore map[string]bool
+		expDoc interface{}
+	}{
+		{
+			name:   "undefined",
+			expDoc: nil,
+		},
+		{
+			name:   "boolean",
+			doc:    true,
+			ignore: map[string]bool{"allow": true},
+			expDoc: true,
+		},
+		{
+			name:   "typed decision as JSON",
+			doc:    typedDecision{Allow: true, RequestID: "r1", Count: 2},
+			expDoc: map[string]interface{}{"allow": true, "request_id": "r1", "count": float64(2)},
+		},
+		{
+			name:   "ignored fields",
+			doc:    map[string]interface{}{"allow": true, "request_id": "r1", "count": 2},
+			ignore: map[string]bool{"request_id": true, "count": true},
+			expDoc: map[string]interface{}{"allow": true},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeDecision(tt.doc, tt.ignore); !reflect.DeepEqual(got, tt.expDoc) {
+				t.Errorf("FAIL: normalizeDecision() got %#v expected %#v", got, tt.expDoc)
+			}
+		})
+	}
+}
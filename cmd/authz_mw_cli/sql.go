@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	opamw "github.com/infobloxopen/atlas-authz-middleware/grpc_opa"
+	"github.com/infobloxopen/seal/pkg/compiler/sql"
+)
+
+// typeMappingFile is the --type-mapping JSON file,
+// mapping SEAL swagger types (eg: "ddi.ipam", or "ddi.*" for any ddi type)
+// to SQL tables, and their properties to SQL columns. Eg:
+//
+//	{
+//	  "ddi.*": {
+//	    "table": "*",
+//	    "properties": {
+//	      "tags": {"column": "tags", "jsonb_operator": "->>"},
+//	      "*": {"column": "*"}
+//	    }
+//	  }
+//	}
+//
+// Table (or column) "*" maps to the matched type (or property) name,
+// and defaults to the type (or property) name if omitted.
+type typeMappingFile map[string]struct {
+	Table      string `json:"table"`
+	Properties map[string]struct {
+		Column        string `json:"column"`
+		JSONBOperator string `json:"jsonb_operator"`
+		JSONBIntKey   bool   `json:"jsonb_int_key"`
+	} `json:"properties"`
+}
+
+// loadSQLCompiler returns a PostgreSQL SEAL compiler with the type mappings in typeMappingPath,
+// or without type mappings if typeMappingPath is empty.
+func loadSQLCompiler(typeMappingPath string) (*sqlcompiler.SQLCompiler, error) {
+	sqlc := sqlcompiler.NewSQLCompiler().WithDialect(sqlcompiler.DialectPostgres)
+	if len(typeMappingPath) == 0 {
+		return sqlc, nil
+	}
+
+	raw, err := ioutil.ReadFile(typeMappingPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings typeMappingFile
+	if err := json.Unmarshal(raw, &mappings); err != nil {
+		return nil, err
+	}
+
+	for swType, typeMapping := range mappings {
+		tmpr := sqlcompiler.NewTypeMapper(swType)
+		if len(typeMapping.Table) > 0 {
+			tmpr.ToSQLTable(typeMapping.Table)
+		}
+
+		for ppty, pptyMapping := range typeMapping.Properties {
+			pmpr := sqlcompiler.NewPropertyMapper(ppty).UseJSONBIntKeyFlag(pptyMapping.JSONBIntKey)
+			if len(pptyMapping.Column) > 0 {
+				pmpr.ToSQLColumn(pptyMapping.Column)
+			}
+			if len(pptyMapping.JSONBOperator) > 0 {
+				pmpr.UseJSONBOperator(pptyMapping.JSONBOperator)
+			}
+			tmpr.WithPropertyMapper(pmpr)
+		}
+
+		sqlc.WithTypeMapper(tmpr)
+	}
+
+	return sqlc, nil
+}
+
+// obligationsSQLResult is the output of the obligations_sql command
+type obligationsSQLResult struct {
+	Allow                 bool                   `json:"allow"`
+	Obligations           *opamw.ObligationsNode `json:"obligations,omitempty"`
+	ObligationsTree       []string               `json:"obligations_tree,omitempty"`
+	SQL                   string                 `json:"sql"`
+	EntitledFeaturesJSONB string                 `json:"entitled_features_jsonb,omitempty"`
+}
+
+func obligations_sql(args []string, settings flagSettings) int {
+	var vf validateFlags
+	fs := newValidateFlagSet(`obligations_sql`, &vf)
+	if err := parseFlags(fs, args, settings); err != nil {
+		return exitCode(err)
+	}
+
+	vResult, resultCtx, err := vf.evaluate(fs)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	result := obligationsSQLResult{
+		Allow:           vResult.Allow,
+		Obligations:     vResult.Obligations,
+		ObligationsTree: obligationsTree(vResult.Obligations, ``),
+	}
+
+	result.SQL, err = vResult.sql()
+	if err != nil {
+		return exitCode(err)
+	}
+
+	result.EntitledFeaturesJSONB, _, err = opamw.EntitlementsCtxOp(resultCtx).ToJSONBArrStmt()
+	if err != nil {
+		return exitCode(err)
+	}
+
+	toTable := func() ([]string, [][]string) {
+		rows := [][]string{
+			{`allow`, fmt.Sprint(result.Allow)},
+		}
+		for idx, line := range result.ObligationsTree {
+			key := ``
+			if idx == 0 {
+				key = `obligations`
+			}
+			rows = append(rows, []string{key, line})
+		}
+		rows = append(rows, []string{`sql`, result.SQL})
+		if len(result.EntitledFeaturesJSONB) > 0 {
+			rows = append(rows, []string{`entitled_features_jsonb`, result.EntitledFeaturesJSONB})
+		}
+		return []string{`KEY`, `VALUE`}, rows
+	}
+
+	if err := writeOutput(vf.output, result, toTable, vResult.sql); err != nil {
+		return exitCode(err)
+	}
+
+	return vResult.exitCode()
+}
+
+// obligationsTree returns the obligations tree as indented lines,
+// one per node: the operator (and tag if any) or the condition
+func obligationsTree(o8n *opamw.ObligationsNode, indent string) []string {
+	if o8n.IsShallowEmpty() {
+		return nil
+	}
+
+	if o8n.Kind == opamw.ObligationsCondition {
+		return []string{indent + o8n.Condition}
+	}
+
+	line := indent + strings.ToUpper(strings.TrimPrefix(o8n.Kind.String(), `Obligations`))
+	if len(o8n.Tag) > 0 {
+		line += ` [` + o8n.Tag + `]`
+	}
+
+	lines := []string{line}
+	for _, childNode := range o8n.Children {
+		lines = append(lines, obligationsTree(childNode, indent+`  `)...)
+	}
+	return lines
+}
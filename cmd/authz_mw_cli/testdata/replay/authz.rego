@@ -0,0 +1,23 @@
+package authz.rbac
+
+# Test rego for the replay command.
+
+default allow = false
+
+allow {
+	input.endpoint == "Ipam.ListAddresses"
+}
+
+validate_v1 = {
+	"allow": allow,
+	"request_id": input.request_id,
+}
+
+# conflict fails evaluation with a conflicting complete rule error
+conflict = 1 {
+	true
+}
+
+conflict = 2 {
+	true
+}
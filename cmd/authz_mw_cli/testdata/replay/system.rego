@@ -0,0 +1,14 @@
+package system
+
+# Test rego for the replay command: OPA's default decision (data.system.main).
+
+default allow = false
+
+allow {
+	input.application == "automobile"
+	input.endpoint == "Vehicle.StompGasPedal"
+}
+
+main = {
+	"allow": allow,
+}
@@ -2,7 +2,9 @@ package grpc_opa_middleware
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
 	logrus "github.com/sirupsen/logrus"
@@ -97,3 +99,140 @@ func (a *DefaultAuthorizer) GetAcctEntitlements(ctx context.Context, accountIDs,
 
 	return acctResult.Result, nil
 }
+
+// AcctEntitlementsFn is called by StreamAcctEntitlements for each account,
+// with the account's map of service to array of features.
+// Returning an error stops the stream, and the error is returned by StreamAcctEntitlements.
+type AcctEntitlementsFn func(acctID string, svcFeats map[string][]string) error
+
+// StreamAcctEntitlements queries account entitled features data
+// for the specified account-ids and entitled-services,
+// decoding the OPA response incrementally and calling fn for each account,
+// so the full result is never held in memory at once.
+// Intended for large results, such as all entitled-services in all accounts.
+// If both account-ids and entitled-services are empty,
+// then data for all entitled-services in all accounts are returned.
+//
+// Combine with opa_client.WithMaxResponseSize to bound the response size,
+// in which case an error matching opa_client.ErrResponseTooLarge is returned
+// when the limit is exceeded (fn may have already been called for some accounts).
+func (a *DefaultAuthorizer) StreamAcctEntitlements(ctx context.Context, accountIDs, serviceNames []string, fn AcctEntitlementsFn) error {
+	lgNtry := ctxlogrus.Extract(ctx)
+
+	if accountIDs == nil {
+		accountIDs = []string{}
+	}
+	if serviceNames == nil {
+		serviceNames = []string{}
+	}
+
+	opaReq := OPARequest{
+		Input: &AcctEntitlementsApiInput{
+			AccountIDs:   accountIDs,
+			ServiceNames: serviceNames,
+		},
+	}
+
+	postReqBody, err := json.Marshal(opaReq)
+	if err != nil {
+		lgNtry.WithError(err).Error("stream_acct_entitlements_marshal_fail")
+		return err
+	}
+
+	nAccts := 0
+	respRdrFn := func(rdr io.Reader) error {
+		return decodeAcctEntitlementsStream(rdr, func(acctID string, svcFeats map[string][]string) error {
+			nAccts++
+			return fn(acctID, svcFeats)
+		})
+	}
+
+	err = a.clienter.CustomQueryStream(ctx, a.acctEntitlementsApi, postReqBody, respRdrFn)
+	if err != nil {
+		lgNtry.WithError(err).Error("stream_acct_entitlements_fail")
+		return err
+	}
+
+	lgNtry.WithFields(logrus.Fields{
+		"nAccts": nAccts,
+	}).Trace("stream_acct_entitlements_okay")
+
+	return nil
+}
+
+// decodeAcctEntitlementsStream decodes an acct_entitlements_api response
+// (see AcctEntitlementsApiResult) one account at a time, calling fn for each account.
+// A missing or null result calls fn for no accounts.
+func decodeAcctEntitlementsStream(rdr io.Reader, fn AcctEntitlementsFn) error {
+	dec := json.NewDecoder(rdr)
+
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if key != "result" {
+			// Skip other top-level keys, eg: decision_id
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := decodeAcctEntitlementsResult(dec, fn); err != nil {
+			return err
+		}
+	}
+
+	return expectJSONDelim(dec, '}')
+}
+
+// decodeAcctEntitlementsResult decodes the result object, one account at a time
+func decodeAcctEntitlementsResult(dec *json.Decoder, fn AcctEntitlementsFn) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("acct_entitlements_api result: expected object, got %v", tok)
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		acctID, _ := tok.(string)
+
+		var svcFeats map[string][]string
+		if err := dec.Decode(&svcFeats); err != nil {
+			return err
+		}
+
+		if err := fn(acctID, svcFeats); err != nil {
+			return err
+		}
+	}
+
+	return expectJSONDelim(dec, '}')
+}
+
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("acct_entitlements_api response: expected %v, got %v", delim, tok)
+	}
+	return nil
+}
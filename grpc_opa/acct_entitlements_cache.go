@@ -0,0 +1,296 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultAcctEntitlementsRefreshInterval is the default interval between
+	// background refreshes of the AcctEntitlementsCache
+	DefaultAcctEntitlementsRefreshInterval = 5 * time.Minute
+
+	// DefaultAcctEntitlementsMaxFallbackEntries is the default max number of
+	// fallback results (see HasFeature) kept until the next refresh
+	DefaultAcctEntitlementsMaxFallbackEntries = 10000
+)
+
+// AcctEntitlementsCacheOption configures an AcctEntitlementsCache
+type AcctEntitlementsCacheOption func(c *AcctEntitlementsCache)
+
+// WithAcctEntitlementsServices restricts the cached entitlements to
+// the entitled-services serviceNames (default: all entitled-services)
+func WithAcctEntitlementsServices(serviceNames ...string) AcctEntitlementsCacheOption {
+	return func(c *AcctEntitlementsCache) {
+		c.serviceNames = serviceNames
+	}
+}
+
+// WithAcctEntitlementsRefreshInterval overrides DefaultAcctEntitlementsRefreshInterval
+// (used if refresh is not positive)
+func WithAcctEntitlementsRefreshInterval(refresh time.Duration) AcctEntitlementsCacheOption {
+	return func(c *AcctEntitlementsCache) {
+		c.refreshInterval = refresh
+	}
+}
+
+// WithAcctEntitlementsMaxFallbackEntries overrides DefaultAcctEntitlementsMaxFallbackEntries
+// (used if maxEntries is not positive)
+func WithAcctEntitlementsMaxFallbackEntries(maxEntries int) AcctEntitlementsCacheOption {
+	return func(c *AcctEntitlementsCache) {
+		c.maxFallbackEntries = maxEntries
+	}
+}
+
+// acctFeatureSets is map of acct_id to map of service to set of features
+type acctFeatureSets map[string]map[string]map[string]struct{}
+
+// AcctEntitlementsCache holds the entitlements (see GetAcctEntitlements) of all accounts
+// for the configured entitled-services in memory, refreshed periodically in the background by Run.
+// HasFeature lookups are served from memory, falling back to a direct query
+// for accounts or services missing from the cache (eg: accounts created since the last refresh).
+// Fallback results are kept until the next refresh, up to the max fallback entries
+// (beyond which the oldest are evicted, eg: while refreshes fail).
+//
+//	cache := NewAcctEntitlementsCache(authzer, WithAcctEntitlementsServices("environment", "wheel"))
+//	go cache.Run(ctx)
+//	ok, err := cache.HasFeature(ctx, acctID, "wheel", "abs")
+type AcctEntitlementsCache struct {
+	// Accessed atomically, first for 64-bit alignment
+	hits   uint64
+	misses uint64
+
+	authzer            *DefaultAuthorizer
+	serviceNames       []string
+	serviceSet         map[string]struct{}
+	refreshInterval    time.Duration
+	maxFallbackEntries int
+	now                func() time.Time
+
+	mu       sync.RWMutex
+	entitled acctFeatureSets
+	fallback acctFeatureSets
+	// fallbackKeys are the acct_id and service of the fallback results, oldest first
+	fallbackKeys [][2]string
+	// generation is incremented by each successful refresh
+	generation  uint64
+	refreshedAt time.Time
+	refreshErr  error
+}
+
+// AcctEntitlementsCacheStats describes the state of an AcctEntitlementsCache
+type AcctEntitlementsCacheStats struct {
+	// RefreshedAt is the time of the last successful refresh, zero if none
+	RefreshedAt time.Time
+	// Staleness is the time elapsed since RefreshedAt, zero if never refreshed
+	Staleness time.Duration
+	// RefreshError is the error of the last refresh, if it failed
+	RefreshError error
+	// NumAccts is the number of accounts with entitlements in the cache
+	NumAccts int
+	// Hits and Misses are the number of HasFeature lookups served from memory or not
+	Hits   uint64
+	Misses uint64
+}
+
+// NewAcctEntitlementsCache returns an empty AcctEntitlementsCache querying authzer.
+// Call Run (or Refresh) to load it.
+func NewAcctEntitlementsCache(authzer *DefaultAuthorizer, opts ...AcctEntitlementsCacheOption) *AcctEntitlementsCache {
+	c := &AcctEntitlementsCache{
+		authzer:            authzer,
+		refreshInterval:    DefaultAcctEntitlementsRefreshInterval,
+		maxFallbackEntries: DefaultAcctEntitlementsMaxFallbackEntries,
+		now:                time.Now,
+		fallback:           acctFeatureSets{},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.refreshInterval <= 0 {
+		c.refreshInterval = DefaultAcctEntitlementsRefreshInterval
+	}
+	if c.maxFallbackEntries <= 0 {
+		c.maxFallbackEntries = DefaultAcctEntitlementsMaxFallbackEntries
+	}
+	c.serviceSet = newFeatureSet(c.serviceNames)
+
+	return c
+}
+
+// Run refreshes the cache immediately, then every refresh interval, until ctx is done.
+// Refresh errors are logged, and the previous entitlements kept (see Stats).
+// Returns ctx.Err().
+func (c *AcctEntitlementsCache) Run(ctx context.Context) error {
+	lgNtry := ctxlogrus.Extract(ctx)
+
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+			lgNtry.WithError(err).Error("acct_entitlements_cache_refresh_fail")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh reloads the entitlements of all accounts for the configured entitled-services.
+// The cached entitlements are kept if reloading fails.
+func (c *AcctEntitlementsCache) Refresh(ctx context.Context) error {
+	entitled := acctFeatureSets{}
+	err := c.authzer.StreamAcctEntitlements(ctx, nil, c.serviceNames, func(acctID string, svcFeats map[string][]string) error {
+		entitled[acctID] = newSvcFeatureSets(svcFeats)
+		return nil
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refreshErr = err
+	if err != nil {
+		return err
+	}
+
+	c.entitled = entitled
+	c.fallback = acctFeatureSets{}
+	c.fallbackKeys = nil
+	c.generation++
+	c.refreshedAt = c.now()
+
+	ctxlogrus.Extract(ctx).WithFields(logrus.Fields{
+		"nAccts": len(entitled),
+	}).Debug("acct_entitlements_cache_refresh_okay")
+
+	return nil
+}
+
+// HasFeature returns whether the account is entitled to the feature of the entitled-service.
+// Served from memory if the account and service are cached, otherwise queried directly.
+func (c *AcctEntitlementsCache) HasFeature(ctx context.Context, acctID, serviceName, feature string) (bool, error) {
+	feats, ok, generation := c.lookup(acctID, serviceName)
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+		_, found := feats[feature]
+		return found, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	acctEnts, err := c.authzer.GetAcctEntitlements(ctx, []string{acctID}, []string{serviceName})
+	if err != nil {
+		return false, err
+	}
+
+	var svcFeats []string
+	if acctEnts != nil {
+		svcFeats = (*acctEnts)[acctID][serviceName]
+	}
+	feats = newFeatureSet(svcFeats)
+	c.setFallback(generation, acctID, serviceName, feats)
+
+	_, found := feats[feature]
+	return found, nil
+}
+
+// setFallback keeps the fallback result queried at the refresh generation,
+// unless a refresh completed since (as the result may be older than the refreshed entitlements),
+// evicting the oldest fallback results beyond the max fallback entries
+func (c *AcctEntitlementsCache) setFallback(generation uint64, acctID, serviceName string, feats map[string]struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if c.fallback[acctID] == nil {
+		c.fallback[acctID] = map[string]map[string]struct{}{}
+	}
+	if _, ok := c.fallback[acctID][serviceName]; !ok {
+		c.fallbackKeys = append(c.fallbackKeys, [2]string{acctID, serviceName})
+	}
+	c.fallback[acctID][serviceName] = feats
+
+	for len(c.fallbackKeys) > c.maxFallbackEntries {
+		oldest := c.fallbackKeys[0]
+		c.fallbackKeys = c.fallbackKeys[1:]
+		delete(c.fallback[oldest[0]], oldest[1])
+		if len(c.fallback[oldest[0]]) == 0 {
+			delete(c.fallback, oldest[0])
+		}
+	}
+}
+
+// Stats returns the state of the cache, eg: to monitor its staleness
+func (c *AcctEntitlementsCache) Stats() AcctEntitlementsCacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stats := AcctEntitlementsCacheStats{
+		RefreshedAt:  c.refreshedAt,
+		RefreshError: c.refreshErr,
+		NumAccts:     len(c.entitled),
+		Hits:         atomic.LoadUint64(&c.hits),
+		Misses:       atomic.LoadUint64(&c.misses),
+	}
+	if !c.refreshedAt.IsZero() {
+		stats.Staleness = c.now().Sub(c.refreshedAt)
+	}
+	return stats
+}
+
+// lookup returns the cached features of the account's entitled-service, if any,
+// and the current refresh generation
+func (c *AcctEntitlementsCache) lookup(acctID, serviceName string) (map[string]struct{}, bool, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if feats, ok := c.fallback[acctID][serviceName]; ok {
+		return feats, true, c.generation
+	}
+	svcSets, ok := c.entitled[acctID]
+	if !ok {
+		return nil, false, c.generation
+	}
+	// Cached accounts are not entitled to the cached services missing from their entitlements
+	if feats, ok := svcSets[serviceName]; ok || c.cachesService(serviceName) {
+		return feats, true, c.generation
+	}
+	return nil, false, c.generation
+}
+
+// cachesService returns whether the entitled-service is cached
+func (c *AcctEntitlementsCache) cachesService(serviceName string) bool {
+	if len(c.serviceSet) == 0 {
+		return true
+	}
+	_, ok := c.serviceSet[serviceName]
+	return ok
+}
+
+func newSvcFeatureSets(svcFeats map[string][]string) map[string]map[string]struct{} {
+	svcSets := make(map[string]map[string]struct{}, len(svcFeats))
+	for svc, feats := range svcFeats {
+		svcSets[svc] = newFeatureSet(feats)
+	}
+	return svcSets
+}
+
+// newFeatureSet returns the set of feats (or of service names)
+func newFeatureSet(feats []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(feats))
+	for _, feat := range feats {
+		set[feat] = struct{}{}
+	}
+	return set
+}
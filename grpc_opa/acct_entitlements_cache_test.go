@@ -0,0 +1,292 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+)
+
+const mockAcctEntitlementsRespJSON = `{"result":{
+	"2001016":{"environment":["ac","heated-seats"],"wheel":["abs","alloy","tpms"]},
+	"2001040":{"environment":["ac","side-mirror-defogger"],"powertrain":["automatic","turbo"]},
+	"2001230":{"powertrain":["manual","v8"],"wheel":["run-flat"]}}}`
+
+// streamingOpaClienter streams streamRespJSON (or the RegoRespJSON of the MockOpaClienter),
+// counting the CustomQuery calls
+type streamingOpaClienter struct {
+	countingOpaClienter
+	streamRespJSON string
+	streamErr      error
+}
+
+func (m *streamingOpaClienter) CustomQueryStream(ctx context.Context, document string, postReqBody []byte, respRdrFn opa_client.StreamReaderFn) error {
+	if m.streamErr != nil {
+		return m.streamErr
+	}
+	if len(m.streamRespJSON) > 0 {
+		return respRdrFn(strings.NewReader(m.streamRespJSON))
+	}
+	return respRdrFn(strings.NewReader(m.RegoRespJSON))
+}
+
+func TestAcctEntitlementsCacheMockOpaClient(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	type lookup struct {
+		acctID, service, feature string
+		expFound                 bool
+	}
+
+	testCases := []struct {
+		name      string
+		opts      []AcctEntitlementsCacheOption
+		streamRsp string
+		lookups   []lookup
+		expHits   uint64
+		expMisses uint64
+	}{
+		{
+			name: "all services",
+			lookups: []lookup{
+				{"2001016", "wheel", "abs", true},
+				{"2001016", "wheel", "run-flat", false},
+				{"2001016", "powertrain", "turbo", false},
+				{"2001040", "powertrain", "turbo", true},
+			},
+			expHits: 4,
+		},
+		{
+			name: "unknown account",
+			lookups: []lookup{
+				{"2009999", "wheel", "abs", false},
+				{"2009999", "wheel", "abs", false},
+			},
+			expHits:   1,
+			expMisses: 1,
+		},
+		{
+			name: "configured services",
+			opts: []AcctEntitlementsCacheOption{WithAcctEntitlementsServices("wheel", "powertrain")},
+			streamRsp: `{"result":{
+				"2001016":{"wheel":["abs","alloy","tpms"]},
+				"2001040":{"powertrain":["automatic","turbo"]},
+				"2001230":{"powertrain":["manual","v8"],"wheel":["run-flat"]}}}`,
+			lookups: []lookup{
+				{"2001016", "wheel", "abs", true},
+				{"2001016", "powertrain", "turbo", false},
+				{"2001016", "environment", "ac", true},
+				{"2001016", "environment", "heated-seats", true},
+			},
+			expHits:   3,
+			expMisses: 1,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			clienter := &streamingOpaClienter{}
+			clienter.Loggr = stdLoggr
+			clienter.RegoRespJSON = mockAcctEntitlementsRespJSON
+			clienter.streamRespJSON = tt.streamRsp
+
+			auther := NewDefaultAuthorizer("bogus_unused_application_value",
+				WithOpaClienter(clienter),
+			)
+			cache := NewAcctEntitlementsCache(auther, tt.opts...)
+			if err := cache.Refresh(ctx); err != nil {
+				t.Fatalf("FAIL: Refresh() unexpected err=%v", err)
+			}
+
+			for _, lkup := range tt.lookups {
+				gotFound, err := cache.HasFeature(ctx, lkup.acctID, lkup.service, lkup.feature)
+				if err != nil {
+					t.Fatalf("FAIL: HasFeature(%s, %s, %s) unexpected err=%v", lkup.acctID, lkup.service, lkup.feature, err)
+				}
+				if gotFound != lkup.expFound {
+					t.Errorf("FAIL: HasFeature(%s, %s, %s) got %v expected %v",
+						lkup.acctID, lkup.service, lkup.feature, gotFound, lkup.expFound)
+				}
+			}
+
+			stats := cache.Stats()
+			if stats.Hits != tt.expHits || stats.Misses != tt.expMisses {
+				t.Errorf("FAIL: got %d hits %d misses expected %d hits %d misses",
+					stats.Hits, stats.Misses, tt.expHits, tt.expMisses)
+			}
+			if uint64(clienter.calls) != tt.expMisses {
+				t.Errorf("FAIL: got %d direct queries expected %d", clienter.calls, tt.expMisses)
+			}
+			if stats.NumAccts != 3 {
+				t.Errorf("FAIL: got %d accounts expected 3", stats.NumAccts)
+			}
+		})
+	}
+}
+
+func TestAcctEntitlementsCacheRefreshFail(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	clienter := &streamingOpaClienter{}
+	clienter.Loggr = stdLoggr
+	clienter.RegoRespJSON = mockAcctEntitlementsRespJSON
+
+	now := time.Unix(1000000, 0)
+	cache := NewAcctEntitlementsCache(NewDefaultAuthorizer("bogus_unused_application_value",
+		WithOpaClienter(clienter),
+	))
+	cache.now = func() time.Time { return now }
+
+	if stats := cache.Stats(); !stats.RefreshedAt.IsZero() || stats.Staleness != 0 {
+		t.Errorf("FAIL: never refreshed cache got %#v", stats)
+	}
+
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatalf("FAIL: Refresh() unexpected err=%v", err)
+	}
+	refreshedAt := now
+
+	clienter.streamErr = opa_client.ErrServiceUnavailable
+	now = now.Add(time.Minute)
+	if err := cache.Refresh(ctx); !errors.Is(err, opa_client.ErrServiceUnavailable) {
+		t.Errorf("FAIL: Refresh() got err=%v expected %v", err, opa_client.ErrServiceUnavailable)
+	}
+
+	stats := cache.Stats()
+	if !stats.RefreshedAt.Equal(refreshedAt) || stats.Staleness != time.Minute {
+		t.Errorf("FAIL: got RefreshedAt=%v Staleness=%v expected %v %v",
+			stats.RefreshedAt, stats.Staleness, refreshedAt, time.Minute)
+	}
+	if !errors.Is(stats.RefreshError, opa_client.ErrServiceUnavailable) {
+		t.Errorf("FAIL: got RefreshError=%v expected %v", stats.RefreshError, opa_client.ErrServiceUnavailable)
+	}
+
+	// Previous entitlements are kept
+	found, err := cache.HasFeature(ctx, "2001230", "wheel", "run-flat")
+	if err != nil || !found {
+		t.Errorf("FAIL: HasFeature() got %v err=%v expected true", found, err)
+	}
+	if clienter.calls != 0 {
+		t.Errorf("FAIL: got %d direct queries expected 0", clienter.calls)
+	}
+}
+
+func TestAcctEntitlementsCacheRun(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	clienter := &streamingOpaClienter{}
+	clienter.Loggr = stdLoggr
+	clienter.RegoRespJSON = mockAcctEntitlementsRespJSON
+
+	cache := NewAcctEntitlementsCache(NewDefaultAuthorizer("bogus_unused_application_value",
+		WithOpaClienter(clienter),
+	), WithAcctEntitlementsRefreshInterval(time.Millisecond*10))
+
+	done := make(chan error)
+	go func() {
+		done <- cache.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for cache.Stats().NumAccts == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	firstRefresh := cache.Stats().RefreshedAt
+	for !cache.Stats().RefreshedAt.After(firstRefresh) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !cache.Stats().RefreshedAt.After(firstRefresh) {
+		t.Errorf("FAIL: cache not refreshed periodically")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("FAIL: Run() got err=%v expected %v", err, context.Canceled)
+	}
+}
+
+// blockingQueryOpaClienter blocks CustomQuery until released
+type blockingQueryOpaClienter struct {
+	streamingOpaClienter
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingQueryOpaClienter) CustomQuery(ctx context.Context, document string, reqData, resp interface{}) error {
+	m.started <- struct{}{}
+	<-m.release
+	return m.streamingOpaClienter.CustomQuery(ctx, document, reqData, resp)
+}
+
+func TestAcctEntitlementsCacheFallback(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	clienter := &blockingQueryOpaClienter{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	clienter.Loggr = stdLoggr
+	clienter.RegoRespJSON = mockAcctEntitlementsRespJSON
+	clienter.streamRespJSON = `{"result": {}}`
+
+	cache := NewAcctEntitlementsCache(NewDefaultAuthorizer("bogus_unused_application_value",
+		WithOpaClienter(clienter),
+	), WithAcctEntitlementsRefreshInterval(0), WithAcctEntitlementsMaxFallbackEntries(2))
+
+	if cache.refreshInterval != DefaultAcctEntitlementsRefreshInterval {
+		t.Errorf("FAIL: got refresh interval %v expected %v", cache.refreshInterval, DefaultAcctEntitlementsRefreshInterval)
+	}
+
+	hasFeature := func(acctID, service, feature string) bool {
+		go func() { <-clienter.started; clienter.release <- struct{}{} }()
+		found, err := cache.HasFeature(ctx, acctID, service, feature)
+		if err != nil {
+			t.Fatalf("FAIL: HasFeature(%s, %s, %s) unexpected err=%v", acctID, service, feature, err)
+		}
+		return found
+	}
+
+	// Fallback results are capped, evicting the oldest
+	if !hasFeature("2001016", "wheel", "abs") {
+		t.Errorf("FAIL: HasFeature(2001016, wheel, abs) not found")
+	}
+	hasFeature("2001040", "powertrain", "turbo")
+	hasFeature("2001230", "wheel", "run-flat")
+	if len(cache.fallbackKeys) != 2 || cache.fallback["2001016"] != nil || cache.fallback["2001230"] == nil {
+		t.Errorf("FAIL: got fallback %v expected 2001040 and 2001230", cache.fallbackKeys)
+	}
+
+	// A fallback query started before a refresh is not kept
+	done := make(chan bool)
+	go func() {
+		found, _ := cache.HasFeature(ctx, "2001016", "environment", "ac")
+		done <- found
+	}()
+	<-clienter.started
+	if err := cache.Refresh(ctx); err != nil {
+		t.Fatalf("FAIL: Refresh() unexpected err=%v", err)
+	}
+	clienter.release <- struct{}{}
+	if found := <-done; !found {
+		t.Errorf("FAIL: HasFeature(2001016, environment, ac) not found")
+	}
+	if len(cache.fallback) != 0 || len(cache.fallbackKeys) != 0 {
+		t.Errorf("FAIL: got fallback %v expected none", cache.fallbackKeys)
+	}
+}
@@ -3,7 +3,9 @@ package grpc_opa_middleware
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net/http"
 	"reflect"
 	"testing"
 
@@ -114,6 +116,28 @@ func TestGetAcctEntitlementsOpa(t *testing.T) {
 		t.Errorf("FAIL:\nactualOpaResp:  %#v\nexpectOpaResp: %#v", actualOpaResp, expectOpaResp)
 	}
 
+	streamResult, err := collectAcctEntitlementsStream(ctx, auther, nil, nil)
+	if err != nil {
+		t.Errorf("FAIL: StreamAcctEntitlements() unexpected err=%v", err)
+	}
+	if !reflect.DeepEqual(streamResult, expectAcctResult.Result) {
+		t.Errorf("FAIL:\nstreamResult:  %#v\nexpectAcctResult.Result: %#v",
+			streamResult, expectAcctResult.Result)
+	}
+
+	// Close idle connections of the limited client before the OPA server shuts down
+	limitedHTTPCli := &http.Client{Transport: &http.Transport{}}
+	defer limitedHTTPCli.CloseIdleConnections()
+	limitedAuther := NewDefaultAuthorizer("bogus_unused_application_value",
+		WithOpaClienter(opa_client.New(cli.Address(),
+			opa_client.WithHTTPClient(limitedHTTPCli), opa_client.WithMaxResponseSize(64))),
+	)
+	_, err = collectAcctEntitlementsStream(ctx, limitedAuther, nil, nil)
+	if !errors.Is(err, opa_client.ErrResponseTooLarge) {
+		t.Errorf("FAIL: StreamAcctEntitlements() got err=%v, expected err=%v",
+			err, opa_client.ErrResponseTooLarge)
+	}
+
 	actualSpecific, err := auther.GetAcctEntitlements(ctx,
 		[]string{"2001040", "2001230"}, []string{"powertrain", "wheel"})
 	if err != nil {
@@ -255,5 +279,63 @@ func TestGetAcctEntitlementsMockOpaClient(t *testing.T) {
 			t.Errorf("%d: %q: FAIL: expectedVal=%#v actualVal=%#v",
 				nth, tm.name, tm.expectedVal, actualVal)
 		}
+
+		streamVal, streamErr := collectAcctEntitlementsStream(ctx, auther, nil, nil)
+		if tm.expectErr && streamErr == nil {
+			t.Errorf("%d: %q: FAIL: StreamAcctEntitlements expected err, but got no err", nth, tm.name)
+		} else if !tm.expectErr && streamErr != nil {
+			t.Errorf("%d: %q: FAIL: StreamAcctEntitlements got unexpected err=%s", nth, tm.name, streamErr)
+		}
+
+		if streamErr == nil && !reflect.DeepEqual(streamVal, tm.expectedVal) {
+			t.Errorf("%d: %q: FAIL: StreamAcctEntitlements expectedVal=%#v streamVal=%#v",
+				nth, tm.name, tm.expectedVal, streamVal)
+		}
+	}
+}
+
+// collectAcctEntitlementsStream collects the accounts streamed by StreamAcctEntitlements,
+// returning nil if no accounts were streamed
+func collectAcctEntitlementsStream(ctx context.Context, auther *DefaultAuthorizer, accountIDs, serviceNames []string) (*AcctEntitlementsType, error) {
+	var result *AcctEntitlementsType
+	err := auther.StreamAcctEntitlements(ctx, accountIDs, serviceNames,
+		func(acctID string, svcFeats map[string][]string) error {
+			if result == nil {
+				result = &AcctEntitlementsType{}
+			}
+			(*result)[acctID] = svcFeats
+			return nil
+		})
+	return result, err
+}
+
+func TestStreamAcctEntitlementsStopsOnFnError(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	mockOpaClienter := MockOpaClienter{
+		Loggr: stdLoggr,
+		RegoRespJSON: `{ "decision_id": "d1", "result": {
+			"acct1": { "svc1a": [ "feat1a1" ] },
+			"acct2": { "svc2a": [ "feat2a1" ] }
+		}}`,
+	}
+	auther := NewDefaultAuthorizer("bogus_unused_application_value",
+		WithOpaClienter(&mockOpaClienter),
+	)
+
+	stopErr := errors.New("stop")
+	var acctIDs []string
+	err := auther.StreamAcctEntitlements(ctx, nil, nil,
+		func(acctID string, svcFeats map[string][]string) error {
+			acctIDs = append(acctIDs, acctID)
+			return stopErr
+		})
+	if err != stopErr {
+		t.Errorf("FAIL: got err=%v, expected err=%v", err, stopErr)
+	}
+	if !reflect.DeepEqual(acctIDs, []string{"acct1"}) {
+		t.Errorf("FAIL: got acctIDs=%v, expected [acct1]", acctIDs)
 	}
 }
@@ -1,8 +1,10 @@
 package grpc_opa_middleware
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -40,9 +42,9 @@ var (
 )
 
 var (
-	ErrForbidden  = status.Errorf(codes.PermissionDenied, "Request forbidden: not authorized")
-	ErrUnknown    = status.Errorf(codes.Unknown, "Unknown error")
-	ErrInvalidArg = status.Errorf(codes.InvalidArgument, "Invalid argument")
+	ErrForbidden  = opa_client.NewError(codes.PermissionDenied, "Request forbidden: not authorized")
+	ErrUnknown    = opa_client.NewError(codes.Unknown, "Unknown error")
+	ErrInvalidArg = opa_client.NewError(codes.InvalidArgument, "Invalid argument")
 )
 
 // DecisionInput is app/service-specific data supplied by app/service ABAC requests
@@ -134,6 +136,10 @@ func NewDefaultAuthorizer(application string, opts ...Option) *DefaultAuthorizer
 		currUserCompartmentsApi:   DefaultCurrentUserCompartmentsPath,
 		filterCompartmentPermsApi: DefaultFilterCompartmentPermissionsApiPath,
 		filterCompartmentFeatsApi: DefaultFilterCompartmentFeaturesApiPath,
+		partialEvalQuery:          DefaultPartialEvalQuery,
+		batchDecisionDocument:     DefaultBatchValidatePath,
+		batchConcurrency:          DefaultBatchConcurrency,
+		effectivePermsApi:         DefaultEffectivePermissionsPath,
 	}
 	for _, opt := range opts {
 		opt(cfg)
@@ -143,7 +149,7 @@ func NewDefaultAuthorizer(application string, opts ...Option) *DefaultAuthorizer
 
 	clienter := cfg.clienter
 	if clienter == nil {
-		clienter = opa_client.New(cfg.address, opa_client.WithHTTPClient(cfg.httpCli))
+		clienter = opa_client.New(cfg.address, cfg.opaClientOptions()...)
 	}
 
 	a := DefaultAuthorizer{
@@ -157,6 +163,23 @@ func NewDefaultAuthorizer(application string, opts ...Option) *DefaultAuthorizer
 		currUserCompartmentsApi:   cfg.currUserCompartmentsApi,
 		filterCompartmentPermsApi: cfg.filterCompartmentPermsApi,
 		filterCompartmentFeatsApi: cfg.filterCompartmentFeatsApi,
+		partialEvalQuery:          cfg.partialEvalQuery,
+		denyReasonFilter:          cfg.denyReasonFilter,
+		responseValidation:        cfg.responseValidation,
+		responseExtraKeys:         cfg.responseExtraKeys,
+		resultMapping:             cfg.resultMapping,
+		batchDecisionDocument:     cfg.batchDecisionDocument,
+		batchConcurrency:          cfg.batchConcurrency,
+		effectivePermsApi:         cfg.effectivePermsApi,
+		payloadClaims:             cfg.payloadClaims,
+		principalExtractor:        cfg.principalExtractor,
+		compartmentExtractor:      cfg.compartmentExtractor,
+	}
+	if cfg.coalesceRequests {
+		a.coalescer = &opa_client.Coalescer{}
+	}
+	if cfg.lookupCacheTTL > 0 {
+		a.lookupCache = newLookupCache(cfg.lookupCacheTTL, cfg.lookupCacheMaxEntries)
 	}
 	return &a
 }
@@ -172,6 +195,19 @@ type DefaultAuthorizer struct {
 	currUserCompartmentsApi   string
 	filterCompartmentPermsApi string
 	filterCompartmentFeatsApi string
+	partialEvalQuery          string
+	coalescer                 *opa_client.Coalescer
+	lookupCache               *lookupCache
+	denyReasonFilter          DenyReasonFilter
+	responseValidation        ResponseValidation
+	responseExtraKeys         []string
+	resultMapping             *ResultMapping
+	batchDecisionDocument     string
+	batchConcurrency          int
+	effectivePermsApi         string
+	payloadClaims             []string
+	principalExtractor        PrincipalExtractor
+	compartmentExtractor      CompartmentExtractor
 }
 
 type Config struct {
@@ -180,6 +216,7 @@ type Config struct {
 	address string
 
 	clienter                  opa_client.Clienter
+	clientOpts                []opa_client.Option
 	opaEvaluator              OpaEvaluator
 	authorizer                []Authorizer
 	decisionInputHandler      DecisionInputHandler
@@ -189,6 +226,21 @@ type Config struct {
 	currUserCompartmentsApi   string
 	filterCompartmentPermsApi string
 	filterCompartmentFeatsApi string
+	partialEvalQuery          string
+	decisionIDTrailerKey      string
+	coalesceRequests          bool
+	lookupCacheTTL            time.Duration
+	lookupCacheMaxEntries     int
+	denyReasonFilter          DenyReasonFilter
+	responseValidation        ResponseValidation
+	responseExtraKeys         []string
+	resultMapping             *ResultMapping
+	batchDecisionDocument     string
+	batchConcurrency          int
+	effectivePermsApi         string
+	payloadClaims             []string
+	principalExtractor        PrincipalExtractor
+	compartmentExtractor      CompartmentExtractor
 }
 
 type ClaimsVerifier func([]string, []string) (string, []error)
@@ -212,83 +264,81 @@ func (a *DefaultAuthorizer) Evaluate(ctx context.Context, fullMethod string, grp
 		"application": a.application,
 	})
 
-	rawResp, err := a.Validate(ctx, fullMethod, grpcReq, opaEvaluator)
+	opaResp, envelope, claims, err := a.validate(ctx, fullMethod, grpcReq, opaEvaluator)
 	if err != nil {
 		return false, ctx, err
 	}
-	opaResp, ok := rawResp.(OPAResponse)
-	if !ok {
-		return false, ctx, ErrUnknown
+
+	// adding the decoded JWT claims to context if present
+	if claims != nil {
+		ctx = ContextWithClaims(ctx, claims)
+	}
+
+	// mapping non-standard policy outputs to the standard keys
+	if a.resultMapping != nil {
+		opaResp = a.resultMapping.Apply(opaResp)
+	}
+
+	// decoding the typed decision, failing on malformed policy output
+	// rather than denying or dropping obligations if WithResponseValidation
+	decision, err := opaResp.decode(a.responseValidation, a.responseExtraKeys, func(key string, err error) {
+		logger.WithField("opaResp", fmt.Sprintf("%#v", opaResp)).WithError(err).Error("parse_" + key + "_error")
+	})
+	if err != nil {
+		logger.WithField("opaResp", fmt.Sprintf("%#v", opaResp)).WithError(err).Error("invalid_opa_response")
+		return false, ctx, err
 	}
 
+	// adding authz result (including OPA decision_id and deny reasons if present) to context
+	authzResult := newAuthzResult(ctx, decision.Allow, envelope)
+	if !authzResult.Allow {
+		authzResult.DenyReasons = decision.DenyReasons
+	}
+	ctx = ContextWithAuthzResult(ctx, authzResult)
+
 	// adding raw entitled_features data to context if present
 	ctx = opaResp.AddRawEntitledFeatures(ctx)
 
 	// adding obligations data to context if present
-	ctx, err = addObligations(ctx, opaResp)
-	if err != nil {
-		logger.WithField("opaResp", fmt.Sprintf("%#v", opaResp)).WithError(err).Error("parse_obligations_error")
+	if decision.Obligations != nil {
+		ctx = context.WithValue(ctx, ObKey, decision.Obligations)
 	}
 
-	if !opaResp.Allow() {
-		return false, ctx, ErrForbidden
+	if !decision.Allow {
+		return false, ctx, a.forbiddenError(ctx, authzResult.DenyReasons)
 	}
 
 	return true, ctx, nil
 }
 
 func (a *DefaultAuthorizer) Validate(ctx context.Context, fullMethod string, grpcReq interface{}, opaEvaluator OpaEvaluator) (interface{}, error) {
+	opaResp, _, _, err := a.validate(ctx, fullMethod, grpcReq, opaEvaluator)
+	if err != nil {
+		return nil, err
+	}
+	return opaResp, nil
+}
+
+// validate implements Validate, also returning the OPA Query API envelope fields
+// (eg: decision_id) if present in the OPA response, and the decoded JWT claims.
+func (a *DefaultAuthorizer) validate(ctx context.Context, fullMethod string, grpcReq interface{}, opaEvaluator OpaEvaluator) (OPAResponse, *opa_client.QueryResponse, *atlas_claims.Claims, error) {
 
 	logger := ctxlogrus.Extract(ctx).WithFields(log.Fields{
 		"application": a.application,
 	})
 
-	// This fetches auth data from auth headers in metadata from context:
-	// bearer = data from "authorization bearer" metadata header
-	// newBearer = data from "set-authorization bearer" metadata header
-	bearer, newBearer := atlas_claims.AuthBearersFromCtx(ctx)
-
-	claimsVerifier := a.claimsVerifier
-	if claimsVerifier == nil {
-		claimsVerifier = UnverifiedClaimFromBearers
-	}
-
-	rawJWT, errs := claimsVerifier([]string{bearer}, []string{newBearer})
-	if len(errs) > 0 {
-		return nil, fmt.Errorf("%q", errs)
-	}
-
-	reqID, ok := requestid.FromContext(ctx)
-	if !ok {
-		reqID = "no-request-uuid"
-	}
-
-	opaReq := Payload{
-		Endpoint:    parseEndpoint(fullMethod),
-		FullMethod:  fullMethod,
-		Application: a.application,
-		// FIXME: implement atlas_claims.AuthBearersFromCtx
-		JWT:              rawJWT,
-		RequestID:        reqID,
-		EntitledServices: a.entitledServices,
-	}
-
-	decisionInput, err := a.decisionInputHandler.GetDecisionInput(ctx, fullMethod, grpcReq)
-	if decisionInput == nil || err != nil {
-		logger.WithFields(log.Fields{
-			"fullMethod": fullMethod,
-		}).WithError(err).Error("get_decision_input")
-		return nil, ErrInvalidArg
+	opaReq, err := a.newPayload(ctx, fullMethod, grpcReq)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	//logger.Debugf("decisionInput=%+v", *decisionInput)
-	opaReq.DecisionInput = *decisionInput
+	decisionInput := &opaReq.DecisionInput
 
 	opaReqJSON, err := json.Marshal(opaReq)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"opaReq": opaReq,
 		}).WithError(err).Error("opa_request_json_marshal")
-		return nil, ErrInvalidArg
+		return nil, nil, nil, ErrInvalidArg
 	}
 
 	now := time.Now()
@@ -320,6 +370,7 @@ func (a *DefaultAuthorizer) Validate(ctx context.Context, fullMethod string, grp
 	}
 
 	var opaResp OPAResponse
+	var envelope *opa_client.QueryResponse
 	err = opaEvaluator(ctxlogrus.ToContext(ctx, logger), decisionInput.DecisionDocument, opaInput, &opaResp)
 	// Metrics, logging, tracing handler
 	defer func() {
@@ -331,13 +382,18 @@ func (a *DefaultAuthorizer) Validate(ctx context.Context, fullMethod string, grp
 			Message: grpc.ErrorDesc(err),
 		})
 		span.End()
-		logger.WithFields(log.Fields{
-			"opaResp": opaResp,
-			"elapsed": time.Since(now),
-		}).Debug("authorization_result")
+		resultLogger := logger.WithFields(log.Fields{
+			"opaResp":    opaResp,
+			"elapsed":    time.Since(now),
+			"request_id": opaReq.RequestID,
+		})
+		if envelope != nil {
+			resultLogger = resultLogger.WithFields(envelope.LogFields())
+		}
+		resultLogger.Debug("authorization_result")
 	}()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	// If OPA POST request body does NOT contain 'input' key,
@@ -356,10 +412,13 @@ func (a *DefaultAuthorizer) Validate(ctx context.Context, fullMethod string, grp
 	// (See comments in testdata/mock_system_main.rego)
 	// If the JSON result document is nested within "result" wrapper map,
 	// we extract the nested JSON document and throw away the "result" wrapper map.
+	// Any OPA Query API envelope fields (decision_id, metrics, provenance, explanation)
+	// returned alongside "result" are also extracted before being thrown away.
 	nestedResultVal, resultIsNested := opaResp["result"]
 	if resultIsNested {
 		nestedResultMap, ok := nestedResultVal.(map[string]interface{})
 		if ok {
+			envelope = opaResp.queryResponseEnvelope()
 			opaResp = OPAResponse{}
 			for k, v := range nestedResultMap {
 				opaResp[k] = v
@@ -375,7 +434,79 @@ func (a *DefaultAuthorizer) Validate(ctx context.Context, fullMethod string, grp
 		}, "out")
 	}
 
-	return opaResp, nil
+	return opaResp, envelope, opaReq.claims, nil
+}
+
+// newPayload builds the OPA input Payload for the grpc request,
+// verifying the JWT claims in the context and obtaining the DecisionInput
+// and target compartment.
+func (a *DefaultAuthorizer) newPayload(ctx context.Context, fullMethod string, grpcReq interface{}) (Payload, error) {
+	logger := ctxlogrus.Extract(ctx).WithFields(log.Fields{
+		"application": a.application,
+	})
+
+	opaReq, err := a.newBasePayload(ctx, fullMethod)
+	if err != nil {
+		return Payload{}, err
+	}
+
+	decisionInput, err := a.decisionInputHandler.GetDecisionInput(ctx, fullMethod, grpcReq)
+	if decisionInput == nil || err != nil {
+		logger.WithFields(log.Fields{
+			"fullMethod": fullMethod,
+		}).WithError(err).Error("get_decision_input")
+		return Payload{}, ErrInvalidArg
+	}
+	//logger.Debugf("decisionInput=%+v", *decisionInput)
+	opaReq.DecisionInput = *decisionInput
+
+	opaReq.CompartmentID, err = a.targetCompartment(ctx, fullMethod, grpcReq)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"fullMethod": fullMethod,
+		}).WithError(err).Error("get_target_compartment")
+		return Payload{}, err
+	}
+
+	return opaReq, nil
+}
+
+// newBasePayload builds the OPA input Payload without DecisionInput,
+// verifying the JWT claims in the context.
+// A request without JWT is permitted if it has a caller Principal
+// (see WithPrincipalExtractor), leaving the policy to authorize the caller.
+func (a *DefaultAuthorizer) newBasePayload(ctx context.Context, fullMethod string) (Payload, error) {
+	caller, err := a.callerPrincipal(ctx)
+	if err != nil {
+		return Payload{}, err
+	}
+
+	rawJWT, err := a.verifyClaims(ctx)
+	if err != nil && !(caller != nil && errors.Is(err, ErrNoCredentials)) {
+		return Payload{}, err
+	}
+
+	reqID, ok := requestid.FromContext(ctx)
+	if !ok {
+		reqID = "no-request-uuid"
+	}
+
+	claims := parseVerifiedClaims(rawJWT)
+
+	opaReq := Payload{
+		Endpoint:    parseEndpoint(fullMethod),
+		FullMethod:  fullMethod,
+		Application: a.application,
+		// FIXME: implement atlas_claims.AuthBearersFromCtx
+		JWT:              rawJWT,
+		RequestID:        reqID,
+		EntitledServices: a.entitledServices,
+		Claims:           projectClaims(claims, a.payloadClaims),
+		Caller:           caller,
+		claims:           claims,
+	}
+
+	return opaReq, nil
 }
 
 func (a *DefaultAuthorizer) OpaQuery(ctx context.Context, decisionDocument string, opaReq, opaResp interface{}) error {
@@ -387,18 +518,74 @@ func (a *DefaultAuthorizer) OpaQuery(ctx context.Context, decisionDocument strin
 
 	// Empty document path is intentional
 	// DO NOT hardcode a path here
-	err := a.clienter.CustomQuery(ctx, decisionDocument, opaReq, opaResp)
+	var err error
+	if a.coalescer != nil {
+		err = a.coalescedQuery(ctx, decisionDocument, opaReq, opaResp)
+	} else {
+		err = a.clienter.CustomQuery(ctx, decisionDocument, opaReq, opaResp)
+	}
 	// TODO: allow overriding logger
 	if err != nil {
-		grpcErr := opa_client.GRPCError(err)
-		logger.WithError(grpcErr).Error("opa_policy_engine_request_error")
-		return opaqueError(grpcErr)
+		logger.WithError(err).Error("opa_policy_engine_request_error")
+		return opaqueError(err)
 	}
 
 	logger.WithField("opaResp", opaResp).Debug("opa_policy_engine_response")
 	return err
 }
 
+// headerPolicier is implemented by clienters forwarding headers by HeaderPolicy, eg: opa_client.Client
+type headerPolicier interface {
+	HeaderPolicy() opa_client.HeaderPolicy
+}
+
+// coalescedQuery executes query of the specified decisionDocument against OPA,
+// sharing one OPA request among identical concurrent queries.
+// Queries are identical if their decisionDocument and opaReq match, ignoring request_id,
+// and their QueryOptions and forwarded headers (see opa_client.CoalesceKey) match.
+// The headers forwarded are those of the clienter's HeaderPolicy if known, otherwise all.
+func (a *DefaultAuthorizer) coalescedQuery(ctx context.Context, decisionDocument string, opaReq, opaResp interface{}) error {
+	keyJSON, err := json.Marshal(withoutRequestID(opaReq))
+	if err != nil {
+		return err
+	}
+
+	hdrPolicy := opa_client.ForwardAllHeaderPolicy()
+	if policier, ok := a.clienter.(headerPolicier); ok {
+		hdrPolicy = policier.HeaderPolicy()
+	}
+
+	queryFn := func(ctx context.Context) ([]byte, error) {
+		return a.clienter.CustomQueryBytes(ctx, decisionDocument, opaReq)
+	}
+
+	bs, shared, err := a.coalescer.Do(ctx, opa_client.CoalesceKey(ctx, hdrPolicy, decisionDocument, keyJSON), queryFn)
+	if err != nil {
+		return err
+	}
+
+	ctxlogrus.Extract(ctx).WithField("shared", shared).Trace("opa_coalesced_query")
+
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	return dec.Decode(opaResp)
+}
+
+// withoutRequestID returns a copy of opaReq with the Payload request_id cleared
+func withoutRequestID(opaReq interface{}) interface{} {
+	switch req := opaReq.(type) {
+	case Payload:
+		req.RequestID = ""
+		return req
+	case OPARequest:
+		if p, ok := req.Input.(*Payload); ok && p != nil {
+			cp := *p
+			cp.RequestID = ""
+			return OPARequest{Input: &cp}
+		}
+	}
+	return opaReq
+}
+
 // AffirmAuthorization makes an authz request to sidecar-OPA.
 // If authorization is permitted, error returned is nil,
 // and a new context is returned, possibly containing obligations.
@@ -413,7 +600,7 @@ func (a *DefaultAuthorizer) AffirmAuthorization(ctx context.Context, fullMethod
 
 	ok, newCtx, err = a.Evaluate(ctx, fullMethod, grpcReq, a.OpaQuery)
 	if err != nil {
-		logger.WithError(err).WithField("authorizer", a).Error("unable_authorize")
+		authzLogger(logger, newCtx).WithError(err).WithField("authorizer", a).Error("unable_authorize")
 		return nil, err
 	}
 
@@ -431,17 +618,33 @@ var (
 )
 
 // opaqueError trims some privileged information from errors
-// as these get sent directly as grpc responses
+// as these get sent directly as grpc responses.
+// OPA errors are wrapped by the opa_client typed error of their gRPC code,
+// whose gRPC status excludes the OPA error details.
 func opaqueError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+
+	// Return the typed error itself: if wrapped (eg: by fmt.Errorf),
+	// the gRPC status of err would contain its full message, including the cause
+	var typedErr *opa_client.Error
+	if errors.As(err, &typedErr) {
+		return typedErr
+	}
 
-	switch status.Code(err) {
+	switch status.Code(opa_client.GRPCError(err)) {
 	case codes.Unavailable:
-		return opa_client.ErrServiceUnavailable
+		return opa_client.ErrServiceUnavailable.Wrap(err)
+	case codes.Internal:
+		return opa_client.ErrEvaluation.Wrap(err)
+	case codes.NotFound:
+		return opa_client.ErrUndefined.Wrap(err)
 	case codes.Unknown:
-		return opa_client.ErrUnknown
+		return opa_client.ErrUnknown.Wrap(err)
 	}
 
-	return err
+	return opa_client.GRPCError(err)
 }
 
 type Payload struct {
@@ -452,7 +655,16 @@ type Payload struct {
 	JWT              string   `json:"jwt"`
 	RequestID        string   `json:"request_id"`
 	EntitledServices []string `json:"entitled_services"`
+	// Claims are the JWT claims selected by WithPayloadClaims, by JSON claim name
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	// Caller is the caller Principal obtained by the PrincipalExtractor, if any
+	Caller *Principal `json:"caller,omitempty"`
+	// CompartmentID is the target compartment obtained by the CompartmentExtractor, if any
+	CompartmentID string `json:"compartment_id,omitempty"`
 	DecisionInput
+
+	// claims are the decoded JWT claims
+	claims *atlas_claims.Claims
 }
 
 // OPARequest is used to query OPA
@@ -473,6 +685,31 @@ func (o OPAResponse) Allow() bool {
 	return allow
 }
 
+// queryResponseEnvelope returns the OPA Query API envelope fields
+// outside of the "result" wrapper map, or nil if there are none
+func (o OPAResponse) queryResponseEnvelope() *opa_client.QueryResponse {
+	envelopeMap := map[string]interface{}{}
+	for k, v := range o {
+		if k != "result" {
+			envelopeMap[k] = v
+		}
+	}
+	if len(envelopeMap) == 0 {
+		return nil
+	}
+
+	raw, err := json.Marshal(envelopeMap)
+	if err != nil {
+		return nil
+	}
+
+	var envelope opa_client.QueryResponse
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil
+	}
+	return &envelope
+}
+
 // Obligations parses the returned obligations and returns them in standard format
 func (o OPAResponse) Obligations() (*ObligationsNode, error) {
 	if obIfc, ok := o[string(ObKey)]; ok {
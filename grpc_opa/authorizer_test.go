@@ -16,6 +16,8 @@ import (
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
 	logrus "github.com/sirupsen/logrus"
 	logrustesthook "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestRedactJWT(t *testing.T) {
@@ -27,6 +29,64 @@ func TestRedactJWT(t *testing.T) {
 	}
 }
 
+func TestOpaqueError(t *testing.T) {
+	secretErr := errors.New("secret policy detail")
+
+	tests := []struct {
+		name    string
+		err     error
+		expErr  error
+		expCode codes.Code
+	}{
+		{
+			name:    "typed error",
+			err:     opa_client.ErrEvaluation.Wrap(secretErr),
+			expErr:  opa_client.ErrEvaluation,
+			expCode: codes.Internal,
+		},
+		{
+			name:    "wrapped typed error",
+			err:     fmt.Errorf("query: %w", opa_client.ErrEvaluation.Wrap(secretErr)),
+			expErr:  opa_client.ErrEvaluation,
+			expCode: codes.Internal,
+		},
+		{
+			name:    "wrapped invalid argument",
+			err:     fmt.Errorf("input: %w", ErrInvalidArg.Wrap(secretErr)),
+			expErr:  ErrInvalidArg,
+			expCode: codes.InvalidArgument,
+		},
+		{
+			name:    "OPA error",
+			err:     opa_client.NewErrorV1("internal_error", secretErr),
+			expErr:  opa_client.ErrEvaluation,
+			expCode: codes.Internal,
+		},
+		{
+			name:    "context canceled",
+			err:     fmt.Errorf("query: %w", context.Canceled),
+			expCode: codes.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := opaqueError(tt.err)
+			if tt.expErr != nil && !errors.Is(gotErr, tt.expErr) {
+				t.Errorf("FAIL: got err: %v wanted: %v", gotErr, tt.expErr)
+			}
+
+			st := status.Convert(gotErr)
+			if st.Code() != tt.expCode {
+				t.Errorf("FAIL: got code: %v wanted: %v", st.Code(), tt.expCode)
+			}
+			if strings.Contains(st.Message(), "secret") {
+				t.Errorf("FAIL: status message not redacted: %q", st.Message())
+			}
+		})
+	}
+}
+
 func Test_parseEndpoint(t *testing.T) {
 	tests := []struct {
 		fullMethod string
@@ -142,6 +202,56 @@ func TestOPAResponseObligations(t *testing.T) {
 	}
 }
 
+func TestOPAResponseQueryResponseEnvelope(t *testing.T) {
+	tests := []struct {
+		name         string
+		regoRespJSON string
+		expectNil    bool
+		expectFields map[string]interface{}
+	}{
+		{
+			name:         `result only`,
+			regoRespJSON: `{"result": {"allow": true}}`,
+			expectNil:    true,
+		},
+		{
+			name:         `decision_id and metrics`,
+			regoRespJSON: `{"result": {"allow": true}, "decision_id": "abc-123", "metrics": {"timer_server_handler_ns": 10}}`,
+			expectFields: map[string]interface{}{
+				"decision_id": "abc-123",
+				"metrics":     map[string]interface{}{"timer_server_handler_ns": float64(10)},
+			},
+		},
+	}
+
+	for idx, tst := range tests {
+		var opaResp OPAResponse
+		if err := json.Unmarshal([]byte(tst.regoRespJSON), &opaResp); err != nil {
+			t.Fatalf("tst#%d: err=%s trying to json.Unmarshal: %s", idx, err, tst.regoRespJSON)
+		}
+
+		envelope := opaResp.queryResponseEnvelope()
+		if tst.expectNil {
+			if envelope != nil {
+				t.Errorf("tst#%d: %s: expected nil envelope, got %#v", idx, tst.name, envelope)
+			}
+			continue
+		}
+
+		if envelope == nil {
+			t.Fatalf("tst#%d: %s: unexpected nil envelope", idx, tst.name)
+		}
+		actualFields := map[string]interface{}{}
+		for k, v := range envelope.LogFields() {
+			actualFields[k] = v
+		}
+		actualFields["metrics"] = map[string]interface{}(envelope.Metrics)
+		if !reflect.DeepEqual(actualFields, tst.expectFields) {
+			t.Errorf("tst#%d: %s: expectFields=%#v actualFields=%#v", idx, tst.name, tst.expectFields, actualFields)
+		}
+	}
+}
+
 func TestAffirmAuthorizationOpa(t *testing.T) {
 	testMap := []struct {
 		name        string
@@ -444,7 +554,10 @@ func (m MockOpaClienter) Query(ctx context.Context, reqData, resp interface{}) e
 }
 
 func (m MockOpaClienter) CustomQueryStream(ctx context.Context, document string, postReqBody []byte, respRdrFn opa_client.StreamReaderFn) error {
-	return nil
+	if respRdrFn == nil {
+		return nil
+	}
+	return respRdrFn(strings.NewReader(m.RegoRespJSON))
 }
 
 func (m MockOpaClienter) CustomQueryBytes(ctx context.Context, document string, reqData interface{}) ([]byte, error) {
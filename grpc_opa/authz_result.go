@@ -0,0 +1,93 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/infobloxopen/atlas-app-toolkit/requestid"
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+const (
+	// DefaultDecisionIDTrailer is the default gRPC trailer key for WithDecisionIDTrailer
+	DefaultDecisionIDTrailer = "opa-decision-id"
+)
+
+// AuthzResult is the authorization result added to the context by Evaluate,
+// whether the request is allowed or denied.
+// It can be retrieved with AuthzResultFromContext (or FromContext).
+type AuthzResult struct {
+	Allow bool
+	// DecisionID is the OPA decision_id, only returned by OPA if decision logging is enabled
+	DecisionID string
+	RequestID  string
+	// DenyReasons are all the deny reasons returned by the policy (unfiltered), if denied
+	DenyReasons []DenyReason
+}
+
+// LogFields returns the AuthzResult fields for logging
+func (r *AuthzResult) LogFields() log.Fields {
+	fields := log.Fields{
+		"request_id": r.RequestID,
+	}
+	if len(r.DecisionID) > 0 {
+		fields["decision_id"] = r.DecisionID
+	}
+	if len(r.DenyReasons) > 0 {
+		fields["deny_reasons"] = r.DenyReasons
+	}
+	return fields
+}
+
+func newAuthzResult(ctx context.Context, allow bool, envelope *opa_client.QueryResponse) *AuthzResult {
+	result := &AuthzResult{
+		Allow: allow,
+	}
+
+	if reqID, ok := requestid.FromContext(ctx); ok {
+		result.RequestID = reqID
+	}
+
+	if envelope != nil {
+		result.DecisionID = envelope.DecisionID
+	}
+
+	return result
+}
+
+// ContextWithAuthzResult returns a new context containing the AuthzResult
+func ContextWithAuthzResult(ctx context.Context, result *AuthzResult) context.Context {
+	return context.WithValue(ctx, authZKey, result)
+}
+
+// AuthzResultFromContext retrieves the AuthzResult from the context
+func AuthzResultFromContext(ctx context.Context) (*AuthzResult, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	result, ok := ctx.Value(authZKey).(*AuthzResult)
+	return result, ok && result != nil
+}
+
+// decisionIDMetadata returns the gRPC trailer containing the OPA decision_id in the context,
+// if WithDecisionIDTrailer was specified and there is a decision_id.
+// The decision_id is also added to the context logger fields.
+func (c *Config) decisionIDMetadata(ctx context.Context) metadata.MD {
+	result, ok := AuthzResultFromContext(ctx)
+	if !ok || len(result.DecisionID) == 0 {
+		return nil
+	}
+
+	ctxlogrus.AddFields(ctx, log.Fields{
+		"authz.decision_id": result.DecisionID,
+	})
+
+	if len(c.decisionIDTrailerKey) == 0 {
+		return nil
+	}
+
+	return metadata.Pairs(c.decisionIDTrailerKey, result.DecisionID)
+}
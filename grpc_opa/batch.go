@@ -0,0 +1,182 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultBatchValidatePath is default OPA path to perform batch authz validation
+	DefaultBatchValidatePath = "v1/data/authz/rbac/batch_validate_v1"
+
+	// DefaultBatchConcurrency is default maximum concurrent Evaluate calls
+	// when BatchEvaluate falls back to evaluating each input individually
+	DefaultBatchConcurrency = 8
+)
+
+// BatchPayload is the OPA input for batch authz validation:
+// the same fields as Payload, plus an array of DecisionInputs to validate.
+// The batch decision document must return an array of results (one per input, in the same order),
+// each of the same form as the validate decision document result, eg:
+//
+//	[{"allow": true, "obligations": [...]}, {"allow": false}]
+type BatchPayload struct {
+	Payload
+	Inputs []DecisionInput `json:"inputs"`
+}
+
+// BatchResult is the authorization result of one DecisionInput in BatchEvaluate
+type BatchResult struct {
+	Allow       bool
+	Obligations *ObligationsNode
+	DenyReasons []DenyReason
+	// Err is any error evaluating this input (other than being denied)
+	Err error
+}
+
+// batchResponse is the data type json.Unmarshaled from OPA RESTAPI query to batch decision document
+type batchResponse struct {
+	Result *[]OPAResponse `json:"result"`
+}
+
+// BatchEvaluate evaluates the authorization of many DecisionInputs for the same grpc request method,
+// in a single OPA query to the batch decision document (see WithBatchDecisionDocument).
+// The results are returned in the same order as the inputs.
+//
+// If the batch decision document is undefined (the policy doesn't implement the batch rule)
+// or empty, each input is evaluated individually with Evaluate instead,
+// with at most WithBatchConcurrency concurrent evaluations.
+//
+// An error is returned only if the batch cannot be evaluated at all (eg: invalid JWT);
+// per-input errors are returned in BatchResult.Err.
+func (a *DefaultAuthorizer) BatchEvaluate(ctx context.Context, fullMethod string, inputs []DecisionInput) ([]BatchResult, error) {
+	logger := ctxlogrus.Extract(ctx).WithFields(log.Fields{
+		"application": a.application,
+		"batch_size":  len(inputs),
+	})
+
+	if len(inputs) == 0 {
+		return []BatchResult{}, nil
+	}
+
+	if len(a.batchDecisionDocument) == 0 {
+		return a.fanOutEvaluate(ctx, fullMethod, inputs)
+	}
+
+	opaReq, err := a.newBasePayload(ctx, fullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	batchReq := OPARequest{
+		Input: &BatchPayload{
+			Payload: opaReq,
+			Inputs:  inputs,
+		},
+	}
+
+	var batchResp batchResponse
+	err = a.OpaQuery(ctx, a.batchDecisionDocument, batchReq, &batchResp)
+	if err != nil {
+		logger.WithError(err).Error("batch_evaluate_error")
+		return nil, err
+	}
+
+	if batchResp.Result == nil {
+		logger.Debug("batch_decision_undefined_fallback")
+		return a.fanOutEvaluate(ctx, fullMethod, inputs)
+	}
+
+	opaResps := *batchResp.Result
+	if len(opaResps) != len(inputs) {
+		err = ErrInvalidOPAResponse.Wrap(fmt.Errorf("batch returned %d results for %d inputs", len(opaResps), len(inputs)))
+		logger.WithError(err).Error("batch_evaluate_error")
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(opaResps))
+	for idx, opaResp := range opaResps {
+		if a.resultMapping != nil {
+			opaResp = a.resultMapping.Apply(opaResp)
+		}
+
+		decision, err := opaResp.Decode(a.responseValidation, a.responseExtraKeys...)
+		if err != nil {
+			results[idx].Err = err
+			continue
+		}
+
+		results[idx] = BatchResult{
+			Allow:       decision.Allow,
+			Obligations: decision.Obligations,
+			DenyReasons: decision.DenyReasons,
+		}
+	}
+
+	return results, nil
+}
+
+// fanOutEvaluate evaluates each input individually with Evaluate, concurrently
+func (a *DefaultAuthorizer) fanOutEvaluate(ctx context.Context, fullMethod string, inputs []DecisionInput) ([]BatchResult, error) {
+	// Fail fast once (rather than for each input) if the JWT or caller is invalid
+	if _, err := a.newBasePayload(ctx, fullMethod); err != nil {
+		return nil, err
+	}
+
+	concurrency := a.batchConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	results := make([]BatchResult, len(inputs))
+
+	var grp errgroup.Group
+	grp.SetLimit(concurrency)
+	for idx := range inputs {
+		idx := idx
+		grp.Go(func() error {
+			results[idx] = a.evaluateInput(ctx, fullMethod, inputs[idx])
+			return nil
+		})
+	}
+	grp.Wait()
+
+	return results, nil
+}
+
+// evaluateInput evaluates a single DecisionInput with Evaluate
+func (a *DefaultAuthorizer) evaluateInput(ctx context.Context, fullMethod string, input DecisionInput) BatchResult {
+	single := *a
+	single.decisionInputHandler = staticDecisionInputer{input}
+
+	allow, newCtx, err := single.Evaluate(ctx, fullMethod, nil, single.OpaQuery)
+
+	var result BatchResult
+	result.Allow = allow
+	if authzResult, ok := AuthzResultFromContext(newCtx); ok {
+		result.DenyReasons = authzResult.DenyReasons
+	}
+	if ob, ok := newCtx.Value(ObKey).(*ObligationsNode); ok {
+		result.Obligations = ob
+	}
+	if err != nil && !errors.Is(err, ErrForbidden) {
+		result.Err = err
+	}
+
+	return result
+}
+
+// staticDecisionInputer is a DecisionInputHandler returning a fixed DecisionInput
+type staticDecisionInputer struct {
+	input DecisionInput
+}
+
+func (s staticDecisionInputer) GetDecisionInput(ctx context.Context, fullMethod string, grpcReq interface{}) (*DecisionInput, error) {
+	input := s.input
+	return &input, nil
+}
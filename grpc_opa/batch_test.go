@@ -0,0 +1,256 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+)
+
+func TestBatchEvaluateOpa(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	done := make(chan struct{})
+	clienter := utils_test.StartOpa(ctx, t, done)
+	cli, ok := clienter.(*opa_client.Client)
+	if !ok {
+		t.Fatal("Unable to convert interface to (*Client)")
+		return
+	}
+
+	// Errors above here will leak containers
+	defer func() {
+		cancel()
+		// Wait for container to be shutdown
+		<-done
+	}()
+
+	policyRego, err := ioutil.ReadFile("testdata/mock_batch_policy.rego")
+	if err != nil {
+		t.Fatalf("ReadFile fatal err: %#v", err)
+		return
+	}
+
+	var resp interface{}
+	err = cli.UploadRegoPolicy(ctx, "mock_batch_policyid", policyRego, resp)
+	if err != nil {
+		t.Fatalf("OpaUploadPolicy fatal err: %#v", err)
+		return
+	}
+
+	inputs := []DecisionInput{
+		{Type: "ddi.ipam", Verb: "read"},
+		{Type: "ddi.ipam", Verb: "write"},
+		{Type: "ddi.dns", Verb: "write"},
+		{Type: "ddi.dhcp", Verb: "read"},
+	}
+	for idx := range inputs {
+		inputs[idx].DecisionDocument = "v1/data/batch_eval/validate_v1"
+	}
+	expAllow := []bool{true, false, true, false}
+	expOb := []bool{false, true, true, false}
+
+	testCases := []struct {
+		name     string
+		batchDoc string
+	}{
+		{
+			name:     "batch rule",
+			batchDoc: "v1/data/batch_eval/batch_validate_v1",
+		},
+		{
+			name:     "undefined batch rule fallback",
+			batchDoc: "v1/data/batch_eval/undefined_batch_validate_v1",
+		},
+		{
+			name:     "no batch rule fallback",
+			batchDoc: "",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			auther := NewDefaultAuthorizer("batch-app",
+				WithOpaClienter(cli),
+				WithClaimsVerifier(NullClaimsVerifier),
+				WithBatchDecisionDocument(tt.batchDoc),
+			)
+
+			results, err := auther.BatchEvaluate(ctx, "FakeMethod", inputs)
+			if err != nil {
+				t.Fatalf("FAIL: BatchEvaluate() unexpected err=%v", err)
+			}
+			if len(results) != len(inputs) {
+				t.Fatalf("FAIL: got %d results wanted %d", len(results), len(inputs))
+			}
+
+			for idx, result := range results {
+				if result.Err != nil {
+					t.Errorf("FAIL: %d: unexpected err=%v", idx, result.Err)
+				}
+				if result.Allow != expAllow[idx] {
+					t.Errorf("FAIL: %d: got allow=%v wanted %v", idx, result.Allow, expAllow[idx])
+				}
+				hasOb := result.Obligations != nil && !result.Obligations.IsShallowEmpty()
+				if hasOb != expOb[idx] {
+					t.Errorf("FAIL: %d: got obligations=%s wanted %v", idx, result.Obligations, expOb[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchEvaluateFallbackConcurrency(t *testing.T) {
+	const limit = 3
+	var active, maxActive, calls int32
+	var mu sync.Mutex
+
+	opaEvaltor := func(ctx context.Context, decisionDocument string, opaReq, opaResp interface{}) error {
+		if decisionDocument == DefaultBatchValidatePath {
+			// batch rule undefined
+			return json.Unmarshal([]byte(`{}`), opaResp)
+		}
+
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&active, 1)
+		mu.Lock()
+		if n > maxActive {
+			maxActive = n
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+
+		payload := opaReq.(OPARequest).Input.(*Payload)
+		switch payload.Verb {
+		case "read":
+			return json.Unmarshal([]byte(`{"allow": true}`), opaResp)
+		case "fail":
+			return opa_client.ErrEvaluation
+		}
+		return json.Unmarshal([]byte(`{"allow": false, "deny_reasons": ["read-only"]}`), opaResp)
+	}
+
+	auther := NewDefaultAuthorizer("batch-app",
+		WithOpaEvaluator(opaEvaltor),
+		WithClaimsVerifier(NullClaimsVerifier),
+		WithBatchConcurrency(limit),
+	)
+
+	verbs := []string{"read", "write", "fail", "read", "write", "read", "read", "write", "read", "read"}
+	inputs := make([]DecisionInput, len(verbs))
+	for idx, verb := range verbs {
+		inputs[idx] = DecisionInput{Verb: verb, DecisionDocument: "v1/data/validate"}
+	}
+
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	results, err := auther.BatchEvaluate(ctx, "FakeMethod", inputs)
+	if err != nil {
+		t.Fatalf("FAIL: BatchEvaluate() unexpected err=%v", err)
+	}
+
+	if calls != int32(len(inputs)) {
+		t.Errorf("FAIL: got %d evaluations wanted %d", calls, len(inputs))
+	}
+	if maxActive > limit {
+		t.Errorf("FAIL: got %d concurrent evaluations wanted at most %d", maxActive, limit)
+	}
+
+	for idx, result := range results {
+		switch verbs[idx] {
+		case "read":
+			if !result.Allow || result.Err != nil {
+				t.Errorf("FAIL: %d: got %#v wanted allowed", idx, result)
+			}
+		case "write":
+			if result.Allow || result.Err != nil || len(result.DenyReasons) != 1 {
+				t.Errorf("FAIL: %d: got %#v wanted denied with reason", idx, result)
+			}
+		case "fail":
+			if result.Allow || !errors.Is(result.Err, opa_client.ErrEvaluation) {
+				t.Errorf("FAIL: %d: got %#v wanted ErrEvaluation", idx, result)
+			}
+		}
+	}
+}
+
+func TestBatchEvaluateInvalid(t *testing.T) {
+	inputs := []DecisionInput{{Verb: "read"}, {Verb: "write"}}
+
+	testMap := []struct {
+		name      string
+		respJSON  string
+		expectErr error
+		expectRes []BatchResult
+	}{
+		{
+			name:      "result count mismatch",
+			respJSON:  `{"result": [{"allow": true}]}`,
+			expectErr: ErrInvalidOPAResponse,
+		},
+		{
+			name:     "malformed item",
+			respJSON: `{"result": [{"allow": true}, {"allow": true, "obligations": 1}]}`,
+			expectRes: []BatchResult{
+				{Allow: true},
+				{Allow: true},
+			},
+		},
+	}
+
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+
+	for _, tm := range testMap {
+		auther := NewDefaultAuthorizer("batch-app",
+			WithOpaEvaluator(mockJSONEvaluator(tm.respJSON)),
+			WithClaimsVerifier(NullClaimsVerifier),
+		)
+
+		results, err := auther.BatchEvaluate(ctx, "FakeMethod", inputs)
+		if tm.expectErr != nil {
+			if !errors.Is(err, tm.expectErr) {
+				t.Errorf("%s: FAIL: got err: %v wanted: %v", tm.name, err, tm.expectErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: FAIL: unexpected err: %v", tm.name, err)
+			continue
+		}
+		for idx := range results {
+			if results[idx].Allow != tm.expectRes[idx].Allow || results[idx].Err != nil {
+				t.Errorf("%s: FAIL: %d: got %#v wanted %#v", tm.name, idx, results[idx], tm.expectRes[idx])
+			}
+		}
+	}
+
+	// Strict validation reports malformed item error per item
+	auther := NewDefaultAuthorizer("batch-app",
+		WithOpaEvaluator(mockJSONEvaluator(`{"result": [{"allow": true}, {"allow": true, "obligations": 1}]}`)),
+		WithClaimsVerifier(NullClaimsVerifier),
+		WithResponseValidation(StrictValidation),
+	)
+	results, err := auther.BatchEvaluate(ctx, "FakeMethod", inputs)
+	if err != nil {
+		t.Fatalf("FAIL: unexpected err: %v", err)
+	}
+	if results[0].Err != nil || !results[0].Allow {
+		t.Errorf("FAIL: 0: got %#v wanted allowed", results[0])
+	}
+	if !errors.Is(results[1].Err, ErrInvalidOPAResponse) || results[1].Allow {
+		t.Errorf("FAIL: 1: got %#v wanted ErrInvalidOPAResponse", results[1])
+	}
+}
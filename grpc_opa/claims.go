@@ -1,9 +1,33 @@
 package grpc_opa_middleware
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+
 	atlas_claims "github.com/infobloxopen/atlas-claims"
 )
 
+const (
+	claimsKey = key("grpc-authz-claims-key")
+)
+
+// ContextWithClaims returns a new context containing the decoded JWT claims
+func ContextWithClaims(ctx context.Context, claims *atlas_claims.Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext retrieves the decoded JWT claims added to the context by Evaluate.
+// The claims are only as trustworthy as the ClaimsVerifier
+// (eg: UnverifiedClaimFromBearers does not verify the signature, see JWKSVerifier).
+func ClaimsFromContext(ctx context.Context) (*atlas_claims.Claims, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	claims, ok := ctx.Value(claimsKey).(*atlas_claims.Claims)
+	return claims, ok && claims != nil
+}
+
 // NullClaimsVerifier does nothing and just returns non-error empty bearer string.
 func NullClaimsVerifier([]string, []string) (string, []error) {
 	return "", nil
@@ -32,3 +56,70 @@ func UnverifiedClaimFromBearers(bearer, newBearer []string) (string, []error) {
 
 	return "", append(bearerErrorList, newBearerErrorList...)
 }
+
+// verifyClaims verifies the JWT claims in the context with the claimsVerifier,
+// and returns the raw JWT chosen by the claimsVerifier.
+// Returns ErrNoCredentials if verification fails because there are no bearers in the context,
+// otherwise ErrInvalidJWT wrapping the verification errors if verification fails.
+func (a *DefaultAuthorizer) verifyClaims(ctx context.Context) (string, error) {
+	// This fetches auth data from auth headers in metadata from context:
+	// bearer = data from "authorization bearer" metadata header
+	// newBearer = data from "set-authorization bearer" metadata header
+	bearer, newBearer := atlas_claims.AuthBearersFromCtx(ctx)
+
+	claimsVerifier := a.claimsVerifier
+	if claimsVerifier == nil {
+		claimsVerifier = UnverifiedClaimFromBearers
+	}
+
+	rawJWT, errs := claimsVerifier([]string{bearer}, []string{newBearer})
+	if len(errs) > 0 {
+		if len(bearer) == 0 && len(newBearer) == 0 {
+			return "", ErrNoCredentials.Wrap(fmt.Errorf("%q", errs))
+		}
+		return "", ErrInvalidJWT.Wrap(fmt.Errorf("%q", errs))
+	}
+
+	return rawJWT, nil
+}
+
+// parseVerifiedClaims decodes the claims of the raw JWT already verified by the ClaimsVerifier.
+// Returns nil if there is no JWT (eg: NullClaimsVerifier) or it cannot be decoded.
+func parseVerifiedClaims(rawJWT string) *atlas_claims.Claims {
+	if len(rawJWT) == 0 {
+		return nil
+	}
+
+	claims, _ := atlas_claims.ParseUnverifiedClaimsFromJwtStrings([]string{rawJWT})
+	return claims
+}
+
+// projectClaims returns the claims with the specified JSON claim names,
+// or nil if there are none.
+func projectClaims(claims *atlas_claims.Claims, claimNames []string) map[string]interface{} {
+	if claims == nil || len(claimNames) == 0 {
+		return nil
+	}
+
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return nil
+	}
+
+	allClaims := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &allClaims); err != nil {
+		return nil
+	}
+
+	projected := map[string]interface{}{}
+	for _, name := range claimNames {
+		if val, ok := allClaims[name]; ok {
+			projected[name] = val
+		}
+	}
+	if len(projected) == 0 {
+		return nil
+	}
+
+	return projected
+}
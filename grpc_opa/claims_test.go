@@ -0,0 +1,97 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+	atlas_claims "github.com/infobloxopen/atlas-claims"
+)
+
+func TestClaimsInContextAndPayload(t *testing.T) {
+	claims := &atlas_claims.Claims{
+		AccountId: "40",
+		Groups:    []string{"user"},
+		Service:   "all",
+		Subject: atlas_claims.Subject{
+			Id:                 "user@example.com",
+			SubjectType:        "user",
+			AuthenticationType: "bearer",
+		},
+	}
+	jwt, err := atlas_claims.BuildJwt(claims, "some-hmac-key-we-dont-care", time.Hour*9)
+	if err != nil {
+		t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		opts          []Option
+		jwt           string
+		expCtxClaims  bool
+		expPayloadRaw string
+	}{
+		{
+			name:         "claims in context, not in payload by default",
+			jwt:          jwt,
+			expCtxClaims: true,
+		},
+		{
+			name: "selected claims in payload",
+			opts: []Option{WithPayloadClaims("account_id", "subject", "groups", "no_such_claim")},
+			jwt:  jwt,
+			expPayloadRaw: `{"account_id": "40", "groups": ["user"],
+				"subject": {"id": "user@example.com", "subject_type": "user", "authentication_type": "bearer"}}`,
+			expCtxClaims: true,
+		},
+		{
+			name: "no claims with NullClaimsVerifier",
+			opts: []Option{WithClaimsVerifier(NullClaimsVerifier), WithPayloadClaims("account_id")},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPayload Payload
+			evaluator := func(ctx context.Context, decisionDocument string, opaReq, opaResp interface{}) error {
+				gotPayload = opaReq.(Payload)
+				return json.Unmarshal([]byte(`{"allow": true}`), opaResp)
+			}
+
+			auther := NewDefaultAuthorizer("app", tt.opts...)
+
+			ctx := context.Background()
+			if len(tt.jwt) > 0 {
+				ctx = utils_test.ContextWithJWT(ctx, tt.jwt)
+			}
+
+			ok, gotCtx, err := auther.Evaluate(ctx, "/service.TagService/ListTags", nil, evaluator)
+			if !ok || err != nil {
+				t.Fatalf("FAIL: Evaluate() ok=%v err=%v", ok, err)
+			}
+
+			gotClaims, gotOk := ClaimsFromContext(gotCtx)
+			if gotOk != tt.expCtxClaims {
+				t.Errorf("FAIL: ClaimsFromContext() ok=%v expected %v", gotOk, tt.expCtxClaims)
+			}
+			if gotOk && (gotClaims.AccountId != claims.AccountId ||
+				!reflect.DeepEqual(gotClaims.Groups, claims.Groups) ||
+				gotClaims.Subject != claims.Subject) {
+				t.Errorf("FAIL: ClaimsFromContext()\ngot: %#v\nexp: %#v", gotClaims, claims)
+			}
+
+			var expPayloadClaims map[string]interface{}
+			if len(tt.expPayloadRaw) > 0 {
+				if err := json.Unmarshal([]byte(tt.expPayloadRaw), &expPayloadClaims); err != nil {
+					t.Fatalf("FAIL: json.Unmarshal() err=%v", err)
+				}
+			}
+			if !reflect.DeepEqual(gotPayload.Claims, expPayloadClaims) {
+				t.Errorf("FAIL: Payload.Claims\ngot: %#v\nexp: %#v", gotPayload.Claims, expPayloadClaims)
+			}
+		})
+	}
+}
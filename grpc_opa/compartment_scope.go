@@ -0,0 +1,181 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+const (
+	// DefaultCompartmentHeader is the default incoming metadata key of the target compartment id
+	DefaultCompartmentHeader = "compartment-id"
+
+	// CompartmentObligationsTag is the Tag of the obligations returned by CompartmentObligations
+	CompartmentObligationsTag = "compartments"
+)
+
+var (
+	// ErrInvalidCompartment is returned when the CompartmentExtractor fails
+	ErrInvalidCompartment = opa_client.NewError(codes.InvalidArgument, "invalid target compartment")
+)
+
+// CompartmentExtractor returns the id of the compartment targeted by the grpc request,
+// or "" if the request does not target a compartment.
+type CompartmentExtractor func(ctx context.Context, fullMethod string, grpcReq interface{}) (string, error)
+
+// CompartmentFromMetadata is a CompartmentExtractor that returns the
+// incoming metadata value of key (eg: DefaultCompartmentHeader).
+// Multiple different values are invalid.
+func CompartmentFromMetadata(key string) CompartmentExtractor {
+	return func(ctx context.Context, fullMethod string, grpcReq interface{}) (string, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		vals := md.Get(key)
+		if len(vals) == 0 {
+			return "", nil
+		}
+		for _, val := range vals {
+			if val != vals[0] {
+				return "", fmt.Errorf("multiple %s metadata values", key)
+			}
+		}
+		return vals[0], nil
+	}
+}
+
+// CompartmentFromRequestField is a CompartmentExtractor that returns the
+// string field of the grpc request struct, by Go field name (eg: "CompartmentId"),
+// using its protobuf getter (eg: GetCompartmentId) if any.
+// Requests without the field do not target a compartment.
+func CompartmentFromRequestField(fieldName string) CompartmentExtractor {
+	return func(ctx context.Context, fullMethod string, grpcReq interface{}) (string, error) {
+		if IsNilInterface(grpcReq) {
+			return "", nil
+		}
+
+		reqVal := reflect.ValueOf(grpcReq)
+		var fieldVal reflect.Value
+		if getter := reqVal.MethodByName("Get" + fieldName); getter.IsValid() &&
+			getter.Type().NumIn() == 0 && getter.Type().NumOut() == 1 {
+			fieldVal = getter.Call(nil)[0]
+		} else {
+			structVal := reflect.Indirect(reqVal)
+			if structVal.Kind() != reflect.Struct {
+				return "", nil
+			}
+			fieldVal = structVal.FieldByName(fieldName)
+			if !fieldVal.IsValid() {
+				return "", nil
+			}
+		}
+
+		if fieldVal.Kind() != reflect.String {
+			return "", fmt.Errorf("request field %s is %s, not string", fieldName, fieldVal.Kind())
+		}
+		return fieldVal.String(), nil
+	}
+}
+
+// FirstCompartment is a CompartmentExtractor that returns the first
+// target compartment id returned by extractors (eg: request field, then metadata).
+// All the non-empty compartment ids must be the same, so that the compartment authorized by OPA
+// is the compartment the handler acts on (eg: a client cannot get authorized for the
+// compartment of a metadata header, then act on the different compartment of the request).
+func FirstCompartment(extractors ...CompartmentExtractor) CompartmentExtractor {
+	return func(ctx context.Context, fullMethod string, grpcReq interface{}) (string, error) {
+		firstID := ""
+		for _, extractor := range extractors {
+			compartmentID, err := extractor(ctx, fullMethod, grpcReq)
+			if err != nil {
+				return "", err
+			}
+			if len(compartmentID) == 0 {
+				continue
+			}
+			if len(firstID) == 0 {
+				firstID = compartmentID
+			} else if compartmentID != firstID {
+				return "", fmt.Errorf("conflicting target compartments %q and %q", firstID, compartmentID)
+			}
+		}
+		return firstID, nil
+	}
+}
+
+// targetCompartment returns the target compartment id using the compartmentExtractor, if any
+func (a *DefaultAuthorizer) targetCompartment(ctx context.Context, fullMethod string, grpcReq interface{}) (string, error) {
+	if a.compartmentExtractor == nil {
+		return "", nil
+	}
+
+	compartmentID, err := a.compartmentExtractor(ctx, fullMethod, grpcReq)
+	if err != nil {
+		return "", ErrInvalidCompartment.Wrap(err)
+	}
+
+	return compartmentID, nil
+}
+
+// CompartmentObligations returns obligations restricting list queries to the
+// compartments of the current user (see GetCurrentUserCompartments):
+// an OR of `type:<sealType>; ctx.<property> == "<compartment-id>"` conditions
+// tagged CompartmentObligationsTag, where property is the SEAL property of the
+// compartment id (eg: compartment_id) of the sealType objects (eg: ddi.ipam).
+// The type prefix is omitted if sealType is empty.
+// Returns ErrForbidden if the user has no compartments, rather than no obligations,
+// so that the query is never left unrestricted.
+func (a *DefaultAuthorizer) CompartmentObligations(ctx context.Context, sealType, property string) (*ObligationsNode, error) {
+	compartmentIDs, err := a.GetCurrentUserCompartments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(compartmentIDs) == 0 {
+		ctxlogrus.Extract(ctx).Debug("compartment_obligations_no_compartments")
+		return nil, ErrForbidden
+	}
+
+	typePrefix := ""
+	if len(sealType) > 0 {
+		typePrefix = "type:" + sealType + "; "
+	}
+
+	o8n := &ObligationsNode{
+		Kind:     ObligationsOr,
+		Tag:      CompartmentObligationsTag,
+		Children: make([]*ObligationsNode, 0, len(compartmentIDs)),
+	}
+	for _, compartmentID := range compartmentIDs {
+		o8n.Children = append(o8n.Children, &ObligationsNode{
+			Kind:      ObligationsCondition,
+			Condition: typePrefix + "ctx." + property + " == " + strconv.Quote(compartmentID),
+		})
+	}
+
+	return o8n, nil
+}
+
+// ContextWithCompartmentObligations adds the CompartmentObligations to the
+// obligations in the context (see ObKey), ANDing them with the obligations returned by OPA if any.
+func (a *DefaultAuthorizer) ContextWithCompartmentObligations(ctx context.Context, sealType, property string) (context.Context, error) {
+	cptO8n, err := a.CompartmentObligations(ctx, sealType, property)
+	if err != nil {
+		return ctx, err
+	}
+
+	o8n, _ := ctx.Value(ObKey).(*ObligationsNode)
+	if o8n.IsShallowEmpty() {
+		return context.WithValue(ctx, ObKey, cptO8n), nil
+	}
+
+	return context.WithValue(ctx, ObKey, &ObligationsNode{
+		Kind:     ObligationsAnd,
+		Children: []*ObligationsNode{o8n, cptO8n},
+	}), nil
+}
@@ -0,0 +1,251 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"github.com/infobloxopen/seal/pkg/compiler/sql"
+	logrus "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+	atlas_claims "github.com/infobloxopen/atlas-claims"
+)
+
+type compartmentProtoReq struct {
+	CompartmentId string
+}
+
+func (r *compartmentProtoReq) GetCompartmentId() string {
+	if r == nil {
+		return ""
+	}
+	return r.CompartmentId
+}
+
+type compartmentStructReq struct {
+	CompartmentId string
+	Size          int
+}
+
+func TestCompartmentExtractor(t *testing.T) {
+	claims := &atlas_claims.Claims{AccountId: "40"}
+	jwt, err := atlas_claims.BuildJwt(claims, "some-hmac-key-we-dont-care", time.Hour*9)
+	if err != nil {
+		t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		extractor CompartmentExtractor
+		md        metadata.MD
+		grpcReq   interface{}
+		expErr    error
+		expCptID  string
+	}{
+		{
+			name:    "no extractor",
+			md:      metadata.Pairs(DefaultCompartmentHeader, "red."),
+			grpcReq: &compartmentProtoReq{CompartmentId: "green."},
+		},
+		{
+			name:      "metadata",
+			extractor: CompartmentFromMetadata(DefaultCompartmentHeader),
+			md:        metadata.Pairs(DefaultCompartmentHeader, "red."),
+			expCptID:  "red.",
+		},
+		{
+			name:      "metadata missing",
+			extractor: CompartmentFromMetadata(DefaultCompartmentHeader),
+		},
+		{
+			name:      "metadata multiple values",
+			extractor: CompartmentFromMetadata(DefaultCompartmentHeader),
+			md:        metadata.Pairs(DefaultCompartmentHeader, "red.", DefaultCompartmentHeader, "green."),
+			expErr:    ErrInvalidCompartment,
+		},
+		{
+			name:      "request getter",
+			extractor: CompartmentFromRequestField("CompartmentId"),
+			grpcReq:   &compartmentProtoReq{CompartmentId: "green."},
+			expCptID:  "green.",
+		},
+		{
+			name:      "request struct field",
+			extractor: CompartmentFromRequestField("CompartmentId"),
+			grpcReq:   compartmentStructReq{CompartmentId: "blue."},
+			expCptID:  "blue.",
+		},
+		{
+			name:      "request without field",
+			extractor: CompartmentFromRequestField("Compartment"),
+			grpcReq:   &compartmentStructReq{CompartmentId: "blue."},
+		},
+		{
+			name:      "request non-string field",
+			extractor: CompartmentFromRequestField("Size"),
+			grpcReq:   &compartmentStructReq{Size: 1},
+			expErr:    ErrInvalidCompartment,
+		},
+		{
+			name: "first of request, metadata",
+			extractor: FirstCompartment(
+				CompartmentFromRequestField("CompartmentId"),
+				CompartmentFromMetadata(DefaultCompartmentHeader),
+			),
+			md:       metadata.Pairs(DefaultCompartmentHeader, "red."),
+			grpcReq:  &compartmentProtoReq{},
+			expCptID: "red.",
+		},
+		{
+			name: "first of request, metadata same",
+			extractor: FirstCompartment(
+				CompartmentFromRequestField("CompartmentId"),
+				CompartmentFromMetadata(DefaultCompartmentHeader),
+			),
+			md:       metadata.Pairs(DefaultCompartmentHeader, "green."),
+			grpcReq:  &compartmentProtoReq{CompartmentId: "green."},
+			expCptID: "green.",
+		},
+		{
+			name: "first of request, metadata conflicting",
+			extractor: FirstCompartment(
+				CompartmentFromRequestField("CompartmentId"),
+				CompartmentFromMetadata(DefaultCompartmentHeader),
+			),
+			md:      metadata.Pairs(DefaultCompartmentHeader, "red."),
+			grpcReq: &compartmentProtoReq{CompartmentId: "green."},
+			expErr:  ErrInvalidCompartment,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPayload Payload
+			evaluator := func(ctx context.Context, decisionDocument string, opaReq, opaResp interface{}) error {
+				gotPayload = opaReq.(Payload)
+				return json.Unmarshal([]byte(`{"allow": true}`), opaResp)
+			}
+
+			auther := NewDefaultAuthorizer("app", WithCompartmentExtractor(tt.extractor))
+
+			md := metadata.Join(tt.md, metadata.Pairs("authorization", "bearer "+jwt))
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+
+			ok, _, err := auther.Evaluate(ctx, "/service.TagService/ListTags", tt.grpcReq, evaluator)
+			if !errors.Is(err, tt.expErr) || (tt.expErr == nil && err != nil) {
+				t.Fatalf("FAIL: Evaluate() err=%v expected %v", err, tt.expErr)
+			}
+			if tt.expErr != nil {
+				return
+			}
+
+			if !ok {
+				t.Errorf("FAIL: Evaluate() not ok")
+			}
+			if gotPayload.CompartmentID != tt.expCptID {
+				t.Errorf("FAIL: Payload.CompartmentID got %q expected %q", gotPayload.CompartmentID, tt.expCptID)
+			}
+		})
+	}
+}
+
+func TestCompartmentObligationsMockOpaClient(t *testing.T) {
+	opaO8n := &ObligationsNode{
+		Kind: ObligationsOr,
+		Children: []*ObligationsNode{
+			{Kind: ObligationsCondition, Condition: `type:ddi.ipam; ctx.size > 10`},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		respJson string
+		ctxO8n   *ObligationsNode
+		expErr   error
+		expSQL   string
+	}{
+		{
+			name:     `single compartment`,
+			respJson: `{ "result": [ "red." ] }`,
+			expSQL:   `(ipam.compartment_id = 'red.')`,
+		},
+		{
+			name:     `multiple compartments`,
+			respJson: `{ "result": [ "red.", "green." ] }`,
+			expSQL:   `((ipam.compartment_id = 'red.') OR (ipam.compartment_id = 'green.'))`,
+		},
+		{
+			name:     `multiple compartments and obligations in context`,
+			respJson: `{ "result": [ "red.", "green." ] }`,
+			ctxO8n:   opaO8n,
+			expSQL:   `((ipam.size > 10) AND ((ipam.compartment_id = 'red.') OR (ipam.compartment_id = 'green.')))`,
+		},
+		{
+			name:     `no compartments`,
+			respJson: `{ "result": [] }`,
+			expErr:   ErrForbidden,
+		},
+		{
+			name:     `null compartments`,
+			respJson: `{ "result": null }`,
+			expErr:   ErrForbidden,
+		},
+	}
+
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	sqlc := sqlcompiler.NewSQLCompiler().WithDialect(sqlcompiler.DialectPostgres).
+		WithTypeMapper(sqlcompiler.NewTypeMapper("ddi.*").ToSQLTable("*").
+			WithPropertyMapper(sqlcompiler.NewPropertyMapper("*").ToSQLColumn("*")),
+		)
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			mockOpaClienter := utils_test.MockOpaClienter{
+				Loggr:        stdLoggr,
+				RegoRespJSON: tt.respJson,
+			}
+			auther := NewDefaultAuthorizer("bogus_unused_application_value",
+				WithOpaClienter(&mockOpaClienter),
+			)
+
+			claims := &atlas_claims.Claims{}
+			jwt, err := atlas_claims.BuildJwt(claims, "some-hmac-key-we-dont-care", time.Hour*9)
+			if err != nil {
+				t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+			}
+			ttCtx := utils_test.ContextWithJWT(ctx, jwt)
+			if tt.ctxO8n != nil {
+				ttCtx = context.WithValue(ttCtx, ObKey, tt.ctxO8n)
+			}
+
+			gotCtx, gotErr := auther.ContextWithCompartmentObligations(ttCtx, "ddi.ipam", "compartment_id")
+			if !errors.Is(gotErr, tt.expErr) || (tt.expErr == nil && gotErr != nil) {
+				t.Fatalf("FAIL: ContextWithCompartmentObligations() err=%v expected %v", gotErr, tt.expErr)
+			}
+			if tt.expErr != nil {
+				return
+			}
+
+			gotO8n, ok := gotCtx.Value(ObKey).(*ObligationsNode)
+			if !ok {
+				t.Fatalf("FAIL: no obligations in context")
+			}
+
+			gotSQL, err := gotO8n.ToSQLPredicate(sqlc)
+			if err != nil {
+				t.Fatalf("FAIL: ToSQLPredicate() unexpected err=%v", err)
+			}
+			if gotSQL != tt.expSQL {
+				t.Errorf("FAIL:\ngotSQL: %s\nexpSQL: %s", gotSQL, tt.expSQL)
+			}
+		})
+	}
+}
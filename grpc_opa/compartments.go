@@ -5,7 +5,6 @@ import (
 	"fmt"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
-	atlas_claims "github.com/infobloxopen/atlas-claims"
 	logrus "github.com/sirupsen/logrus"
 )
 
@@ -22,40 +21,39 @@ type CurrentUserCompartmentsResult struct {
 
 // GetCurrentUserCompartments returns list of compartment-ids
 // for the current-user's JWT in the context.
+// The result is memoized in the request context (see ContextWithLookupMemo)
+// and cached (see WithLookupCache) if enabled.
 func (a *DefaultAuthorizer) GetCurrentUserCompartments(ctx context.Context) ([]string, error) {
 	lgNtry := ctxlogrus.Extract(ctx)
-	cptResult := CurrentUserCompartmentsResult{}
 
-	// This fetches auth data from auth headers in metadata from context:
-	// bearer = data from "authorization bearer" metadata header
-	// newBearer = data from "set-authorization bearer" metadata header
-	bearer, newBearer := atlas_claims.AuthBearersFromCtx(ctx)
-
-	claimsVerifier := a.claimsVerifier
-	if claimsVerifier == nil {
-		claimsVerifier = UnverifiedClaimFromBearers
-	}
-
-	rawJWT, errs := claimsVerifier([]string{bearer}, []string{newBearer})
-	if len(errs) > 0 {
-		return nil, fmt.Errorf("%q", errs)
-	}
-
-	opaReq := OPARequest{
-		Input: &Payload{
-			JWT: redactJWT(rawJWT),
-		},
+	rawJWT, err := a.lookupJWT(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	err := a.clienter.CustomQuery(ctx, a.currUserCompartmentsApi, opaReq, &cptResult)
+	result, err := a.lookup(ctx, rawJWT, a.currUserCompartmentsApi, nil, func() (interface{}, error) {
+		cptResult := CurrentUserCompartmentsResult{}
+		opaReq := OPARequest{
+			Input: &Payload{
+				JWT: redactJWT(rawJWT),
+			},
+		}
+
+		err := a.clienter.CustomQuery(ctx, a.currUserCompartmentsApi, opaReq, &cptResult)
+		if err != nil {
+			lgNtry.WithError(err).Error("get_curr_user_compartments_fail")
+			return nil, err
+		}
+
+		lgNtry.WithFields(logrus.Fields{
+			"cptResult": fmt.Sprintf("%#v", cptResult),
+		}).Trace("get_curr_user_compartments_okay")
+
+		return cptResult.Result, nil
+	})
 	if err != nil {
-		lgNtry.WithError(err).Error("get_curr_user_compartments_fail")
 		return nil, err
 	}
 
-	lgNtry.WithFields(logrus.Fields{
-		"cptResult": fmt.Sprintf("%#v", cptResult),
-	}).Trace("get_curr_user_compartments_okay")
-
-	return cptResult.Result, nil
+	return copyStrings(result.([]string)), nil
 }
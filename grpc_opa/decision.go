@@ -0,0 +1,134 @@
+package grpc_opa_middleware
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+// AllowKey is the allow key in the OPA response
+const AllowKey = "allow"
+
+// ResponseValidation is a bitmask of the OPA response validation checks
+// performed by OPAResponse.Decode, and by Evaluate if WithResponseValidation is specified
+type ResponseValidation uint
+
+const (
+	// RequireAllow requires allow to be present and boolean
+	RequireAllow ResponseValidation = 1 << iota
+	// RejectMalformed rejects malformed entitled_features, obligations and deny reasons
+	RejectMalformed
+	// RejectUnknownKeys rejects keys other than the known decision keys
+	// (allow, entitled_features, obligations, deny_reasons, errors) and any extra keys specified
+	RejectUnknownKeys
+
+	// StrictValidation performs all validation checks
+	StrictValidation = RequireAllow | RejectMalformed | RejectUnknownKeys
+)
+
+// ErrInvalidOPAResponse is returned upon OPA response failing validation
+var ErrInvalidOPAResponse = opa_client.NewError(codes.Internal, "Invalid OPA response")
+
+// knownDecisionKeys are the keys decoded into Decision
+var knownDecisionKeys = map[string]bool{
+	AllowKey:                    true,
+	string(EntitledFeaturesKey): true,
+	string(ObKey):               true,
+	DenyReasonsKey:              true,
+	ErrorsKey:                   true,
+}
+
+// Decision is the typed authorization decision decoded from OPAResponse
+type Decision struct {
+	Allow bool
+	// EntitledFeatures is map of service to array of features
+	EntitledFeatures map[string][]string
+	Obligations      *ObligationsNode
+	DenyReasons      []DenyReason
+}
+
+// Decode decodes the typed Decision from the OPA response,
+// performing the specified validation checks.
+// extraKeys are keys, other than the known decision keys, allowed by RejectUnknownKeys.
+//
+// Without any validation checks, Decode is as lenient as Evaluate by default:
+// allow is false unless boolean true, and malformed fields are left empty.
+// Returns opa_client.ErrUndefined if RequireAllow and the response is empty (undefined decision),
+// otherwise returns ErrInvalidOPAResponse wrapping the failed check.
+func (o OPAResponse) Decode(validation ResponseValidation, extraKeys ...string) (*Decision, error) {
+	return o.decode(validation, extraKeys, nil)
+}
+
+// decode implements Decode, calling onMalformed (if not nil) with the key and error
+// of each malformed field left empty (unless RejectMalformed)
+func (o OPAResponse) decode(validation ResponseValidation, extraKeys []string, onMalformed func(key string, err error)) (*Decision, error) {
+	decision := &Decision{}
+
+	allowIfc, ok := o[AllowKey]
+	decision.Allow, _ = allowIfc.(bool)
+	if validation&RequireAllow != 0 {
+		if len(o) == 0 {
+			return nil, opa_client.ErrUndefined
+		}
+		if _, isBool := allowIfc.(bool); !ok || !isBool {
+			return nil, ErrInvalidOPAResponse.Wrap(fmt.Errorf("%s is missing or not boolean: %#v", AllowKey, allowIfc))
+		}
+	}
+
+	if validation&RejectUnknownKeys != 0 {
+		allowed := make(map[string]bool, len(extraKeys))
+		for _, k := range extraKeys {
+			allowed[k] = true
+		}
+
+		var unknownKeys []string
+		for k := range o {
+			if !knownDecisionKeys[k] && !allowed[k] {
+				unknownKeys = append(unknownKeys, k)
+			}
+		}
+		if len(unknownKeys) > 0 {
+			sort.Strings(unknownKeys)
+			return nil, ErrInvalidOPAResponse.Wrap(fmt.Errorf("unknown keys %q", unknownKeys))
+		}
+	}
+
+	malformed := func(key string, err error) error {
+		if validation&RejectMalformed != 0 {
+			return ErrInvalidOPAResponse.Wrap(err)
+		}
+		if onMalformed != nil {
+			onMalformed(key, err)
+		}
+		return nil
+	}
+
+	efs, err := parseRawEntitledFeatures(o[string(EntitledFeaturesKey)])
+	if err != nil {
+		if err = malformed(string(EntitledFeaturesKey), err); err != nil {
+			return nil, err
+		}
+	}
+	decision.EntitledFeatures = efs
+
+	ob, err := o.Obligations()
+	if err != nil {
+		if err = malformed(string(ObKey), err); err != nil {
+			return nil, err
+		}
+	}
+	decision.Obligations = ob
+
+	reasons, err := o.DenyReasons()
+	if err != nil {
+		if err = malformed(DenyReasonsKey, err); err != nil {
+			return nil, err
+		}
+	}
+	decision.DenyReasons = reasons
+
+	return decision, nil
+}
@@ -0,0 +1,209 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+)
+
+func TestOPAResponseDecode(t *testing.T) {
+	testMap := []struct {
+		name       string
+		respJSON   string
+		validation ResponseValidation
+		extraKeys  []string
+		expect     *Decision
+		expectErr  error
+	}{
+		{
+			name:       "valid, strict",
+			respJSON:   `{"allow": true, "entitled_features": {"lic": ["dhcp", "ipam"]}, "obligations": [["ctx.a == 1"]]}`,
+			validation: StrictValidation,
+			expect: &Decision{
+				Allow:            true,
+				EntitledFeatures: map[string][]string{"lic": {"dhcp", "ipam"}},
+				Obligations: &ObligationsNode{
+					Kind: ObligationsOr,
+					Children: []*ObligationsNode{{
+						Kind:     ObligationsOr,
+						Children: []*ObligationsNode{{Kind: ObligationsCondition, Condition: "ctx.a == 1"}},
+					}},
+				},
+			},
+		},
+		{
+			name:     "non-boolean allow, lax",
+			respJSON: `{"allow": "true"}`,
+			expect:   &Decision{},
+		},
+		{
+			name:       "non-boolean allow, require allow",
+			respJSON:   `{"allow": "true"}`,
+			validation: RequireAllow,
+			expectErr:  ErrInvalidOPAResponse,
+		},
+		{
+			name:       "missing allow, require allow",
+			respJSON:   `{"entitled_features": {}}`,
+			validation: RequireAllow,
+			expectErr:  ErrInvalidOPAResponse,
+		},
+		{
+			name:       "undefined, require allow",
+			respJSON:   `{}`,
+			validation: RequireAllow,
+			expectErr:  opa_client.ErrUndefined,
+		},
+		{
+			name:     "malformed obligations, lax",
+			respJSON: `{"allow": true, "obligations": 1}`,
+			expect:   &Decision{Allow: true},
+		},
+		{
+			name:       "malformed obligations, reject malformed",
+			respJSON:   `{"allow": true, "obligations": 1}`,
+			validation: RejectMalformed,
+			expectErr:  ErrInvalidObligations,
+		},
+		{
+			name:       "malformed entitled_features, reject malformed",
+			respJSON:   `{"allow": true, "entitled_features": {"lic": "dhcp"}}`,
+			validation: RejectMalformed,
+			expectErr:  ErrInvalidEntitledFeatures,
+		},
+		{
+			name:       "malformed deny_reasons, reject malformed",
+			respJSON:   `{"allow": false, "deny_reasons": {}}`,
+			validation: RejectMalformed,
+			expectErr:  ErrInvalidDenyReasons,
+		},
+		{
+			name:       "unknown key, reject unknown keys",
+			respJSON:   `{"allow": true, "alow": true}`,
+			validation: RejectUnknownKeys,
+			expectErr:  ErrInvalidOPAResponse,
+		},
+		{
+			name:       "extra key, reject unknown keys",
+			respJSON:   `{"allow": true, "custom": 1}`,
+			validation: StrictValidation,
+			extraKeys:  []string{"custom"},
+			expect:     &Decision{Allow: true},
+		},
+	}
+
+	for _, tm := range testMap {
+		var opaResp OPAResponse
+		if err := json.Unmarshal([]byte(tm.respJSON), &opaResp); err != nil {
+			t.Fatalf("%s: json.Unmarshal fatal err: %v", tm.name, err)
+		}
+
+		actual, err := opaResp.Decode(tm.validation, tm.extraKeys...)
+		if tm.expectErr == nil && err != nil {
+			t.Errorf("%s: FAIL: unexpected err: %v", tm.name, err)
+		} else if tm.expectErr != nil && !errors.Is(err, tm.expectErr) {
+			t.Errorf("%s: FAIL: got err: %v wanted: %v", tm.name, err, tm.expectErr)
+		}
+
+		if !reflect.DeepEqual(actual, tm.expect) {
+			t.Errorf("%s: FAIL:\ngot:    %#v\nwanted: %#v", tm.name, actual, tm.expect)
+		}
+	}
+}
+
+func TestOPAResponseDecodeMalformed(t *testing.T) {
+	var opaResp OPAResponse
+	respJSON := `{"allow": false, "entitled_features": [], "obligations": 1, "deny_reasons": [{"reason": 1}]}`
+	if err := json.Unmarshal([]byte(respJSON), &opaResp); err != nil {
+		t.Fatalf("json.Unmarshal fatal err: %v", err)
+	}
+
+	malformed := map[string]error{}
+	actual, err := opaResp.decode(0, nil, func(key string, err error) {
+		malformed[key] = err
+	})
+	if err != nil {
+		t.Fatalf("FAIL: unexpected err: %v", err)
+	}
+	if !reflect.DeepEqual(actual, &Decision{}) {
+		t.Errorf("FAIL: got: %#v wanted empty Decision", actual)
+	}
+
+	expect := map[string]error{
+		string(EntitledFeaturesKey): ErrInvalidEntitledFeatures,
+		string(ObKey):               ErrInvalidObligations,
+		DenyReasonsKey:              ErrInvalidDenyReasons,
+	}
+	if len(malformed) != len(expect) {
+		t.Errorf("FAIL: got malformed: %v wanted: %v", malformed, expect)
+	}
+	for key, expectErr := range expect {
+		if !errors.Is(malformed[key], expectErr) {
+			t.Errorf("FAIL: got malformed %s err: %v wanted: %v", key, malformed[key], expectErr)
+		}
+	}
+}
+
+func TestEvaluateResponseValidation(t *testing.T) {
+	testMap := []struct {
+		name        string
+		opts        []Option
+		respJSON    string
+		expectAllow bool
+		expectErr   error
+	}{
+		{
+			name:        "malformed obligations, lax",
+			respJSON:    `{"allow": true, "obligations": 1}`,
+			expectAllow: true,
+		},
+		{
+			name:      "malformed obligations, strict",
+			opts:      []Option{WithResponseValidation(StrictValidation)},
+			respJSON:  `{"allow": true, "obligations": 1}`,
+			expectErr: ErrInvalidOPAResponse,
+		},
+		{
+			name:      "non-boolean allow, lax",
+			respJSON:  `{"allow": "yes"}`,
+			expectErr: ErrForbidden,
+		},
+		{
+			name:      "non-boolean allow, strict",
+			opts:      []Option{WithResponseValidation(StrictValidation)},
+			respJSON:  `{"allow": "yes"}`,
+			expectErr: ErrInvalidOPAResponse,
+		},
+		{
+			name:        "valid, strict",
+			opts:        []Option{WithResponseValidation(StrictValidation)},
+			respJSON:    `{"allow": true, "obligations": {}}`,
+			expectAllow: true,
+		},
+	}
+
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+
+	for _, tm := range testMap {
+		opts := append([]Option{
+			WithOpaEvaluator(mockJSONEvaluator(tm.respJSON)),
+			WithClaimsVerifier(NullClaimsVerifier),
+		}, tm.opts...)
+		auther := NewDefaultAuthorizer("app", opts...)
+
+		allow, _, err := auther.Evaluate(ctx, "FakeMethod", nil, auther.OpaQuery)
+		if allow != tm.expectAllow {
+			t.Errorf("%s: FAIL: got allow: %v wanted: %v", tm.name, allow, tm.expectAllow)
+		}
+		if tm.expectErr == nil && err != nil {
+			t.Errorf("%s: FAIL: unexpected err: %v", tm.name, err)
+		} else if tm.expectErr != nil && !errors.Is(err, tm.expectErr) {
+			t.Errorf("%s: FAIL: got err: %v wanted: %v", tm.name, err, tm.expectErr)
+		}
+	}
+}
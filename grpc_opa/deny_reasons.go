@@ -0,0 +1,210 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+const (
+	// DenyReasonsKey is the deny reasons key in the OPA response
+	DenyReasonsKey = "deny_reasons"
+
+	// ErrorsKey is the alternate deny reasons key in the OPA response,
+	// used if DenyReasonsKey is not present
+	ErrorsKey = "errors"
+
+	// DefaultDenyReason is the google.rpc.ErrorInfo reason if the deny reason has none
+	DefaultDenyReason = "PERMISSION_DENIED"
+)
+
+// ErrInvalidDenyReasons is returned upon invalid deny reasons
+var ErrInvalidDenyReasons = opa_client.NewError(codes.Internal, "Invalid deny_reasons")
+
+// DenyReason is a reason computed by the policy for denying the request.
+// In the OPA response, a deny reason is either a message string, or an object such as:
+//
+//	{"reason": "ACCOUNT_SUSPENDED", "message": "account is suspended",
+//	 "subject": "account/123", "metadata": {"account_id": "123"}, "user_visible": true}
+type DenyReason struct {
+	// Reason is the machine-readable reason, in UPPER_SNAKE_CASE
+	Reason string `json:"reason,omitempty"`
+	// Message is the human-readable description
+	Message string `json:"message,omitempty"`
+	// Subject is the resource (or other subject) that failed the precondition
+	Subject     string            `json:"subject,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	UserVisible bool              `json:"user_visible,omitempty"`
+}
+
+// DenyReasonFilter returns whether a deny reason may be returned to gRPC callers
+type DenyReasonFilter func(DenyReason) bool
+
+// UserVisibleDenyReasons is the default DenyReasonFilter,
+// returning only the deny reasons marked "user_visible" by the policy
+func UserVisibleDenyReasons(reason DenyReason) bool {
+	return reason.UserVisible
+}
+
+// DenyReasons parses the optional deny reasons in the OPA response
+// (under DenyReasonsKey, or else ErrorsKey).
+// Returns ErrInvalidDenyReasons if the deny reasons are not an array of strings or objects.
+func (o OPAResponse) DenyReasons() ([]DenyReason, error) {
+	drIfc, ok := o[DenyReasonsKey]
+	if !ok {
+		drIfc, ok = o[ErrorsKey]
+	}
+	if !ok || IsNilInterface(drIfc) {
+		return nil, nil
+	}
+
+	drArr, ok := drIfc.([]interface{})
+	if !ok {
+		return nil, ErrInvalidDenyReasons
+	}
+
+	reasons := make([]DenyReason, 0, len(drArr))
+	for _, elem := range drArr {
+		switch v := elem.(type) {
+		case string:
+			reasons = append(reasons, DenyReason{Message: v})
+		case map[string]interface{}:
+			reason, err := parseDenyReason(v)
+			if err != nil {
+				return nil, err
+			}
+			reasons = append(reasons, reason)
+		default:
+			return nil, ErrInvalidDenyReasons
+		}
+	}
+
+	return reasons, nil
+}
+
+func parseDenyReason(obj map[string]interface{}) (DenyReason, error) {
+	var reason DenyReason
+	var ok bool
+
+	for k, v := range obj {
+		switch k {
+		case "reason":
+			reason.Reason, ok = v.(string)
+		case "message":
+			reason.Message, ok = v.(string)
+		case "subject":
+			reason.Subject, ok = v.(string)
+		case "user_visible":
+			reason.UserVisible, ok = v.(bool)
+		case "metadata":
+			var mdObj map[string]interface{}
+			mdObj, ok = v.(map[string]interface{})
+			reason.Metadata = make(map[string]string, len(mdObj))
+			for mdKey, mdVal := range mdObj {
+				reason.Metadata[mdKey] = fmt.Sprint(mdVal)
+			}
+		default:
+			// Ignore unknown keys
+			ok = true
+		}
+		if !ok {
+			return DenyReason{}, ErrInvalidDenyReasons
+		}
+	}
+
+	return reason, nil
+}
+
+// DeniedError is returned by Evaluate when the request is denied
+// and the policy returned deny reasons allowed by the DenyReasonFilter.
+// It matches ErrForbidden with errors.Is.
+// Its gRPC status is PermissionDenied with the deny reasons as details:
+// a google.rpc.ErrorInfo for the first reason,
+// and a google.rpc.PreconditionFailure listing all reasons.
+type DeniedError struct {
+	// Domain is the google.rpc.ErrorInfo domain (the application)
+	Domain  string
+	Reasons []DenyReason
+}
+
+// Error implements error interface
+func (e *DeniedError) Error() string {
+	msgs := make([]string, 0, len(e.Reasons))
+	for _, reason := range e.Reasons {
+		msgs = append(msgs, reason.Message)
+	}
+	return fmt.Sprintf("%s: %s", ErrForbidden.Message, strings.Join(msgs, "; "))
+}
+
+// Unwrap allows errors.Is(err, ErrForbidden)
+func (e *DeniedError) Unwrap() error {
+	return ErrForbidden
+}
+
+// GRPCStatus returns the PermissionDenied status with the deny reasons as details
+func (e *DeniedError) GRPCStatus() *status.Status {
+	st := status.New(codes.PermissionDenied, ErrForbidden.Message)
+	if len(e.Reasons) == 0 {
+		return st
+	}
+
+	first := e.Reasons[0]
+	errInfo := &errdetails.ErrorInfo{
+		Reason:   first.Reason,
+		Domain:   e.Domain,
+		Metadata: first.Metadata,
+	}
+	if len(errInfo.Reason) == 0 {
+		errInfo.Reason = DefaultDenyReason
+	}
+
+	preFail := &errdetails.PreconditionFailure{}
+	for _, reason := range e.Reasons {
+		preFail.Violations = append(preFail.Violations, &errdetails.PreconditionFailure_Violation{
+			Type:        reason.Reason,
+			Subject:     reason.Subject,
+			Description: reason.Message,
+		})
+	}
+
+	detailed, err := st.WithDetails(errInfo, preFail)
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+// forbiddenError returns the error for a denied OPA response:
+// *DeniedError if the policy returned deny reasons allowed by the denyReasonFilter,
+// otherwise ErrForbidden.
+func (a *DefaultAuthorizer) forbiddenError(ctx context.Context, reasons []DenyReason) error {
+	filter := a.denyReasonFilter
+	if filter == nil {
+		filter = UserVisibleDenyReasons
+	}
+
+	visible := make([]DenyReason, 0, len(reasons))
+	for _, reason := range reasons {
+		if filter(reason) {
+			visible = append(visible, reason)
+		}
+	}
+
+	if len(visible) == 0 {
+		return ErrForbidden
+	}
+
+	ctxlogrus.Extract(ctx).WithField("deny_reasons", visible).Trace("visible_deny_reasons")
+
+	return &DeniedError{
+		Domain:  a.application,
+		Reasons: visible,
+	}
+}
@@ -0,0 +1,198 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+)
+
+func TestOPAResponseDenyReasons(t *testing.T) {
+	testMap := []struct {
+		name      string
+		respJSON  string
+		expect    []DenyReason
+		expectErr error
+	}{
+		{
+			name:     "no deny reasons",
+			respJSON: `{"allow": false}`,
+		},
+		{
+			name:     "null deny reasons",
+			respJSON: `{"allow": false, "deny_reasons": null}`,
+		},
+		{
+			name:     "string deny reasons",
+			respJSON: `{"allow": false, "deny_reasons": ["no access", "read-only"]}`,
+			expect: []DenyReason{
+				{Message: "no access"},
+				{Message: "read-only"},
+			},
+		},
+		{
+			name: "object deny reasons",
+			respJSON: `{"allow": false, "deny_reasons": [{
+				"reason": "ACCOUNT_SUSPENDED", "message": "account is suspended",
+				"subject": "account/123", "metadata": {"account_id": "123", "days": 3},
+				"user_visible": true, "unknown_key": 1}]}`,
+			expect: []DenyReason{{
+				Reason:      "ACCOUNT_SUSPENDED",
+				Message:     "account is suspended",
+				Subject:     "account/123",
+				Metadata:    map[string]string{"account_id": "123", "days": "3"},
+				UserVisible: true,
+			}},
+		},
+		{
+			name:     "errors key",
+			respJSON: `{"allow": false, "errors": ["no access"]}`,
+			expect:   []DenyReason{{Message: "no access"}},
+		},
+		{
+			name:     "deny_reasons key has precedence",
+			respJSON: `{"allow": false, "deny_reasons": ["deny"], "errors": ["error"]}`,
+			expect:   []DenyReason{{Message: "deny"}},
+		},
+		{
+			name:      "invalid deny reasons type",
+			respJSON:  `{"allow": false, "deny_reasons": "no access"}`,
+			expectErr: ErrInvalidDenyReasons,
+		},
+		{
+			name:      "invalid deny reason element",
+			respJSON:  `{"allow": false, "deny_reasons": [1]}`,
+			expectErr: ErrInvalidDenyReasons,
+		},
+		{
+			name:      "invalid deny reason field",
+			respJSON:  `{"allow": false, "deny_reasons": [{"user_visible": "yes"}]}`,
+			expectErr: ErrInvalidDenyReasons,
+		},
+	}
+
+	for _, tm := range testMap {
+		var opaResp OPAResponse
+		if err := json.Unmarshal([]byte(tm.respJSON), &opaResp); err != nil {
+			t.Fatalf("%s: json.Unmarshal fatal err: %v", tm.name, err)
+		}
+
+		actual, err := opaResp.DenyReasons()
+		if err != tm.expectErr {
+			t.Errorf("%s: FAIL: got err: %v wanted: %v", tm.name, err, tm.expectErr)
+		}
+		if len(actual) != 0 || len(tm.expect) != 0 {
+			if !reflect.DeepEqual(actual, tm.expect) {
+				t.Errorf("%s: FAIL:\ngot:    %#v\nwanted: %#v", tm.name, actual, tm.expect)
+			}
+		}
+	}
+}
+
+func TestDenyReasonsErrorDetails(t *testing.T) {
+	respJSON := `{"allow": false, "deny_reasons": [
+		{"reason": "ACCOUNT_SUSPENDED", "message": "account is suspended",
+		 "subject": "account/123", "metadata": {"account_id": "123"}, "user_visible": true},
+		{"reason": "INTERNAL_RULE", "message": "rule 42 failed"},
+		{"message": "quota exceeded", "user_visible": true}
+	]}`
+
+	testMap := []struct {
+		name            string
+		opts            []Option
+		respJSON        string
+		expectForbidden bool
+		expectReasons   []string
+	}{
+		{
+			name:          "default filter, user-visible reasons only",
+			respJSON:      respJSON,
+			expectReasons: []string{"account is suspended", "quota exceeded"},
+		},
+		{
+			name: "custom filter, all reasons",
+			opts: []Option{WithDenyReasonFilter(func(DenyReason) bool {
+				return true
+			})},
+			respJSON:      respJSON,
+			expectReasons: []string{"account is suspended", "rule 42 failed", "quota exceeded"},
+		},
+		{
+			name:            "no user-visible reasons",
+			respJSON:        `{"allow": false, "deny_reasons": ["internal"]}`,
+			expectForbidden: true,
+		},
+		{
+			name:            "no deny reasons",
+			respJSON:        `{"allow": false}`,
+			expectForbidden: true,
+		},
+	}
+
+	grpcUnaryHandler := func(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+		return nil, nil
+	}
+
+	for _, tm := range testMap {
+		t.Run(tm.name, func(t *testing.T) {
+			opts := append([]Option{
+				WithOpaEvaluator(mockJSONEvaluator(tm.respJSON)),
+				WithClaimsVerifier(NullClaimsVerifier),
+			}, tm.opts...)
+			interceptor := UnaryServerInterceptor("app", opts...)
+
+			ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "FakeMethod"}, grpcUnaryHandler)
+
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("FAIL: got err: %v wanted: %v", err, ErrForbidden)
+			}
+			if tm.expectForbidden {
+				if err != ErrForbidden {
+					t.Errorf("FAIL: got err: %#v wanted: ErrForbidden", err)
+				}
+				return
+			}
+
+			st := status.Convert(err)
+			if st.Code() != codes.PermissionDenied {
+				t.Errorf("FAIL: got code: %v wanted: %v", st.Code(), codes.PermissionDenied)
+			}
+
+			var errInfo *errdetails.ErrorInfo
+			var preFail *errdetails.PreconditionFailure
+			for _, detail := range st.Details() {
+				switch d := detail.(type) {
+				case *errdetails.ErrorInfo:
+					errInfo = d
+				case *errdetails.PreconditionFailure:
+					preFail = d
+				}
+			}
+
+			if errInfo == nil || errInfo.Reason != "ACCOUNT_SUSPENDED" || errInfo.Domain != "app" ||
+				errInfo.Metadata["account_id"] != "123" {
+				t.Errorf("FAIL: unexpected ErrorInfo: %v", errInfo)
+			}
+
+			if preFail == nil {
+				t.Fatalf("FAIL: missing PreconditionFailure")
+			}
+			var actualReasons []string
+			for _, violation := range preFail.Violations {
+				actualReasons = append(actualReasons, violation.Description)
+			}
+			if !reflect.DeepEqual(actualReasons, tm.expectReasons) {
+				t.Errorf("FAIL: got reasons: %v wanted: %v", actualReasons, tm.expectReasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultEffectivePermissionsPath is default OPA path to fetch current user's effective permissions
+	DefaultEffectivePermissionsPath = "v1/data/authz/rbac/effective_permissions"
+)
+
+// EffectivePermissionsInput is the input payload for effective_permissions
+type EffectivePermissionsInput struct {
+	JWT         string   `json:"jwt"`
+	Application string   `json:"application"`
+	Endpoints   []string `json:"endpoints"`
+}
+
+// EffectivePermissionsType is a convenience data type, returned by GetEffectivePermissions()
+// (map of endpoint to map of type to array of verbs)
+type EffectivePermissionsType map[string]map[string][]string
+
+// EffectivePermissionsResult is the data type json.Unmarshaled from OPA RESTAPI query
+// to effective_permissions rego rule
+type EffectivePermissionsResult struct {
+	Result EffectivePermissionsType `json:"result"`
+}
+
+// Can returns whether verb on type is permitted for endpoint
+func (p EffectivePermissionsType) Can(endpoint, typ, verb string) bool {
+	for _, v := range p[endpoint][typ] {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// GetEffectivePermissions returns the current-user's effective permissions
+// (map of endpoint to map of type to array of verbs) for the JWT in the context.
+// If endpoints are specified, only the permissions of those endpoints are returned
+// (endpoints are of the form "Service.Method", see Payload.Endpoint).
+func (a *DefaultAuthorizer) GetEffectivePermissions(ctx context.Context, endpoints ...string) (EffectivePermissionsType, error) {
+	lgNtry := ctxlogrus.Extract(ctx)
+	permsResult := EffectivePermissionsResult{}
+
+	rawJWT, err := a.verifyClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoints == nil {
+		endpoints = []string{}
+	}
+
+	opaReq := OPARequest{
+		Input: &EffectivePermissionsInput{
+			JWT:         redactJWT(rawJWT),
+			Application: a.application,
+			Endpoints:   endpoints,
+		},
+	}
+
+	err = a.clienter.CustomQuery(ctx, a.effectivePermsApi, opaReq, &permsResult)
+	if err != nil {
+		lgNtry.WithError(err).Error("get_effective_permissions_fail")
+		return nil, err
+	}
+
+	// Filter here as well, in case the policy does not filter by endpoints
+	if len(endpoints) > 0 && permsResult.Result != nil {
+		filtered := EffectivePermissionsType{}
+		for _, endpoint := range endpoints {
+			if perms, ok := permsResult.Result[endpoint]; ok {
+				filtered[endpoint] = perms
+			}
+		}
+		permsResult.Result = filtered
+	}
+
+	lgNtry.WithFields(logrus.Fields{
+		"permsResult": fmt.Sprintf("%#v", permsResult),
+	}).Trace("get_effective_permissions_okay")
+
+	return permsResult.Result, nil
+}
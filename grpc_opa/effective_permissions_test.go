@@ -0,0 +1,217 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+	atlas_claims "github.com/infobloxopen/atlas-claims"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+)
+
+func TestGetEffectivePermissionsOpa(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	done := make(chan struct{})
+	clienter := utils_test.StartOpa(ctx, t, done)
+	cli, ok := clienter.(*opa_client.Client)
+	if !ok {
+		t.Fatal("Unable to convert interface to (*Client)")
+		return
+	}
+
+	// Errors above here will leak containers
+	defer func() {
+		cancel()
+		// Wait for container to be shutdown
+		<-done
+	}()
+
+	policyRego, err := ioutil.ReadFile("testdata/mock_authz_policy.rego")
+	if err != nil {
+		t.Fatalf("ReadFile fatal err: %#v", err)
+		return
+	}
+
+	var resp interface{}
+	err = cli.UploadRegoPolicy(ctx, "mock_authz_policyid", policyRego, resp)
+	if err != nil {
+		t.Fatalf("OpaUploadPolicy fatal err: %#v", err)
+		return
+	}
+
+	auther := NewDefaultAuthorizer("bogus_unused_application_value",
+		WithOpaClienter(cli),
+	)
+
+	testCases := []struct {
+		name      string
+		groups    []string
+		endpoints []string
+		expVal    EffectivePermissionsType
+	}{
+		{
+			name:   "custom-admin-group,user; all endpoints",
+			groups: []string{"custom-admin-group", "user"},
+			expVal: EffectivePermissionsType{
+				"TagService.ListTags":  {"ddi.tag": {"list", "read"}},
+				"TagService.DeleteTag": {"ddi.tag": {"delete"}},
+				"UserService.GetUser":  {"iam.user": {"read"}},
+			},
+		},
+		{
+			name:      "user; specific endpoints",
+			groups:    []string{"user"},
+			endpoints: []string{"TagService.ListTags", "TagService.DeleteTag"},
+			expVal: EffectivePermissionsType{
+				"TagService.ListTags": {"ddi.tag": {"list"}},
+			},
+		},
+		{
+			name:   "no groups",
+			expVal: EffectivePermissionsType{},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &atlas_claims.Claims{
+				AccountId: "40",
+				Groups:    tt.groups,
+			}
+
+			jwt, err := atlas_claims.BuildJwt(claims, "some-hmac-key-we-dont-care", time.Hour*9)
+			if err != nil {
+				t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+			}
+
+			ttCtx := utils_test.ContextWithJWT(ctx, jwt)
+
+			gotVal, err := auther.GetEffectivePermissions(ttCtx, tt.endpoints...)
+			if err != nil {
+				t.Errorf("FAIL: GetEffectivePermissions() unexpected err=%v", err)
+			}
+
+			if !reflect.DeepEqual(gotVal, tt.expVal) {
+				t.Errorf("FAIL:\ngotVal:  %#v\nexpVal: %#v",
+					gotVal, tt.expVal)
+			}
+		})
+	}
+}
+
+func TestGetEffectivePermissionsMockOpaClient(t *testing.T) {
+	testCases := []struct {
+		name      string
+		respJson  string
+		endpoints []string
+		expErr    bool
+		expVal    EffectivePermissionsType
+	}{
+		{
+			name:     `valid result`,
+			respJson: `{ "result": { "TagService.ListTags": { "ddi.tag": [ "list" ] } } }`,
+			expVal: EffectivePermissionsType{
+				"TagService.ListTags": {"ddi.tag": {"list"}},
+			},
+		},
+		{
+			name: `unfiltered result is filtered`,
+			respJson: `{ "result": { "TagService.ListTags": { "ddi.tag": [ "list" ] },
+				"TagService.DeleteTag": { "ddi.tag": [ "delete" ] } } }`,
+			endpoints: []string{"TagService.DeleteTag", "UserService.GetUser"},
+			expVal: EffectivePermissionsType{
+				"TagService.DeleteTag": {"ddi.tag": {"delete"}},
+			},
+		},
+		{
+			name:     `null result ok`,
+			respJson: `{ "result": null }`,
+			expVal:   nil,
+		},
+		{
+			name:     `invalid result array`,
+			respJson: `{ "result": [ "TagService.ListTags" ] }`,
+			expErr:   true,
+		},
+		{
+			name:     `invalid verbs`,
+			respJson: `{ "result": { "TagService.ListTags": { "ddi.tag": "list" } } }`,
+			expErr:   true,
+		},
+	}
+
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			mockOpaClienter := utils_test.MockOpaClienter{
+				Loggr:        stdLoggr,
+				RegoRespJSON: tt.respJson,
+			}
+			auther := NewDefaultAuthorizer("bogus_unused_application_value",
+				WithOpaClienter(&mockOpaClienter),
+			)
+
+			claims := &atlas_claims.Claims{}
+			jwt, err := atlas_claims.BuildJwt(claims, "some-hmac-key-we-dont-care", time.Hour*9)
+			if err != nil {
+				t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+			}
+			ttCtx := utils_test.ContextWithJWT(ctx, jwt)
+
+			gotVal, gotErr := auther.GetEffectivePermissions(ttCtx, tt.endpoints...)
+
+			if tt.expErr && gotErr == nil {
+				t.Errorf("FAIL: expected err, but got no err")
+			} else if !tt.expErr && gotErr != nil {
+				t.Errorf("FAIL: got unexpected err=%s", gotErr)
+			}
+
+			if gotErr != nil && gotVal != nil {
+				t.Errorf("FAIL: returned val should be nil if err returned")
+			}
+
+			if !reflect.DeepEqual(gotVal, tt.expVal) {
+				t.Errorf("FAIL: expVal=%#v gotVal=%#v",
+					tt.expVal, gotVal)
+			}
+		})
+	}
+
+	// No JWT
+	auther := NewDefaultAuthorizer("bogus_unused_application_value",
+		WithOpaClienter(&utils_test.MockOpaClienter{Loggr: stdLoggr}),
+	)
+	if _, err := auther.GetEffectivePermissions(ctx); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("FAIL: got err=%v wanted %v", err, ErrNoCredentials)
+	}
+}
+
+func TestEffectivePermissionsCan(t *testing.T) {
+	perms := EffectivePermissionsType{
+		"TagService.ListTags": {"ddi.tag": {"list", "read"}},
+	}
+
+	if !perms.Can("TagService.ListTags", "ddi.tag", "read") {
+		t.Errorf("FAIL: expected read permitted")
+	}
+	if perms.Can("TagService.ListTags", "ddi.tag", "delete") {
+		t.Errorf("FAIL: expected delete not permitted")
+	}
+	if perms.Can("TagService.DeleteTag", "ddi.tag", "delete") {
+		t.Errorf("FAIL: expected unknown endpoint not permitted")
+	}
+}
@@ -37,6 +37,23 @@ func (o OPAResponse) AddRawEntitledFeatures(ctx context.Context) context.Context
 // Returns flattened array of the form:
 //   []string{"lic.dhcp", "lic.ipam", "rpz.bogon", "rpz.malware"}
 func FlattenRawEntitledFeatures(efIfc interface{}) ([]string, error) {
+	svcFeats, err := parseRawEntitledFeatures(efIfc)
+	if err != nil || svcFeats == nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for svcName, feats := range svcFeats {
+		for _, feat := range feats {
+			result = append(result, svcName+"."+feat)
+		}
+	}
+
+	return result, nil
+}
+
+// parseRawEntitledFeatures parses raw entitled_features into map of service to array of features
+func parseRawEntitledFeatures(efIfc interface{}) (map[string][]string, error) {
 	if IsNilInterface(efIfc) {
 		return nil, nil
 	}
@@ -46,7 +63,7 @@ func FlattenRawEntitledFeatures(efIfc interface{}) ([]string, error) {
 		return nil, ErrInvalidEntitledFeatures
 	}
 
-	result := []string{}
+	result := make(map[string][]string, len(efMapIfc))
 	for svcName, featIfc := range efMapIfc {
 		if IsNilInterface(featIfc) {
 			continue
@@ -67,8 +84,7 @@ func FlattenRawEntitledFeatures(efIfc interface{}) ([]string, error) {
 				return nil, ErrInvalidEntitledFeatures
 			}
 
-			flatten := svcName + "." + oneFeatStr
-			result = append(result, flatten)
+			result[svcName] = append(result[svcName], oneFeatStr)
 		}
 	}
 
@@ -5,7 +5,6 @@ import (
 	"fmt"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
-	atlas_claims "github.com/infobloxopen/atlas-claims"
 	logrus "github.com/sirupsen/logrus"
 )
 
@@ -37,44 +36,43 @@ type FilterCompartmentPermissionsResult struct {
 	Result FilterCompartmentPermissionsType `json:"result"`
 }
 
-// FilterCompartmentPermissions filters list of permissions based on the JWT in the context
+// FilterCompartmentPermissions filters list of permissions based on the JWT in the context.
+// The result is memoized in the request context (see ContextWithLookupMemo)
+// and cached (see WithLookupCache) if enabled.
 func (a *DefaultAuthorizer) FilterCompartmentPermissions(ctx context.Context, permissions FilterCompartmentPermissionsType) (FilterCompartmentPermissionsType, error) {
 	lgNtry := ctxlogrus.Extract(ctx)
-	permsResult := FilterCompartmentPermissionsResult{}
 
-	// This fetches auth data from auth headers in metadata from context:
-	// bearer = data from "authorization bearer" metadata header
-	// newBearer = data from "set-authorization bearer" metadata header
-	bearer, newBearer := atlas_claims.AuthBearersFromCtx(ctx)
-
-	claimsVerifier := a.claimsVerifier
-	if claimsVerifier == nil {
-		claimsVerifier = UnverifiedClaimFromBearers
-	}
-
-	rawJWT, errs := claimsVerifier([]string{bearer}, []string{newBearer})
-	if len(errs) > 0 {
-		return nil, fmt.Errorf("%q", errs)
-	}
-
-	opaReq := OPARequest{
-		Input: &FilterCompartmentPermissionsInput{
-			JWT:         redactJWT(rawJWT),
-			Permissions: permissions,
-		},
+	rawJWT, err := a.lookupJWT(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	err := a.clienter.CustomQuery(ctx, a.filterCompartmentPermsApi, opaReq, &permsResult)
+	result, err := a.lookup(ctx, rawJWT, a.filterCompartmentPermsApi, permissions, func() (interface{}, error) {
+		permsResult := FilterCompartmentPermissionsResult{}
+		opaReq := OPARequest{
+			Input: &FilterCompartmentPermissionsInput{
+				JWT:         redactJWT(rawJWT),
+				Permissions: permissions,
+			},
+		}
+
+		err := a.clienter.CustomQuery(ctx, a.filterCompartmentPermsApi, opaReq, &permsResult)
+		if err != nil {
+			lgNtry.WithError(err).Error("filter_compartment_permissions_fail")
+			return nil, err
+		}
+
+		lgNtry.WithFields(logrus.Fields{
+			"permsResult": fmt.Sprintf("%#v", permsResult),
+		}).Trace("filter_compartment_permissions_okay")
+
+		return permsResult.Result, nil
+	})
 	if err != nil {
-		lgNtry.WithError(err).Error("filter_compartment_permissions_fail")
 		return nil, err
 	}
 
-	lgNtry.WithFields(logrus.Fields{
-		"permsResult": fmt.Sprintf("%#v", permsResult),
-	}).Trace("filter_compartment_permissions_okay")
-
-	return permsResult.Result, nil
+	return FilterCompartmentPermissionsType(copyStrings(result.(FilterCompartmentPermissionsType))), nil
 }
 
 // FilterCompartmentFeaturesInput is the input payload for filter_compartment_features_api
@@ -89,42 +87,49 @@ type FilterCompartmentFeaturesResult struct {
 	Result FilterCompartmentFeaturesType `json:"result"`
 }
 
-// FilterCompartmentFeatures filters list of features based on the JWT in the context
+// FilterCompartmentFeatures filters list of features based on the JWT in the context.
+// The result is memoized in the request context (see ContextWithLookupMemo)
+// and cached (see WithLookupCache) if enabled.
 func (a *DefaultAuthorizer) FilterCompartmentFeatures(ctx context.Context, features FilterCompartmentFeaturesType) (FilterCompartmentFeaturesType, error) {
 	lgNtry := ctxlogrus.Extract(ctx)
-	featsResult := FilterCompartmentFeaturesResult{}
-
-	// This fetches auth data from auth headers in metadata from context:
-	// bearer = data from "authorization bearer" metadata header
-	// newBearer = data from "set-authorization bearer" metadata header
-	bearer, newBearer := atlas_claims.AuthBearersFromCtx(ctx)
 
-	claimsVerifier := a.claimsVerifier
-	if claimsVerifier == nil {
-		claimsVerifier = UnverifiedClaimFromBearers
-	}
-
-	rawJWT, errs := claimsVerifier([]string{bearer}, []string{newBearer})
-	if len(errs) > 0 {
-		return nil, fmt.Errorf("%q", errs)
-	}
-
-	opaReq := OPARequest{
-		Input: &FilterCompartmentFeaturesInput{
-			JWT:                 redactJWT(rawJWT),
-			ApplicationFeatures: features,
-		},
+	rawJWT, err := a.lookupJWT(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	err := a.clienter.CustomQuery(ctx, a.filterCompartmentFeatsApi, opaReq, &featsResult)
+	result, err := a.lookup(ctx, rawJWT, a.filterCompartmentFeatsApi, features, func() (interface{}, error) {
+		featsResult := FilterCompartmentFeaturesResult{}
+		opaReq := OPARequest{
+			Input: &FilterCompartmentFeaturesInput{
+				JWT:                 redactJWT(rawJWT),
+				ApplicationFeatures: features,
+			},
+		}
+
+		err := a.clienter.CustomQuery(ctx, a.filterCompartmentFeatsApi, opaReq, &featsResult)
+		if err != nil {
+			lgNtry.WithError(err).Error("filter_compartment_features_fail")
+			return nil, err
+		}
+
+		lgNtry.WithFields(logrus.Fields{
+			"featsResult": fmt.Sprintf("%#v", featsResult),
+		}).Trace("filter_compartment_features_okay")
+
+		return featsResult.Result, nil
+	})
 	if err != nil {
-		lgNtry.WithError(err).Error("filter_compartment_features_fail")
 		return nil, err
 	}
 
-	lgNtry.WithFields(logrus.Fields{
-		"featsResult": fmt.Sprintf("%#v", featsResult),
-	}).Trace("filter_compartment_features_okay")
-
-	return featsResult.Result, nil
+	cachedFeats := result.(FilterCompartmentFeaturesType)
+	if cachedFeats == nil {
+		return nil, nil
+	}
+	feats := make(FilterCompartmentFeaturesType, len(cachedFeats))
+	for app, appFeats := range cachedFeats {
+		feats[app] = copyStrings(appFeats)
+	}
+	return feats, nil
 }
@@ -0,0 +1,473 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	logrus "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultJWKSRefreshInterval is the default max age of the cached JWKS
+	DefaultJWKSRefreshInterval = 15 * time.Minute
+
+	// DefaultJWKSMinRefreshInterval is the default min interval between
+	// JWKS refreshes triggered by tokens signed with an unknown key id
+	DefaultJWKSMinRefreshInterval = time.Minute
+
+	// maxJWKSSize limits the size of a JWKS fetched from an HTTP endpoint
+	maxJWKSSize = 1 << 20
+)
+
+var (
+	// ErrJWKSKeyNotFound is returned if the JWT signing key is not in the JWKS
+	ErrJWKSKeyNotFound = errors.New("jwks: signing key not found")
+
+	// ErrInvalidJWKS is returned if the JWKS cannot be loaded or parsed
+	ErrInvalidJWKS = errors.New("jwks: invalid key set")
+
+	// jwksValidMethods are the asymmetric signing methods accepted by JWKSVerifier
+	jwksValidMethods = []string{
+		"RS256", "RS384", "RS512",
+		"PS256", "PS384", "PS512",
+		"ES256", "ES384", "ES512",
+	}
+)
+
+// JWKSOption configures a JWKSVerifier
+type JWKSOption func(v *JWKSVerifier)
+
+// WithJWKSIssuer requires the JWT 'iss' claim to equal issuer
+func WithJWKSIssuer(issuer string) JWKSOption {
+	return func(v *JWKSVerifier) {
+		v.issuer = issuer
+	}
+}
+
+// WithJWKSAudience requires the JWT 'aud' claim to contain one of audience
+func WithJWKSAudience(audience ...string) JWKSOption {
+	return func(v *JWKSVerifier) {
+		v.audience = audience
+	}
+}
+
+// WithJWKSLeeway allows for clock skew when checking the
+// 'exp', 'nbf' and 'iat' JWT claims
+func WithJWKSLeeway(leeway time.Duration) JWKSOption {
+	return func(v *JWKSVerifier) {
+		v.leeway = leeway
+	}
+}
+
+// WithJWKSRefreshInterval overrides DefaultJWKSRefreshInterval and
+// DefaultJWKSMinRefreshInterval
+func WithJWKSRefreshInterval(refresh, minRefresh time.Duration) JWKSOption {
+	return func(v *JWKSVerifier) {
+		v.refreshInterval = refresh
+		v.minRefreshInterval = minRefresh
+	}
+}
+
+// WithJWKSHTTPClient overrides the default http.Client used to fetch the JWKS
+func WithJWKSHTTPClient(cli *http.Client) JWKSOption {
+	return func(v *JWKSVerifier) {
+		if cli != nil {
+			v.httpClient = cli
+		}
+	}
+}
+
+// JWKSVerifier verifies JWT signatures against a JSON Web Key Set (RFC 7517)
+// loaded from a local file or an HTTP(S) endpoint,
+// and checks the 'exp', 'nbf', 'iat', 'iss' and 'aud' claims.
+// The JWKS is cached, and reloaded in the background when older than the refresh interval,
+// or before verifying a JWT signed with an unknown key id (to support key rotation).
+// Verifications never wait for a reload unless the key id is unknown.
+//
+// Use JWKSVerifier.Verify as the ClaimsVerifier:
+//
+//	verifier, err := NewJWKSVerifier("https://issuer/.well-known/jwks.json",
+//		WithJWKSIssuer("https://issuer"))
+//	authzer := NewDefaultAuthorizer(app, WithClaimsVerifier(verifier.Verify))
+type JWKSVerifier struct {
+	source             string
+	httpClient         *http.Client
+	issuer             string
+	audience           []string
+	leeway             time.Duration
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	now                func() time.Time
+
+	refreshGroup singleflight.Group
+
+	mu          sync.RWMutex
+	keys        map[string]jsonWebKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// jsonWebKey is a parsed public key from a JWKS
+type jsonWebKey struct {
+	alg string
+	key interface{}
+}
+
+// NewJWKSVerifier returns a JWKSVerifier for the JWKS at source,
+// which is either an http(s) URL or a local file path.
+// Returns error if the JWKS cannot be loaded initially.
+func NewJWKSVerifier(source string, opts ...JWKSOption) (*JWKSVerifier, error) {
+	v := &JWKSVerifier{
+		source:             source,
+		httpClient:         &http.Client{Timeout: 10 * time.Second},
+		refreshInterval:    DefaultJWKSRefreshInterval,
+		minRefreshInterval: DefaultJWKSMinRefreshInterval,
+		now:                time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	if err := v.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Verify implements ClaimsVerifier.
+// It verifies the 'bearer' and 'newBearer' JWT strings,
+// and returns the chosen valid bearer string ('newBearer' has precedence over 'bearer').
+// Returns errors if none of the bearer strings are valid.
+func (v *JWKSVerifier) Verify(bearer, newBearer []string) (string, []error) {
+	var errs []error
+	for _, jwtStrings := range [][]string{newBearer, bearer} {
+		for _, jwtString := range jwtStrings {
+			if err := v.verifyJWT(jwtString); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return jwtString, nil
+		}
+	}
+
+	return "", errs
+}
+
+// Refresh reloads the JWKS from its source.
+// The cached JWKS is kept if reloading fails.
+func (v *JWKSVerifier) Refresh(ctx context.Context) error {
+	v.mu.Lock()
+	attemptedAt := v.now()
+	v.attemptedAt = attemptedAt
+	v.mu.Unlock()
+
+	return v.reload(ctx, attemptedAt)
+}
+
+// reload loads the JWKS, without holding the lock
+func (v *JWKSVerifier) reload(ctx context.Context, attemptedAt time.Time) error {
+	data, err := v.load(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidJWKS, err)
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if attemptedAt.Before(v.fetchedAt) {
+		// A more recent reload completed first
+		return nil
+	}
+	v.keys = keys
+	v.fetchedAt = attemptedAt
+	return nil
+}
+
+// sharedReload reloads the JWKS if due (see reloadDue), logging failures.
+// Concurrent callers wait for the same reload.
+func (v *JWKSVerifier) sharedReload(now time.Time, periodic bool) error {
+	_, err, _ := v.refreshGroup.Do("jwks", func() (interface{}, error) {
+		if !v.claimReload(now, periodic) {
+			return nil, nil
+		}
+
+		err := v.reload(context.Background(), now)
+		if err != nil {
+			logrus.WithError(err).WithField("source", v.source).Error("jwks_refresh_fail")
+		}
+		return nil, err
+	})
+	return err
+}
+
+// reloadDue returns whether the JWKS should be reloaded: reloads are rate limited
+// by minRefreshInterval (including failed reloads), and periodic reloads
+// are only due when the JWKS is older than refreshInterval
+func (v *JWKSVerifier) reloadDue(now time.Time, periodic bool) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.reloadDueLocked(now, periodic)
+}
+
+func (v *JWKSVerifier) reloadDueLocked(now time.Time, periodic bool) bool {
+	if now.Sub(v.attemptedAt) < v.minRefreshInterval {
+		return false
+	}
+	return !periodic || now.Sub(v.fetchedAt) >= v.refreshInterval
+}
+
+// claimReload marks the reload attempted, returning false if not due
+func (v *JWKSVerifier) claimReload(now time.Time, periodic bool) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.reloadDueLocked(now, periodic) {
+		return false
+	}
+	v.attemptedAt = now
+	return true
+}
+
+func (v *JWKSVerifier) load(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(v.source, "http://") && !strings.HasPrefix(v.source, "https://") {
+		return ioutil.ReadFile(v.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", v.source, resp.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+// lookupKey returns the key for kid, reloading the JWKS if required:
+// in the background when older than the refresh interval (serving the cached keys meanwhile),
+// or before returning if kid is unknown.
+func (v *JWKSVerifier) lookupKey(kid string) (jsonWebKey, error) {
+	now := v.now()
+	jwk, ok := v.findKey(kid)
+
+	if ok {
+		if v.reloadDue(now, true) {
+			go v.sharedReload(now, true)
+		}
+		return jwk, nil
+	}
+
+	if err := v.sharedReload(now, false); err != nil {
+		return jsonWebKey{}, err
+	}
+	jwk, ok = v.findKey(kid)
+
+	if !ok {
+		return jsonWebKey{}, fmt.Errorf("%w: kid=%q", ErrJWKSKeyNotFound, kid)
+	}
+
+	return jwk, nil
+}
+
+// findKey returns the key for kid.
+// A JWT without kid may only be verified by a JWKS with a single key.
+func (v *JWKSVerifier) findKey(kid string) (jsonWebKey, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if kid == "" && len(v.keys) == 1 {
+		for _, jwk := range v.keys {
+			return jwk, true
+		}
+	}
+
+	jwk, ok := v.keys[kid]
+	return jwk, ok
+}
+
+func (v *JWKSVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	jwk, err := v.lookupKey(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if jwk.alg != "" && jwk.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("jwks: kid=%q requires alg %s, got %s", kid, jwk.alg, token.Method.Alg())
+	}
+
+	return jwk.key, nil
+}
+
+func (v *JWKSVerifier) verifyJWT(jwtString string) error {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(jwksValidMethods), jwt.WithoutClaimsValidation())
+	if _, err := parser.ParseWithClaims(jwtString, claims, v.keyFunc); err != nil {
+		return err
+	}
+
+	return v.validateClaims(claims)
+}
+
+func (v *JWKSVerifier) validateClaims(claims jwt.MapClaims) error {
+	now := v.now()
+	leeway := v.leeway
+
+	if !claims.VerifyExpiresAt(now.Add(-leeway).Unix(), true) {
+		return errors.New("jwks: token is expired or has no exp claim")
+	}
+	if !claims.VerifyNotBefore(now.Add(leeway).Unix(), false) {
+		return errors.New("jwks: token is not valid yet")
+	}
+	if !claims.VerifyIssuedAt(now.Add(leeway).Unix(), false) {
+		return errors.New("jwks: token used before issued")
+	}
+
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return fmt.Errorf("jwks: invalid issuer, want %q", v.issuer)
+	}
+
+	if len(v.audience) == 0 {
+		return nil
+	}
+	for _, aud := range v.audience {
+		if claims.VerifyAudience(aud, true) {
+			return nil
+		}
+	}
+	return fmt.Errorf("jwks: invalid audience, want one of %q", v.audience)
+}
+
+// parseJWKS parses the public keys in a JWKS, indexed by key id.
+// Keys not used for signatures, and unsupported key types are skipped.
+func parseJWKS(data []byte) (map[string]jsonWebKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidJWKS, err)
+	}
+
+	keys := map[string]jsonWebKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAJWK(k.N, k.E)
+		case "EC":
+			key, err = parseECJWK(k.Crv, k.X, k.Y)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: kid=%q: %s", ErrInvalidJWKS, k.Kid, err)
+		}
+
+		keys[k.Kid] = jsonWebKey{alg: k.Alg, key: key}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no signing keys", ErrInvalidJWKS)
+	}
+
+	return keys, nil
+}
+
+func parseRSAJWK(n, e string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid n: %s", err)
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, fmt.Errorf("invalid e: %s", err)
+	}
+
+	eInt := new(big.Int).SetBytes(eBytes)
+	if len(nBytes) == 0 || !eInt.IsInt64() || eInt.Int64() < 3 || eInt.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA key")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(eInt.Int64()),
+	}, nil
+}
+
+func parseECJWK(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported crv %q", crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x: %s", err)
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y: %s", err)
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("invalid EC key")
+	}
+
+	return key, nil
+}
@@ -0,0 +1,399 @@
+package grpc_opa_middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func rsaJWK(t *testing.T, kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(t *testing.T, kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func marshalJWKS(t *testing.T, keys ...map[string]string) []byte {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatalf("json.Marshal fatal err: %v", err)
+	}
+	return data
+}
+
+func signJWT(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString fatal err: %v", err)
+	}
+	return signed
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey fatal err: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey fatal err: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey fatal err: %v", err)
+	}
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err = ioutil.WriteFile(jwksFile, marshalJWKS(t, rsaJWK(t, "rsa1", rsaKey), ecJWK(t, "ec1", ecKey)), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile fatal err: %v", err)
+	}
+
+	now := time.Now()
+	verifier, err := NewJWKSVerifier(jwksFile,
+		WithJWKSIssuer("https://issuer.example"),
+		WithJWKSAudience("svc-a", "svc-b"),
+		WithJWKSLeeway(30*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("NewJWKSVerifier fatal err: %v", err)
+	}
+	verifier.now = func() time.Time { return now }
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":        "https://issuer.example",
+			"aud":        []string{"svc-b"},
+			"iat":        now.Unix(),
+			"exp":        now.Add(time.Hour).Unix(),
+			"account_id": "40",
+		}
+	}
+	withClaim := func(key string, val interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if val == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = val
+		}
+		return claims
+	}
+
+	testCases := []struct {
+		name   string
+		method jwt.SigningMethod
+		kid    string
+		key    interface{}
+		claims jwt.MapClaims
+		expOk  bool
+	}{
+		{
+			name:   "valid RS256",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: validClaims(),
+			expOk:  true,
+		},
+		{
+			name:   "valid ES256",
+			method: jwt.SigningMethodES256,
+			kid:    "ec1",
+			key:    ecKey,
+			claims: validClaims(),
+			expOk:  true,
+		},
+		{
+			name:   "expired within leeway",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: withClaim("exp", now.Add(-10*time.Second).Unix()),
+			expOk:  true,
+		},
+		{
+			name:   "expired",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: withClaim("exp", now.Add(-time.Minute).Unix()),
+		},
+		{
+			name:   "missing exp",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: withClaim("exp", nil),
+		},
+		{
+			name:   "not yet valid",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: withClaim("nbf", now.Add(time.Minute).Unix()),
+		},
+		{
+			name:   "issued in future",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: withClaim("iat", now.Add(time.Minute).Unix()),
+		},
+		{
+			name:   "wrong issuer",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: withClaim("iss", "https://evil.example"),
+		},
+		{
+			name:   "wrong audience",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: withClaim("aud", "svc-c"),
+		},
+		{
+			name:   "wrong signing key",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa1",
+			key:    otherKey,
+			claims: validClaims(),
+		},
+		{
+			name:   "unknown kid",
+			method: jwt.SigningMethodRS256,
+			kid:    "rsa2",
+			key:    rsaKey,
+			claims: validClaims(),
+		},
+		{
+			name:   "alg mismatch with jwk",
+			method: jwt.SigningMethodRS384,
+			kid:    "rsa1",
+			key:    rsaKey,
+			claims: validClaims(),
+		},
+		{
+			name:   "HMAC rejected",
+			method: jwt.SigningMethodHS256,
+			kid:    "rsa1",
+			key:    []byte("some-hmac-key-we-dont-care"),
+			claims: validClaims(),
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			signed := signJWT(t, tt.method, tt.kid, tt.key, tt.claims)
+
+			gotJWT, gotErrs := verifier.Verify([]string{signed}, []string{""})
+			if tt.expOk && (len(gotErrs) > 0 || gotJWT != signed) {
+				t.Errorf("FAIL: expected valid, got errs=%q", gotErrs)
+			} else if !tt.expOk && (len(gotErrs) == 0 || gotJWT != "") {
+				t.Errorf("FAIL: expected errs, got jwt=%q", gotJWT)
+			}
+		})
+	}
+
+	// newBearer has precedence over bearer
+	bearer := signJWT(t, jwt.SigningMethodRS256, "rsa1", rsaKey, validClaims())
+	newBearer := signJWT(t, jwt.SigningMethodES256, "ec1", ecKey, validClaims())
+	if gotJWT, gotErrs := verifier.Verify([]string{bearer}, []string{newBearer}); gotJWT != newBearer {
+		t.Errorf("FAIL: expected newBearer, got jwt=%q errs=%q", gotJWT, gotErrs)
+	}
+
+	// ... unless newBearer is invalid
+	if gotJWT, gotErrs := verifier.Verify([]string{bearer}, []string{"garbage"}); gotJWT != bearer {
+		t.Errorf("FAIL: expected bearer, got jwt=%q errs=%q", gotJWT, gotErrs)
+	}
+}
+
+func TestJWKSVerifierRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey fatal err: %v", err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey fatal err: %v", err)
+	}
+
+	var jwks atomic.Value
+	jwks.Store(marshalJWKS(t, rsaJWK(t, "old", oldKey)))
+	var fetches int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(jwks.Load().([]byte))
+	}))
+	defer svr.Close()
+
+	now := time.Now()
+	verifier, err := NewJWKSVerifier(svr.URL, WithJWKSRefreshInterval(time.Hour, time.Minute))
+	if err != nil {
+		t.Fatalf("NewJWKSVerifier fatal err: %v", err)
+	}
+	verifier.now = func() time.Time { return now }
+
+	claims := jwt.MapClaims{"exp": now.Add(time.Hour).Unix()}
+	oldJWT := signJWT(t, jwt.SigningMethodRS256, "old", oldKey, claims)
+	newJWT := signJWT(t, jwt.SigningMethodRS256, "new", newKey, claims)
+
+	if _, errs := verifier.Verify([]string{oldJWT}, nil); len(errs) > 0 {
+		t.Errorf("FAIL: old key unexpected errs=%q", errs)
+	}
+
+	// Key rotated: unknown kid does not refetch within min refresh interval
+	jwks.Store(marshalJWKS(t, rsaJWK(t, "new", newKey)))
+	if _, errs := verifier.Verify([]string{newJWT}, nil); len(errs) == 0 || !errors.Is(errs[0], ErrJWKSKeyNotFound) {
+		t.Errorf("FAIL: expected ErrJWKSKeyNotFound, got errs=%q", errs)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("FAIL: got %d JWKS fetches, wanted 1", n)
+	}
+
+	// ... but does after it
+	now = now.Add(2 * time.Minute)
+	if _, errs := verifier.Verify([]string{newJWT}, nil); len(errs) > 0 {
+		t.Errorf("FAIL: new key unexpected errs=%q", errs)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("FAIL: got %d JWKS fetches, wanted 2", n)
+	}
+
+	// Cached keys are used if the JWKS endpoint fails after refresh interval
+	jwks.Store([]byte(`not json`))
+	now = now.Add(2 * time.Hour)
+	claims = jwt.MapClaims{"exp": now.Add(time.Hour).Unix()}
+	newJWT = signJWT(t, jwt.SigningMethodRS256, "new", newKey, claims)
+	if _, errs := verifier.Verify([]string{newJWT}, nil); len(errs) > 0 {
+		t.Errorf("FAIL: cached key unexpected errs=%q", errs)
+	}
+}
+
+func TestJWKSVerifierSlowRefresh(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey fatal err: %v", err)
+	}
+	jwks := marshalJWKS(t, rsaJWK(t, "kid1", key))
+
+	// The JWKS endpoint blocks after the initial fetch, until released
+	release := make(chan struct{})
+	var fetches int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		w.Write(jwks)
+	}))
+	defer svr.Close()
+	defer close(release)
+
+	now := time.Now()
+	verifier, err := NewJWKSVerifier(svr.URL, WithJWKSRefreshInterval(time.Hour, time.Minute))
+	if err != nil {
+		t.Fatalf("NewJWKSVerifier fatal err: %v", err)
+	}
+	verifier.now = func() time.Time { return now.Add(2 * time.Hour) }
+
+	claims := jwt.MapClaims{"exp": now.Add(3 * time.Hour).Unix()}
+	knownJWT := signJWT(t, jwt.SigningMethodRS256, "kid1", key, claims)
+	unknownJWT := signJWT(t, jwt.SigningMethodRS256, "kid2", key, claims)
+
+	// Known keys are verified while the periodic refresh is blocked
+	for i := 0; i < 10; i++ {
+		if _, errs := verifier.Verify([]string{knownJWT}, nil); len(errs) > 0 {
+			t.Errorf("FAIL: known key unexpected errs=%q", errs)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&fetches) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("FAIL: got %d JWKS fetches, wanted 2", n)
+	}
+
+	// Unknown key ids wait for the refresh in progress, instead of fetching again
+	done := make(chan []error)
+	go func() {
+		_, errs := verifier.Verify([]string{unknownJWT}, nil)
+		done <- errs
+	}()
+	select {
+	case <-done:
+		t.Errorf("FAIL: unknown key did not wait for refresh")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	if errs := <-done; len(errs) == 0 || !errors.Is(errs[0], ErrJWKSKeyNotFound) {
+		t.Errorf("FAIL: expected ErrJWKSKeyNotFound, got errs=%q", errs)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("FAIL: got %d JWKS fetches, wanted 2", n)
+	}
+}
+
+func TestNewJWKSVerifierInvalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		jwks string
+	}{
+		{name: "not json", jwks: `not json`},
+		{name: "no keys", jwks: `{"keys": []}`},
+		{name: "only encryption keys", jwks: `{"keys": [{"kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`},
+		{name: "invalid EC point", jwks: `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+			if err := ioutil.WriteFile(jwksFile, []byte(tt.jwks), 0600); err != nil {
+				t.Fatalf("WriteFile fatal err: %v", err)
+			}
+
+			_, err := NewJWKSVerifier(jwksFile)
+			if !errors.Is(err, ErrInvalidJWKS) {
+				t.Errorf("FAIL: got err=%v wanted %v", err, ErrInvalidJWKS)
+			}
+		})
+	}
+
+	if _, err := NewJWKSVerifier(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, ErrInvalidJWKS) {
+		t.Errorf("FAIL: got err=%v wanted %v", err, ErrInvalidJWKS)
+	}
+}
@@ -0,0 +1,226 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	atlas_claims "github.com/infobloxopen/atlas-claims"
+)
+
+const (
+	lookupMemoKey = key("grpc-authz-lookup-memo-key")
+
+	// DefaultLookupCacheMaxEntries is the default max number of entries of the lookup cache
+	DefaultLookupCacheMaxEntries = 10000
+)
+
+// lookupMemo memoizes the verified JWT and the lookups
+// (eg: GetCurrentUserCompartments) of a single request
+type lookupMemo struct {
+	mu      sync.Mutex
+	jwts    map[string]string
+	results map[string]interface{}
+}
+
+// ContextWithLookupMemo returns a new context memoizing the JWT verification and the results of
+// GetCurrentUserCompartments, FilterCompartmentPermissions and FilterCompartmentFeatures,
+// so that repeated lookups with the context do not query OPA again.
+// The unary interceptor adds it to the context of the grpc handler.
+// The context should not outlive a single request (nor the JWT),
+// so the stream interceptor does not add it.
+func ContextWithLookupMemo(ctx context.Context) context.Context {
+	if lookupMemoFromContext(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, lookupMemoKey, &lookupMemo{
+		jwts:    map[string]string{},
+		results: map[string]interface{}{},
+	})
+}
+
+func lookupMemoFromContext(ctx context.Context) *lookupMemo {
+	if ctx == nil {
+		return nil
+	}
+	memo, _ := ctx.Value(lookupMemoKey).(*lookupMemo)
+	return memo
+}
+
+func (m *lookupMemo) get(memoKey string) (interface{}, bool) {
+	if m == nil {
+		return nil, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	val, ok := m.results[memoKey]
+	return val, ok
+}
+
+func (m *lookupMemo) set(memoKey string, val interface{}) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[memoKey] = val
+}
+
+// lookupCache caches lookups across requests, by JWT identity (see WithLookupCache)
+type lookupCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]lookupCacheEntry
+	now        func() time.Time
+}
+
+type lookupCacheEntry struct {
+	val       interface{}
+	expiresAt time.Time
+}
+
+func newLookupCache(ttl time.Duration, maxEntries int) *lookupCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultLookupCacheMaxEntries
+	}
+	return &lookupCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]lookupCacheEntry{},
+		now:        time.Now,
+	}
+}
+
+func (c *lookupCache) get(cacheKey string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKey]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, cacheKey)
+		return nil, false
+	}
+	return entry.val, true
+}
+
+// set caches val for the TTL, bounded by the JWT expiry (if not zero)
+func (c *lookupCache) set(cacheKey string, val interface{}, jwtExpiry time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	expiresAt := now.Add(c.ttl)
+	if !jwtExpiry.IsZero() && jwtExpiry.Before(expiresAt) {
+		expiresAt = jwtExpiry
+	}
+	if !now.Before(expiresAt) {
+		return
+	}
+
+	if _, ok := c.entries[cacheKey]; !ok && len(c.entries) >= c.maxEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full: evict any entry
+		for k := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[cacheKey] = lookupCacheEntry{val: val, expiresAt: expiresAt}
+}
+
+// lookupJWT returns the verified raw JWT (see verifyClaims),
+// memoized by the bearers of the request if the context has a lookup memo
+func (a *DefaultAuthorizer) lookupJWT(ctx context.Context) (string, error) {
+	memo := lookupMemoFromContext(ctx)
+	if memo == nil {
+		return a.verifyClaims(ctx)
+	}
+
+	bearer, newBearer := atlas_claims.AuthBearersFromCtx(ctx)
+	bearersKey := bearer + "\x00" + newBearer
+
+	memo.mu.Lock()
+	rawJWT, ok := memo.jwts[bearersKey]
+	memo.mu.Unlock()
+	if ok {
+		return rawJWT, nil
+	}
+
+	rawJWT, err := a.verifyClaims(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	memo.mu.Lock()
+	memo.jwts[bearersKey] = rawJWT
+	memo.mu.Unlock()
+	return rawJWT, nil
+}
+
+// lookup returns the result of the lookup of OPA api with input for rawJWT,
+// from the request lookup memo or the lookup cache if any, otherwise from queryFn.
+// Only successful results are memoized and cached.
+// The result is shared, and must not be modified.
+func (a *DefaultAuthorizer) lookup(ctx context.Context, rawJWT, api string, input interface{}, queryFn func() (interface{}, error)) (interface{}, error) {
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	jwtSum := sha256.Sum256([]byte(rawJWT))
+	lookupKey := hex.EncodeToString(jwtSum[:]) + "\x00" + api + "\x00" + string(inputJSON)
+
+	memo := lookupMemoFromContext(ctx)
+	if val, ok := memo.get(lookupKey); ok {
+		return val, nil
+	}
+	if val, ok := a.lookupCache.get(lookupKey); ok {
+		memo.set(lookupKey, val)
+		return val, nil
+	}
+
+	val, err := queryFn()
+	if err != nil {
+		return nil, err
+	}
+
+	memo.set(lookupKey, val)
+	a.lookupCache.set(lookupKey, val, jwtExpiry(rawJWT))
+	return val, nil
+}
+
+// jwtExpiry returns the expiry of the raw JWT, or zero time if none
+func jwtExpiry(rawJWT string) time.Time {
+	claims := parseVerifiedClaims(rawJWT)
+	if claims == nil || claims.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+// copyStrings returns a copy of strs, preserving nil
+func copyStrings(strs []string) []string {
+	if strs == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(strs)), strs...)
+}
@@ -0,0 +1,269 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+	atlas_claims "github.com/infobloxopen/atlas-claims"
+)
+
+// countingOpaClienter counts the CustomQuery calls of the MockOpaClienter
+type countingOpaClienter struct {
+	utils_test.MockOpaClienter
+	calls int32
+}
+
+func (m *countingOpaClienter) CustomQuery(ctx context.Context, document string, reqData, resp interface{}) error {
+	atomic.AddInt32(&m.calls, 1)
+	return m.MockOpaClienter.CustomQuery(ctx, document, reqData, resp)
+}
+
+func TestLookupMemoAndCache(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	jwt40, err := atlas_claims.BuildJwt(&atlas_claims.Claims{AccountId: "40"}, "some-hmac-key-we-dont-care", time.Hour*9)
+	if err != nil {
+		t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+	}
+	jwt41, err := atlas_claims.BuildJwt(&atlas_claims.Claims{AccountId: "41"}, "some-hmac-key-we-dont-care", time.Hour*9)
+	if err != nil {
+		t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		opts     []Option
+		memo     bool
+		jwts     []string
+		expCalls int32
+	}{
+		{
+			name:     "no memo, no cache",
+			jwts:     []string{jwt40, jwt40},
+			expCalls: 2,
+		},
+		{
+			name:     "memo",
+			memo:     true,
+			jwts:     []string{jwt40, jwt40},
+			expCalls: 1,
+		},
+		{
+			name:     "memo, different JWTs",
+			memo:     true,
+			jwts:     []string{jwt40, jwt41},
+			expCalls: 2,
+		},
+		{
+			name:     "cache",
+			opts:     []Option{WithLookupCache(time.Minute, 0)},
+			jwts:     []string{jwt40, jwt40, jwt40},
+			expCalls: 1,
+		},
+		{
+			name:     "cache, different JWTs",
+			opts:     []Option{WithLookupCache(time.Minute, 0)},
+			jwts:     []string{jwt40, jwt41, jwt40, jwt41},
+			expCalls: 2,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			clienter := &countingOpaClienter{
+				MockOpaClienter: utils_test.MockOpaClienter{
+					Loggr:        stdLoggr,
+					RegoRespJSON: `{ "result": [ "red.", "green." ] }`,
+				},
+			}
+			auther := NewDefaultAuthorizer("bogus_unused_application_value",
+				append([]Option{WithOpaClienter(clienter)}, tt.opts...)...,
+			)
+
+			memoCtx := ctx
+			if tt.memo {
+				memoCtx = ContextWithLookupMemo(ctx)
+			}
+
+			for _, jwt := range tt.jwts {
+				gotVal, err := auther.GetCurrentUserCompartments(utils_test.ContextWithJWT(memoCtx, jwt))
+				if err != nil {
+					t.Fatalf("FAIL: GetCurrentUserCompartments() unexpected err=%v", err)
+				}
+				if !reflect.DeepEqual(gotVal, []string{"red.", "green."}) {
+					t.Errorf("FAIL: GetCurrentUserCompartments() got %#v", gotVal)
+				}
+
+				// Modifying the result must not modify the memoized/cached result
+				gotVal[0] = "modified."
+			}
+
+			if clienter.calls != tt.expCalls {
+				t.Errorf("FAIL: got %d OPA queries expected %d", clienter.calls, tt.expCalls)
+			}
+		})
+	}
+}
+
+func TestLookupMemoInput(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	jwt, err := atlas_claims.BuildJwt(&atlas_claims.Claims{AccountId: "40"}, "some-hmac-key-we-dont-care", time.Hour*9)
+	if err != nil {
+		t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+	}
+
+	clienter := &countingOpaClienter{
+		MockOpaClienter: utils_test.MockOpaClienter{
+			Loggr:        stdLoggr,
+			RegoRespJSON: `{ "result": [ "ipam.view" ] }`,
+		},
+	}
+	auther := NewDefaultAuthorizer("bogus_unused_application_value",
+		WithOpaClienter(clienter),
+	)
+	ctx = ContextWithLookupMemo(utils_test.ContextWithJWT(ctx, jwt))
+
+	for _, perms := range []FilterCompartmentPermissionsType{
+		{"ipam.view"},
+		{"ipam.view", "ipam.update"},
+		{"ipam.view"},
+	} {
+		if _, err := auther.FilterCompartmentPermissions(ctx, perms); err != nil {
+			t.Fatalf("FAIL: FilterCompartmentPermissions() unexpected err=%v", err)
+		}
+	}
+	if _, err := auther.GetCurrentUserCompartments(ctx); err != nil {
+		t.Fatalf("FAIL: GetCurrentUserCompartments() unexpected err=%v", err)
+	}
+
+	if clienter.calls != 3 {
+		t.Errorf("FAIL: got %d OPA queries expected 3", clienter.calls)
+	}
+}
+
+func TestLookupCacheExpiry(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	cache := newLookupCache(time.Minute, 2)
+	cache.now = func() time.Time { return now }
+
+	testCases := []struct {
+		name      string
+		key       string
+		jwtExpiry time.Time
+		elapsed   time.Duration
+		expOk     bool
+	}{
+		{
+			name:    "within ttl",
+			key:     "a",
+			elapsed: time.Second * 59,
+			expOk:   true,
+		},
+		{
+			name:    "ttl expired",
+			key:     "b",
+			elapsed: time.Minute,
+		},
+		{
+			name:      "within jwt expiry",
+			key:       "c",
+			jwtExpiry: now.Add(time.Second * 10),
+			elapsed:   time.Second * 9,
+			expOk:     true,
+		},
+		{
+			name:      "jwt expired before ttl",
+			key:       "d",
+			jwtExpiry: now.Add(time.Second * 10),
+			elapsed:   time.Second * 10,
+		},
+		{
+			name:      "jwt already expired",
+			key:       "e",
+			jwtExpiry: now.Add(-time.Second),
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			start := now
+			defer func() { now = start }()
+
+			cache.set(tt.key, tt.key, tt.jwtExpiry)
+			now = now.Add(tt.elapsed)
+
+			gotVal, gotOk := cache.get(tt.key)
+			if gotOk != tt.expOk {
+				t.Fatalf("FAIL: get() ok=%v expected %v", gotOk, tt.expOk)
+			}
+			if gotOk && gotVal != tt.key {
+				t.Errorf("FAIL: get() got %v expected %v", gotVal, tt.key)
+			}
+		})
+	}
+
+	cache.set("x", "x", time.Time{})
+	cache.set("y", "y", time.Time{})
+	cache.set("z", "z", time.Time{})
+	if len(cache.entries) != 2 {
+		t.Errorf("FAIL: got %d entries expected max 2", len(cache.entries))
+	}
+	if _, ok := cache.get("z"); !ok {
+		t.Errorf("FAIL: last set entry evicted")
+	}
+}
+
+func TestLookupMemoInterceptors(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	opts := []Option{
+		WithOpaClienter(utils_test.MockOpaClienter{
+			Loggr:        stdLoggr,
+			RegoRespJSON: `{"allow": true}`,
+		}),
+		WithClaimsVerifier(NullClaimsVerifier),
+	}
+
+	var unaryMemo *lookupMemo
+	unaryHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		unaryMemo = lookupMemoFromContext(ctx)
+		return nil, nil
+	}
+	_, err := UnaryServerInterceptor("app", opts...)(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "FakeMethod"}, unaryHandler)
+	if err != nil {
+		t.Fatalf("FAIL: unary interceptor unexpected err=%v", err)
+	}
+	if unaryMemo == nil {
+		t.Errorf("FAIL: unary handler context has no lookup memo")
+	}
+
+	// Streams may outlive the JWT, so lookups are not memoized
+	var streamMemo *lookupMemo
+	streamHandler := func(srv interface{}, stream grpc.ServerStream) error {
+		streamMemo = lookupMemoFromContext(stream.Context())
+		return nil
+	}
+	err = StreamServerInterceptor("app", opts...)(nil, &WrappedSrvStream{WrappedCtx: ctx},
+		&grpc.StreamServerInfo{FullMethod: "FakeMethod"}, streamHandler)
+	if err != nil {
+		t.Fatalf("FAIL: stream interceptor unexpected err=%v", err)
+	}
+	if streamMemo != nil {
+		t.Errorf("FAIL: stream handler context has lookup memo")
+	}
+}
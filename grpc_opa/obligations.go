@@ -6,12 +6,13 @@ import (
 	"strings"
 
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
 )
 
 var (
 	// ErrInvalidObligations is returned upon invalid obligations
-	ErrInvalidObligations = status.Errorf(codes.Internal, "Invalid obligations")
+	ErrInvalidObligations = opa_client.NewError(codes.Internal, "Invalid obligations")
 )
 
 // ObligationsEnum enumerates the different kinds of ObligationsNode
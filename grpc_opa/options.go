@@ -2,6 +2,7 @@ package grpc_opa_middleware
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
 )
@@ -34,6 +35,19 @@ func WithOpaClienter(clienter opa_client.Clienter) Option {
 	}
 }
 
+// WithOpaClientOptions supplies additional opa_client.Option (eg: opa_client.WithHeaderPolicy)
+// used when creating the default Clienter.
+// This option is ignored if WithOpaClienter is specified.
+func WithOpaClientOptions(opts ...opa_client.Option) Option {
+	return func(c *Config) {
+		c.clientOpts = append(c.clientOpts, opts...)
+	}
+}
+
+func (c *Config) opaClientOptions() []opa_client.Option {
+	return append([]opa_client.Option{opa_client.WithHTTPClient(c.httpCli)}, c.clientOpts...)
+}
+
 // WithOpaEvaluator overrides the OpaEvaluator use to
 // evaluate authorization against OPA.
 func WithOpaEvaluator(opaEvaluator OpaEvaluator) Option {
@@ -66,6 +80,34 @@ func WithClaimsVerifier(claimsVerifier ClaimsVerifier) Option {
 	}
 }
 
+// WithPrincipalExtractor supplies a PrincipalExtractor to obtain the caller
+// identity (eg: TLSPeerPrincipal for services authenticated by mTLS),
+// which is added to the OPA input Payload "caller".
+// Requests without JWT are then permitted to be authorized by policy
+// if they have a caller Principal.
+func WithPrincipalExtractor(extractor PrincipalExtractor) Option {
+	return func(c *Config) {
+		c.principalExtractor = extractor
+	}
+}
+
+// WithCompartmentExtractor supplies a CompartmentExtractor to obtain the compartment
+// targeted by the grpc request (eg: CompartmentFromMetadata(DefaultCompartmentHeader)),
+// which is added to the OPA input Payload "compartment_id".
+func WithCompartmentExtractor(extractor CompartmentExtractor) Option {
+	return func(c *Config) {
+		c.compartmentExtractor = extractor
+	}
+}
+
+// WithPayloadClaims adds the named JWT claims (eg: "account_id", "subject")
+// to the OPA input Payload "claims", so policies need not decode the JWT
+func WithPayloadClaims(claimNames ...string) Option {
+	return func(c *Config) {
+		c.payloadClaims = claimNames
+	}
+}
+
 // WithEntitledServices overrides default EntitledServices
 func WithEntitledServices(entitledServices ...string) Option {
 	return func(c *Config) {
@@ -93,3 +135,99 @@ func WithFilterComparmentFeaturesApiPath(filterCompartmentFeatsApi string) Optio
 		c.filterCompartmentFeatsApi = filterCompartmentFeatsApi
 	}
 }
+
+// WithEffectivePermissionsApiPath overrides default EffectivePermissionsApiPath
+func WithEffectivePermissionsApiPath(effectivePermsApi string) Option {
+	return func(c *Config) {
+		c.effectivePermsApi = effectivePermsApi
+	}
+}
+
+// WithPartialEvalQuery overrides default PartialEvalQuery
+func WithPartialEvalQuery(partialEvalQuery string) Option {
+	return func(c *Config) {
+		c.partialEvalQuery = partialEvalQuery
+	}
+}
+
+// WithDecisionIDTrailer returns the OPA decision_id (if any) to gRPC callers
+// in the specified response trailer key (DefaultDecisionIDTrailer if empty).
+// OPA only returns decision_id if OPA decision logging is enabled.
+func WithDecisionIDTrailer(key string) Option {
+	return func(c *Config) {
+		if len(key) == 0 {
+			key = DefaultDecisionIDTrailer
+		}
+		c.decisionIDTrailerKey = key
+	}
+}
+
+// WithRequestCoalescing coalesces identical concurrent OPA authorization queries
+// (same decision document and input, ignoring request_id, and same opa_client.QueryOptions
+// and forwarded metadata, see opa_client.CoalesceKey) into a single request to OPA,
+// sharing the response among all waiters.
+// Per-request correlation and trace metadata (see opa_client.CoalesceIgnoredHeaders)
+// is ignored, so queries of different RPCs are coalesced too.
+// Each waiter still returns early if its own context is canceled.
+// Not applicable if WithOpaEvaluator is specified.
+func WithRequestCoalescing() Option {
+	return func(c *Config) {
+		c.coalesceRequests = true
+	}
+}
+
+// WithLookupCache caches the results of GetCurrentUserCompartments,
+// FilterCompartmentPermissions and FilterCompartmentFeatures across requests,
+// by JWT identity, for ttl bounded by the JWT expiry.
+// At most maxEntries results are cached (DefaultLookupCacheMaxEntries if <= 0).
+// Within a request, results are memoized regardless (see ContextWithLookupMemo).
+func WithLookupCache(ttl time.Duration, maxEntries int) Option {
+	return func(c *Config) {
+		c.lookupCacheTTL = ttl
+		c.lookupCacheMaxEntries = maxEntries
+	}
+}
+
+// WithDenyReasonFilter overrides the default UserVisibleDenyReasons filter,
+// which selects the policy deny reasons returned to gRPC callers as error details.
+// All deny reasons are still logged and available in the AuthzResult.
+func WithDenyReasonFilter(filter DenyReasonFilter) Option {
+	return func(c *Config) {
+		c.denyReasonFilter = filter
+	}
+}
+
+// WithResponseValidation makes Evaluate fail with ErrInvalidOPAResponse
+// (or opa_client.ErrUndefined) if the OPA response fails the specified validation checks
+// (eg: StrictValidation), instead of silently denying or dropping malformed obligations.
+// extraKeys are keys, other than the known decision keys, allowed by RejectUnknownKeys.
+func WithResponseValidation(validation ResponseValidation, extraKeys ...string) Option {
+	return func(c *Config) {
+		c.responseValidation = validation
+		c.responseExtraKeys = extraKeys
+	}
+}
+
+// WithResultMapping specifies where Evaluate finds the allow flag, obligations,
+// entitled features and deny reasons in non-standard OPA responses.
+func WithResultMapping(mapping ResultMapping) Option {
+	return func(c *Config) {
+		c.resultMapping = &mapping
+	}
+}
+
+// WithBatchDecisionDocument overrides default DefaultBatchValidatePath used by BatchEvaluate.
+// If empty, BatchEvaluate always evaluates each input individually.
+func WithBatchDecisionDocument(batchDecisionDocument string) Option {
+	return func(c *Config) {
+		c.batchDecisionDocument = batchDecisionDocument
+	}
+}
+
+// WithBatchConcurrency overrides default DefaultBatchConcurrency,
+// the maximum concurrent evaluations when BatchEvaluate evaluates each input individually.
+func WithBatchConcurrency(concurrency int) Option {
+	return func(c *Config) {
+		c.batchConcurrency = concurrency
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/infobloxopen/atlas-app-toolkit/requestid"
 	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
 	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
 )
@@ -122,3 +126,60 @@ func (m optionsMockOpaClienter) CustomQuery(ctx context.Context, document string
 	}
 	return json.Unmarshal([]byte(`{"allow": true}`), resp)
 }
+
+type coalescingMockOpaClienter struct {
+	optionsMockOpaClienter
+	hits    int32
+	release chan struct{}
+}
+
+func (m *coalescingMockOpaClienter) CustomQueryBytes(ctx context.Context, document string, reqData interface{}) ([]byte, error) {
+	atomic.AddInt32(&m.hits, 1)
+	<-m.release
+	return []byte(`{"allow": true}`), nil
+}
+
+func Test_WithRequestCoalescing(t *testing.T) {
+	mockOpaClienter := &coalescingMockOpaClienter{release: make(chan struct{})}
+
+	auther := NewDefaultAuthorizer("app",
+		WithOpaClienter(mockOpaClienter),
+		WithClaimsVerifier(NullClaimsVerifier),
+		WithRequestCoalescing(),
+	)
+
+	const waiters = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// request_id differs per request, but is ignored for coalescing
+			ctx := requestid.NewContext(context.Background(), fmt.Sprintf("request-%d", i))
+			// QueryOptions change the response, so are not coalesced with other requests
+			if i%2 == 1 {
+				ctx = opa_client.ContextWithQueryOptions(ctx, opa_client.QueryOptions{Metrics: true})
+			}
+			_, err := auther.AffirmAuthorization(ctx, "FakeMethod", nil)
+			errs <- err
+		}(i)
+	}
+
+	// Release the responses once all waiters joined the in-flight requests
+	for auther.coalescer.Waiters() < waiters {
+		time.Sleep(time.Millisecond)
+	}
+	close(mockOpaClienter.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected err: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&mockOpaClienter.hits); n != 2 {
+		t.Errorf("got %d OPA requests, wanted 2", n)
+	}
+}
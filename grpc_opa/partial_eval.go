@@ -0,0 +1,290 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"github.com/open-policy-agent/opa/ast"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+const (
+	// DefaultPartialEvalQuery is default OPA query partially evaluated by PartialEvaluate
+	DefaultPartialEvalQuery = "data.authz.rbac.validate_v1.allow == true"
+
+	// DefaultPartialEvalUnknown is default unknown used by PartialEvaluate
+	DefaultPartialEvalUnknown = "input.resource"
+
+	// sealCtxPrefix is the SEAL identifier prefix that unknown references are rewritten to
+	sealCtxPrefix = "ctx"
+)
+
+var (
+	// ErrCompileUnsupported is returned when the Clienter does not implement opa_client.Compiler
+	ErrCompileUnsupported = status.Errorf(codes.Unimplemented, "OPA Compile API not supported by clienter")
+
+	// ErrUnsupportedResidual is returned when a residual query cannot be converted to obligations
+	ErrUnsupportedResidual = status.Errorf(codes.Internal, "Unsupported residual query")
+)
+
+// sealOperators maps OPA comparison builtins to SEAL operators
+var sealOperators = map[string]string{
+	ast.Equality.Name:      "==",
+	ast.Equal.Name:         "==",
+	ast.NotEqual.Name:      "!=",
+	ast.LessThan.Name:      "<",
+	ast.LessThanEq.Name:    "<=",
+	ast.GreaterThan.Name:   ">",
+	ast.GreaterThanEq.Name: ">=",
+}
+
+// sealMirroredOperators maps SEAL operators to their mirrored operator
+// when the unknown reference is on the right-hand-side
+var sealMirroredOperators = map[string]string{
+	"==": "==",
+	"!=": "!=",
+	"<":  ">",
+	"<=": ">=",
+	">":  "<",
+	">=": "<=",
+}
+
+// PartialEvaluate partially evaluates the authorization query (see WithPartialEvalQuery)
+// using the same input as Evaluate, treating the specified unknowns as unknown.
+// If no unknowns are specified, DefaultPartialEvalUnknown is used.
+//
+// The residual queries returned by OPA are converted into an ObligationsNode
+// which is added to the returned context, exactly as Evaluate does for obligations,
+// so it can be compiled into an SQL filter with ToSQLPredicate.
+// References under the unknowns are rewritten as SEAL "ctx." identifiers,
+// eg: "input.resource.owner" becomes "ctx.owner",
+// and "input.resource.tags.dc" becomes `ctx.tags["dc"]`.
+// If DecisionInput.Type is non-empty, conditions are annotated with it as SEAL type.
+//
+// Returns false with ErrForbidden if the query can never be true.
+// Returns true without obligations if the query is unconditionally true.
+func (a *DefaultAuthorizer) PartialEvaluate(ctx context.Context, fullMethod string, grpcReq interface{}, unknowns ...string) (bool, context.Context, error) {
+	logger := ctxlogrus.Extract(ctx).WithFields(log.Fields{
+		"application": a.application,
+	})
+
+	compiler, ok := a.clienter.(opa_client.Compiler)
+	if !ok {
+		return false, ctx, ErrCompileUnsupported
+	}
+
+	if len(unknowns) == 0 {
+		unknowns = []string{DefaultPartialEvalUnknown}
+	}
+
+	opaReq, err := a.newPayload(ctx, fullMethod, grpcReq)
+	if err != nil {
+		return false, ctx, err
+	}
+
+	if opaReq.claims != nil {
+		ctx = ContextWithClaims(ctx, opaReq.claims)
+	}
+
+	compileReq := opa_client.CompileRequest{
+		Query:    a.partialEvalQuery,
+		Input:    opaReq,
+		Unknowns: unknowns,
+	}
+
+	logger.WithFields(log.Fields{
+		"query":    compileReq.Query,
+		"unknowns": unknowns,
+		"opaReq":   shortenPayloadForDebug(opaReq),
+	}).Debug("opa_partial_eval_request")
+
+	result, err := compiler.Compile(ctx, &compileReq)
+	if err != nil {
+		logger.WithError(err).Error("opa_partial_eval_request_error")
+		return false, ctx, opaqueError(err)
+	}
+
+	ob, err := ResidualToObligations(result, unknowns, opaReq.Type)
+	if err != nil {
+		logger.WithField("queries", fmt.Sprintf("%v", result.Queries)).WithError(err).Error("parse_residual_error")
+		return false, ctx, err
+	}
+
+	if ob == nil {
+		return false, ctx, ErrForbidden
+	}
+
+	if !ob.IsShallowEmpty() {
+		ctx = context.WithValue(ctx, ObKey, ob)
+	}
+
+	return true, ctx, nil
+}
+
+// ResidualToObligations converts the residual queries of a partial evaluation
+// into an ObligationsNode: an OR of the residual queries,
+// each an AND of the SEAL conditions of its expressions.
+// Returns nil node if there are no residual queries (query can never be true).
+// Returns an empty node if any residual query is empty (query is unconditionally true).
+// sealType, if non-empty, is added to each condition as SEAL type annotation.
+func ResidualToObligations(result *opa_client.CompileResult, unknowns []string, sealType string) (*ObligationsNode, error) {
+	if result == nil || len(result.Queries) == 0 {
+		return nil, nil
+	}
+
+	unknownRefs := make([]ast.Ref, 0, len(unknowns))
+	for _, unk := range unknowns {
+		ref, err := ast.ParseRef(unk)
+		if err != nil {
+			return nil, err
+		}
+		unknownRefs = append(unknownRefs, ref)
+	}
+
+	rootNode := &ObligationsNode{
+		Kind: ObligationsOr,
+	}
+
+	for _, query := range result.Queries {
+		if len(query) == 0 {
+			return &ObligationsNode{Kind: ObligationsEmpty}, nil
+		}
+
+		queryNode := &ObligationsNode{
+			Kind:     ObligationsAnd,
+			Children: make([]*ObligationsNode, 0, len(query)),
+		}
+
+		for _, expr := range query {
+			cond, err := exprToSEALCondition(expr, unknownRefs)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(sealType) > 0 {
+				cond = "type:" + sealType + "; " + cond
+			}
+
+			queryNode.Children = append(queryNode.Children, &ObligationsNode{
+				Kind:      ObligationsCondition,
+				Condition: cond,
+			})
+		}
+
+		rootNode.Children = append(rootNode.Children, queryNode)
+	}
+
+	return rootNode, nil
+}
+
+// exprToSEALCondition converts a single residual expression into a SEAL condition string
+func exprToSEALCondition(expr *ast.Expr, unknownRefs []ast.Ref) (string, error) {
+	if !expr.IsCall() || len(expr.With) > 0 {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedResidual, expr)
+	}
+
+	operands := expr.Operands()
+	if len(operands) != 2 {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedResidual, expr)
+	}
+
+	opName := expr.Operator().String()
+
+	var cond string
+	if opName == ast.RegexMatch.Name {
+		// regex.match(pattern, value)
+		lhs, lhsIsRef, err := termToSEAL(operands[1], unknownRefs)
+		if err != nil {
+			return "", err
+		}
+		rhs, rhsIsRef, err := termToSEAL(operands[0], unknownRefs)
+		if err != nil {
+			return "", err
+		}
+		if !lhsIsRef || rhsIsRef {
+			return "", fmt.Errorf("%w: %s", ErrUnsupportedResidual, expr)
+		}
+		cond = lhs + " =~ " + rhs
+	} else {
+		sealOp, ok := sealOperators[opName]
+		if !ok {
+			return "", fmt.Errorf("%w: %s", ErrUnsupportedResidual, expr)
+		}
+
+		lhs, lhsIsRef, err := termToSEAL(operands[0], unknownRefs)
+		if err != nil {
+			return "", err
+		}
+		rhs, rhsIsRef, err := termToSEAL(operands[1], unknownRefs)
+		if err != nil {
+			return "", err
+		}
+		if lhsIsRef == rhsIsRef {
+			return "", fmt.Errorf("%w: %s", ErrUnsupportedResidual, expr)
+		}
+
+		// SEAL expects identifier on the left-hand-side
+		if rhsIsRef {
+			lhs, rhs = rhs, lhs
+			sealOp = sealMirroredOperators[sealOp]
+		}
+		cond = lhs + " " + sealOp + " " + rhs
+	}
+
+	if expr.Negated {
+		cond = "not " + cond
+	}
+
+	return cond, nil
+}
+
+// termToSEAL converts a residual term into a SEAL identifier or literal (string or integer).
+// SEAL has no boolean or null literals, these terms fail with ErrUnsupportedResidual.
+// Returns whether the term is an identifier (reference under one of the unknowns).
+func termToSEAL(term *ast.Term, unknownRefs []ast.Ref) (string, bool, error) {
+	switch v := term.Value.(type) {
+	case ast.String:
+		return fmt.Sprintf("%q", string(v)), false, nil
+	case ast.Number:
+		if _, ok := v.Int64(); !ok {
+			return "", false, fmt.Errorf("%w: non-integer number %s", ErrUnsupportedResidual, v)
+		}
+		return v.String(), false, nil
+	case ast.Boolean, ast.Null:
+		return "", false, fmt.Errorf("%w: %s literal %s", ErrUnsupportedResidual, ast.TypeName(v), v)
+	case ast.Ref:
+		for _, unkRef := range unknownRefs {
+			if !v.HasPrefix(unkRef) {
+				continue
+			}
+
+			// The first part is the SEAL property, eg: input.resource.tags => ctx.tags
+			// Further parts are SEAL indexes, eg: input.resource.tags.dc => ctx.tags["dc"]
+			var sb strings.Builder
+			sb.WriteString(sealCtxPrefix)
+			for i, part := range v[len(unkRef):] {
+				str, ok := part.Value.(ast.String)
+				if !ok {
+					return "", false, fmt.Errorf("%w: non-string reference %s", ErrUnsupportedResidual, v)
+				}
+				if i == 0 {
+					if !ast.IsVarCompatibleString(string(str)) {
+						return "", false, fmt.Errorf("%w: invalid property %s", ErrUnsupportedResidual, v)
+					}
+					sb.WriteString("." + string(str))
+				} else {
+					sb.WriteString(fmt.Sprintf("[%q]", string(str)))
+				}
+			}
+			return sb.String(), true, nil
+		}
+	}
+
+	return "", false, fmt.Errorf("%w: %s", ErrUnsupportedResidual, term)
+}
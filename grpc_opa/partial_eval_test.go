@@ -0,0 +1,235 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+	"github.com/infobloxopen/seal/pkg/compiler/sql"
+	"github.com/open-policy-agent/opa/ast"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+)
+
+func TestPartialEvaluateOpa(t *testing.T) {
+	stdLoggr := logrus.StandardLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(stdLoggr))
+
+	done := make(chan struct{})
+	clienter := utils_test.StartOpa(ctx, t, done)
+	cli, ok := clienter.(*opa_client.Client)
+	if !ok {
+		t.Fatal("Unable to convert interface to (*Client)")
+		return
+	}
+
+	// Errors above here will leak containers
+	defer func() {
+		cancel()
+		// Wait for container to be shutdown
+		<-done
+	}()
+
+	policyRego, err := ioutil.ReadFile("testdata/mock_partial_eval_policy.rego")
+	if err != nil {
+		t.Fatalf("ReadFile fatal err: %#v", err)
+		return
+	}
+
+	var resp interface{}
+	err = cli.UploadRegoPolicy(ctx, "mock_partial_eval_policyid", policyRego, resp)
+	if err != nil {
+		t.Fatalf("OpaUploadPolicy fatal err: %#v", err)
+		return
+	}
+
+	sqlc := sqlcompiler.NewSQLCompiler().WithDialect(sqlcompiler.DialectPostgres).
+		WithTypeMapper(sqlcompiler.NewTypeMapper("ddi.*").ToSQLTable("*").
+			WithPropertyMapper(sqlcompiler.NewPropertyMapper("tags").ToSQLColumn("tags").UseJSONBOperator(sqlcompiler.JSONBTextOperator)).
+			WithPropertyMapper(sqlcompiler.NewPropertyMapper("*").ToSQLColumn("*")))
+
+	testCases := []struct {
+		name   string
+		app    string
+		expOk  bool
+		expErr error
+		expOb  *ObligationsNode
+		expSQL string
+	}{
+		{
+			name:   "residual obligations",
+			app:    "partial-app",
+			expOk:  true,
+			expSQL: `((ipam.owner = 'bob') OR ((ipam.size > 10) AND (ipam.tags->>'datacenter' != 'dc-1')))`,
+			expOb: &ObligationsNode{
+				Kind: ObligationsOr,
+				Children: []*ObligationsNode{
+					{
+						Kind: ObligationsAnd,
+						Children: []*ObligationsNode{
+							{Kind: ObligationsCondition, Condition: `type:ddi.ipam; ctx.owner == "bob"`},
+						},
+					},
+					{
+						Kind: ObligationsAnd,
+						Children: []*ObligationsNode{
+							{Kind: ObligationsCondition, Condition: `type:ddi.ipam; ctx.size > 10`},
+							{Kind: ObligationsCondition, Condition: `type:ddi.ipam; ctx.tags["datacenter"] != "dc-1"`},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:  "unconditionally allowed",
+			app:   "unconditional-app",
+			expOk: true,
+			expOb: nil,
+		},
+		{
+			name:   "never allowed",
+			app:    "other-app",
+			expOk:  false,
+			expErr: ErrForbidden,
+			expOb:  nil,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			auther := NewDefaultAuthorizer(tt.app,
+				WithOpaClienter(cli),
+				WithClaimsVerifier(NullClaimsVerifier),
+				WithDecisionInputHandler(&MockDecisionInputr{DecisionInput{Type: "ddi.ipam"}}),
+				WithPartialEvalQuery("data.partial_eval.allow == true"),
+			)
+
+			gotOk, gotCtx, gotErr := auther.PartialEvaluate(ctx, "/service.Ipam/ListAddresses", nil)
+			if gotOk != tt.expOk || gotErr != tt.expErr {
+				t.Fatalf("FAIL: gotOk=%v gotErr=%v; expOk=%v expErr=%v", gotOk, gotErr, tt.expOk, tt.expErr)
+			}
+
+			gotOb, _ := gotCtx.Value(ObKey).(*ObligationsNode)
+			gotOb.DeepSort()
+			tt.expOb.DeepSort()
+			if !reflect.DeepEqual(gotOb, tt.expOb) {
+				t.Errorf("FAIL:\ngotOb: %s\nexpOb: %s", gotOb, tt.expOb)
+			}
+
+			if gotOb == nil {
+				return
+			}
+
+			gotSQL, err := gotOb.ToSQLPredicate(sqlc)
+			if err != nil {
+				t.Errorf("FAIL: ToSQLPredicate() unexpected err=%v", err)
+			}
+			if gotSQL != tt.expSQL {
+				t.Errorf("FAIL:\ngotSQL: %s\nexpSQL: %s", gotSQL, tt.expSQL)
+			}
+		})
+	}
+}
+
+func TestPartialEvaluateCompileUnsupported(t *testing.T) {
+	auther := NewDefaultAuthorizer("app",
+		WithOpaClienter(&MockOpaClienter{Loggr: logrus.StandardLogger()}),
+		WithClaimsVerifier(NullClaimsVerifier),
+	)
+
+	_, _, err := auther.PartialEvaluate(context.Background(), "FakeMethod", nil)
+	if err != ErrCompileUnsupported {
+		t.Errorf("FAIL: got err=%v; expected err=%v", err, ErrCompileUnsupported)
+	}
+}
+
+func TestResidualToObligationsTerms(t *testing.T) {
+	sqlc := sqlcompiler.NewSQLCompiler().WithDialect(sqlcompiler.DialectPostgres).
+		WithTypeMapper(sqlcompiler.NewTypeMapper("ddi.*").ToSQLTable("*").
+			WithPropertyMapper(sqlcompiler.NewPropertyMapper("*").ToSQLColumn("*")))
+
+	testCases := []struct {
+		name    string
+		query   string
+		expCond string
+		expSQL  string
+		expErr  error
+	}{
+		{
+			name:    "string",
+			query:   `input.resource.owner == "bob"`,
+			expCond: `type:ddi.ipam; ctx.owner == "bob"`,
+			expSQL:  `(ipam.owner = 'bob')`,
+		},
+		{
+			name:    "integer mirrored",
+			query:   `10 < input.resource.size`,
+			expCond: `type:ddi.ipam; ctx.size > 10`,
+			expSQL:  `(ipam.size > 10)`,
+		},
+		{
+			name:    "negated",
+			query:   `not input.resource.owner == "bob"`,
+			expCond: `type:ddi.ipam; not ctx.owner == "bob"`,
+			expSQL:  `(NOT (ipam.owner = 'bob'))`,
+		},
+		{
+			name:   "boolean",
+			query:  `input.resource.deleted == false`,
+			expErr: ErrUnsupportedResidual,
+		},
+		{
+			name:   "boolean mirrored",
+			query:  `true != input.resource.enabled`,
+			expErr: ErrUnsupportedResidual,
+		},
+		{
+			name:   "null",
+			query:  `input.resource.owner == null`,
+			expErr: ErrUnsupportedResidual,
+		},
+		{
+			name:   "non-integer number",
+			query:  `input.resource.size > 1.5`,
+			expErr: ErrUnsupportedResidual,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &opa_client.CompileResult{
+				Queries: []ast.Body{ast.MustParseBody(tt.query)},
+			}
+
+			gotNode, gotErr := ResidualToObligations(result, []string{"input.resource"}, "ddi.ipam")
+			if !errors.Is(gotErr, tt.expErr) {
+				t.Fatalf("FAIL: got err=%v; expected err=%v", gotErr, tt.expErr)
+			}
+			if tt.expErr != nil {
+				return
+			}
+
+			if len(gotNode.Children) != 1 || len(gotNode.Children[0].Children) != 1 {
+				t.Fatalf("FAIL: got obligations %s; expected a single condition", gotNode)
+			}
+			if gotCond := gotNode.Children[0].Children[0].Condition; gotCond != tt.expCond {
+				t.Errorf("FAIL: got condition %q; expected %q", gotCond, tt.expCond)
+			}
+
+			gotSQL, err := gotNode.ToSQLPredicate(sqlc)
+			if err != nil {
+				t.Errorf("FAIL: ToSQLPredicate() unexpected err=%v", err)
+			}
+			if gotSQL != tt.expSQL {
+				t.Errorf("FAIL:\ngotSQL: %s\nexpSQL: %s", gotSQL, tt.expSQL)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"crypto/x509"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+)
+
+const (
+	// PrincipalTypeService is the Principal type of services authenticated by mTLS
+	PrincipalTypeService = "service"
+
+	spiffeScheme = "spiffe"
+)
+
+var (
+	// ErrInvalidPrincipal is returned when the PrincipalExtractor fails
+	ErrInvalidPrincipal = opa_client.NewError(codes.Unauthenticated, "invalid caller principal")
+)
+
+// Principal is the identity of the caller authenticated by other means than the JWT
+// (eg: a service authenticated by mTLS).
+// It is added to the OPA input Payload as "caller".
+type Principal struct {
+	Type string `json:"type"`
+	// ID is the SPIFFE ID if present, otherwise the first DNS SAN, otherwise the subject CN
+	ID          string   `json:"id"`
+	SPIFFEID    string   `json:"spiffe_id,omitempty"`
+	TrustDomain string   `json:"trust_domain,omitempty"`
+	DNSNames    []string `json:"dns_names,omitempty"`
+}
+
+// PrincipalExtractor returns the caller Principal of the grpc request context,
+// or nil if there is none.
+type PrincipalExtractor func(ctx context.Context) (*Principal, error)
+
+// TLSPeerPrincipal is a PrincipalExtractor that returns the Principal of the
+// verified TLS client certificate of the grpc peer, or nil if the peer did not
+// present a verified client certificate (eg: server does not require mTLS).
+func TLSPeerPrincipal(ctx context.Context) (*Principal, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return nil, nil
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil, nil
+	}
+
+	// Only the leaf certificate of a verified chain is trusted
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, nil
+	}
+
+	return principalFromCertificate(chains[0][0]), nil
+}
+
+// principalFromCertificate returns the service Principal of the certificate SANs
+func principalFromCertificate(cert *x509.Certificate) *Principal {
+	principal := &Principal{
+		Type:     PrincipalTypeService,
+		DNSNames: cert.DNSNames,
+	}
+
+	for _, uri := range cert.URIs {
+		if uri.Scheme == spiffeScheme {
+			principal.SPIFFEID = uri.String()
+			principal.TrustDomain = uri.Host
+			break
+		}
+	}
+
+	switch {
+	case len(principal.SPIFFEID) > 0:
+		principal.ID = principal.SPIFFEID
+	case len(cert.DNSNames) > 0:
+		principal.ID = cert.DNSNames[0]
+	default:
+		principal.ID = cert.Subject.CommonName
+	}
+
+	return principal
+}
+
+// callerPrincipal returns the caller Principal using the principalExtractor, if any
+func (a *DefaultAuthorizer) callerPrincipal(ctx context.Context) (*Principal, error) {
+	if a.principalExtractor == nil {
+		return nil, nil
+	}
+
+	principal, err := a.principalExtractor(ctx)
+	if err != nil {
+		return nil, ErrInvalidPrincipal.Wrap(err)
+	}
+
+	return principal, nil
+}
@@ -0,0 +1,169 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+	atlas_claims "github.com/infobloxopen/atlas-claims"
+)
+
+func contextWithTLSPeer(ctx context.Context, cert *x509.Certificate, verified bool) context.Context {
+	state := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+	if verified {
+		state.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return peer.NewContext(ctx, &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: state},
+	})
+}
+
+func TestPrincipalExtractor(t *testing.T) {
+	spiffeCert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "svc-cn"},
+		DNSNames: []string{"svc.ns.svc.cluster.local"},
+		URIs:     []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/ns/default/sa/svc"}},
+	}
+	dnsCert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "svc-cn"},
+		DNSNames: []string{"svc.ns.svc.cluster.local"},
+	}
+	cnCert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "svc-cn"},
+	}
+
+	claims := &atlas_claims.Claims{AccountId: "40"}
+	jwt, err := atlas_claims.BuildJwt(claims, "some-hmac-key-we-dont-care", time.Hour*9)
+	if err != nil {
+		t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		extractor PrincipalExtractor
+		cert      *x509.Certificate
+		verified  bool
+		jwt       string
+		expErr    error
+		expCaller *Principal
+	}{
+		{
+			name:     "no extractor, no jwt",
+			cert:     spiffeCert,
+			verified: true,
+			expErr:   ErrNoCredentials,
+		},
+		{
+			name:      "spiffe id, no jwt",
+			extractor: TLSPeerPrincipal,
+			cert:      spiffeCert,
+			verified:  true,
+			expCaller: &Principal{
+				Type:        PrincipalTypeService,
+				ID:          "spiffe://example.org/ns/default/sa/svc",
+				SPIFFEID:    "spiffe://example.org/ns/default/sa/svc",
+				TrustDomain: "example.org",
+				DNSNames:    []string{"svc.ns.svc.cluster.local"},
+			},
+		},
+		{
+			name:      "dns san, no jwt",
+			extractor: TLSPeerPrincipal,
+			cert:      dnsCert,
+			verified:  true,
+			expCaller: &Principal{
+				Type:     PrincipalTypeService,
+				ID:       "svc.ns.svc.cluster.local",
+				DNSNames: []string{"svc.ns.svc.cluster.local"},
+			},
+		},
+		{
+			name:      "subject cn, with jwt",
+			extractor: TLSPeerPrincipal,
+			cert:      cnCert,
+			verified:  true,
+			jwt:       jwt,
+			expCaller: &Principal{
+				Type: PrincipalTypeService,
+				ID:   "svc-cn",
+			},
+		},
+		{
+			name:      "unverified cert, no jwt",
+			extractor: TLSPeerPrincipal,
+			cert:      spiffeCert,
+			expErr:    ErrNoCredentials,
+		},
+		{
+			name:      "no peer, no jwt",
+			extractor: TLSPeerPrincipal,
+			expErr:    ErrNoCredentials,
+		},
+		{
+			name:      "spiffe id, invalid jwt",
+			extractor: TLSPeerPrincipal,
+			cert:      spiffeCert,
+			verified:  true,
+			jwt:       "garbage",
+			expErr:    ErrInvalidJWT,
+		},
+		{
+			name: "extractor error",
+			extractor: func(ctx context.Context) (*Principal, error) {
+				return nil, errors.New("bad peer")
+			},
+			expErr: ErrInvalidPrincipal,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPayload Payload
+			evaluator := func(ctx context.Context, decisionDocument string, opaReq, opaResp interface{}) error {
+				gotPayload = opaReq.(Payload)
+				return json.Unmarshal([]byte(`{"allow": true}`), opaResp)
+			}
+
+			auther := NewDefaultAuthorizer("app", WithPrincipalExtractor(tt.extractor))
+
+			ctx := context.Background()
+			if tt.cert != nil {
+				ctx = contextWithTLSPeer(ctx, tt.cert, tt.verified)
+			}
+			if len(tt.jwt) > 0 {
+				ctx = utils_test.ContextWithJWT(ctx, tt.jwt)
+			}
+
+			ok, _, err := auther.Evaluate(ctx, "/service.TagService/ListTags", nil, evaluator)
+			if !errors.Is(err, tt.expErr) || (tt.expErr == nil && err != nil) {
+				t.Fatalf("FAIL: Evaluate() err=%v expected %v", err, tt.expErr)
+			}
+			if tt.expErr != nil {
+				return
+			}
+
+			if !ok {
+				t.Errorf("FAIL: Evaluate() not ok")
+			}
+			if !reflect.DeepEqual(gotPayload.Caller, tt.expCaller) {
+				t.Errorf("FAIL: Payload.Caller\ngot: %#v\nexp: %#v", gotPayload.Caller, tt.expCaller)
+			}
+			if gotPayload.JWT != tt.jwt {
+				t.Errorf("FAIL: Payload.JWT got %q expected %q", gotPayload.JWT, tt.jwt)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package grpc_opa_middleware
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ResultMapping maps the decision fields to their location in non-standard OPA responses,
+// as JSON pointers (RFC 6901), eg: "/decision/permit".
+// An empty pointer uses the standard key (eg: "allow" is "/allow").
+//
+// For example, for policies returning:
+//
+//	{"decision": {"permit": true, "filters": [["ctx.a == 1"]]}}
+//
+// use:
+//
+//	ResultMapping{Allow: "/decision/permit", Obligations: "/decision/filters"}
+type ResultMapping struct {
+	Allow            string
+	Obligations      string
+	EntitledFeatures string
+	DenyReasons      string
+}
+
+// Apply returns a new OPAResponse with the mapped fields at their standard keys
+// (allow, obligations, entitled_features, deny_reasons).
+// Fields not found in the OPA response are omitted.
+func (m ResultMapping) Apply(opaResp OPAResponse) OPAResponse {
+	mapped := OPAResponse{}
+
+	fields := []struct {
+		ptr string
+		key string
+	}{
+		{m.Allow, AllowKey},
+		{m.Obligations, string(ObKey)},
+		{m.EntitledFeatures, string(EntitledFeaturesKey)},
+		{m.DenyReasons, DenyReasonsKey},
+	}
+
+	for _, field := range fields {
+		if len(field.ptr) == 0 {
+			if val, ok := opaResp[field.key]; ok {
+				mapped[field.key] = val
+			}
+			continue
+		}
+
+		if val, ok := lookupJSONPointer(map[string]interface{}(opaResp), field.ptr); ok {
+			mapped[field.key] = val
+		}
+	}
+
+	// Unmapped deny reasons may also be under the alternate key
+	if _, ok := mapped[DenyReasonsKey]; !ok && len(m.DenyReasons) == 0 {
+		if val, ok := opaResp[ErrorsKey]; ok {
+			mapped[ErrorsKey] = val
+		}
+	}
+
+	return mapped
+}
+
+// lookupJSONPointer returns the value in the JSON-unmarshaled doc at the JSON pointer ptr
+func lookupJSONPointer(doc interface{}, ptr string) (interface{}, bool) {
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, false
+	}
+
+	cur := doc
+	for _, token := range strings.Split(ptr[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			next, ok := v[token]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case []interface{}:
+			idx, err := strconv.Atoi(token)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			cur = v[idx]
+		default:
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
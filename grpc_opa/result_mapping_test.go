@@ -0,0 +1,127 @@
+package grpc_opa_middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+)
+
+func TestLookupJSONPointer(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"decision": {"permit": true, "a/b": 1, "m~n": 2, "arr": ["x", "y"]}}`), &doc)
+
+	testMap := []struct {
+		ptr      string
+		expectOK bool
+		expect   interface{}
+	}{
+		{ptr: "/decision/permit", expectOK: true, expect: true},
+		{ptr: "/decision/a~1b", expectOK: true, expect: float64(1)},
+		{ptr: "/decision/m~0n", expectOK: true, expect: float64(2)},
+		{ptr: "/decision/arr/1", expectOK: true, expect: "y"},
+		{ptr: "/decision/arr/2"},
+		{ptr: "/decision/arr/x"},
+		{ptr: "/decision/missing"},
+		{ptr: "/decision/permit/x"},
+		{ptr: "decision"},
+	}
+
+	for _, tm := range testMap {
+		actual, ok := lookupJSONPointer(doc, tm.ptr)
+		if ok != tm.expectOK || !reflect.DeepEqual(actual, tm.expect) {
+			t.Errorf("%q: FAIL: got: %#v, %v wanted: %#v, %v", tm.ptr, actual, ok, tm.expect, tm.expectOK)
+		}
+	}
+}
+
+func TestEvaluateResultMapping(t *testing.T) {
+	mapping := ResultMapping{
+		Allow:            "/decision/permit",
+		Obligations:      "/decision/filters",
+		EntitledFeatures: "/decision/features",
+		DenyReasons:      "/decision/why",
+	}
+
+	testMap := []struct {
+		name        string
+		opts        []Option
+		respJSON    string
+		expectAllow bool
+		expectErr   error
+		expectOb    bool
+		expectEF    bool
+	}{
+		{
+			name:        "permitted with filters and features",
+			opts:        []Option{WithResultMapping(mapping)},
+			respJSON:    `{"result": {"decision": {"permit": true, "filters": [["ctx.a == 1"]], "features": {"lic": ["dhcp"]}}}}`,
+			expectAllow: true,
+			expectOb:    true,
+			expectEF:    true,
+		},
+		{
+			name:      "denied with reasons",
+			opts:      []Option{WithResultMapping(mapping)},
+			respJSON:  `{"result": {"decision": {"permit": false, "why": [{"message": "no", "user_visible": true}]}}}`,
+			expectErr: ErrForbidden,
+		},
+		{
+			name:      "standard keys ignored when mapped",
+			opts:      []Option{WithResultMapping(mapping)},
+			respJSON:  `{"result": {"allow": true}}`,
+			expectErr: ErrForbidden,
+		},
+		{
+			name:        "unmapped fields use standard keys",
+			opts:        []Option{WithResultMapping(ResultMapping{Allow: "/decision/permit"})},
+			respJSON:    `{"result": {"decision": {"permit": true}, "obligations": [["ctx.a == 1"]]}}`,
+			expectAllow: true,
+			expectOb:    true,
+		},
+		{
+			name:        "mapped, strict validation",
+			opts:        []Option{WithResultMapping(mapping), WithResponseValidation(StrictValidation)},
+			respJSON:    `{"result": {"decision": {"permit": true, "filters": [["ctx.a == 1"]]}}}`,
+			expectAllow: true,
+			expectOb:    true,
+		},
+		{
+			name:      "mapped allow missing, strict validation",
+			opts:      []Option{WithResultMapping(mapping), WithResponseValidation(StrictValidation)},
+			respJSON:  `{"result": {"decision": {"filters": []}}}`,
+			expectErr: ErrInvalidOPAResponse,
+		},
+	}
+
+	ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+
+	for _, tm := range testMap {
+		opts := append([]Option{
+			WithOpaEvaluator(mockJSONEvaluator(tm.respJSON)),
+			WithClaimsVerifier(NullClaimsVerifier),
+			WithDecisionInputHandler(&MockDecisionInputr{DecisionInput{DecisionDocument: "v1/data/custom"}}),
+		}, tm.opts...)
+		auther := NewDefaultAuthorizer("app", opts...)
+
+		allow, newCtx, err := auther.Evaluate(ctx, "FakeMethod", nil, auther.OpaQuery)
+		if allow != tm.expectAllow {
+			t.Errorf("%s: FAIL: got allow: %v wanted: %v", tm.name, allow, tm.expectAllow)
+		}
+		if tm.expectErr == nil && err != nil {
+			t.Errorf("%s: FAIL: unexpected err: %v", tm.name, err)
+		} else if tm.expectErr != nil && !errors.Is(err, tm.expectErr) {
+			t.Errorf("%s: FAIL: got err: %v wanted: %v", tm.name, err, tm.expectErr)
+		}
+
+		if _, ok := newCtx.Value(ObKey).(*ObligationsNode); ok != tm.expectOb {
+			t.Errorf("%s: FAIL: got obligations: %v wanted: %v", tm.name, ok, tm.expectOb)
+		}
+		if ef := newCtx.Value(EntitledFeaturesKey); (ef != nil) != tm.expectEF {
+			t.Errorf("%s: FAIL: got entitled_features: %v wanted: %v", tm.name, ef, tm.expectEF)
+		}
+	}
+}
@@ -2,11 +2,11 @@ package grpc_opa_middleware
 
 import (
 	"context"
-	"errors"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
 )
@@ -17,8 +17,12 @@ const (
 
 var (
 	// Application is set at initization
-	Application      string
-	ErrNoCredentials = errors.New("no credentials found")
+	Application string
+
+	// ErrNoCredentials is returned when there are no JWT bearers in the request
+	ErrNoCredentials = opa_client.NewError(codes.Unauthenticated, "no credentials found")
+	// ErrInvalidJWT is returned when the JWT claims verification fails
+	ErrInvalidJWT = opa_client.NewError(codes.Unauthenticated, "invalid JWT")
 )
 
 type key string
@@ -35,7 +39,7 @@ func NewDefaultConfig(application string, opts ...Option) *Config {
 		opt(cfg)
 	}
 
-	opts = append([]Option{WithOpaClienter(opa_client.New(cfg.address, opa_client.WithHTTPClient(cfg.httpCli)))}, opts...)
+	opts = append([]Option{WithOpaClienter(opa_client.New(cfg.address, cfg.opaClientOptions()...))}, opts...)
 
 	authorizer := NewDefaultAuthorizer(application, opts...)
 
@@ -63,13 +67,19 @@ func UnaryServerInterceptor(application string, opts ...Option) grpc.UnaryServer
 		for _, auther := range cfg.authorizer {
 			ok, newCtx, err = auther.Evaluate(ctx, info.FullMethod, grpcReq, auther.OpaQuery)
 			if err != nil {
-				logger.WithError(err).WithField("authorizer", auther).Error("unable_authorize")
+				authzLogger(logger, newCtx).WithError(err).WithField("authorizer", auther).Error("unable_authorize")
 			}
 			if ok {
 				break
 			}
 		}
 
+		if md := cfg.decisionIDMetadata(newCtx); md != nil {
+			if trErr := grpc.SetTrailer(ctx, md); trErr != nil {
+				logger.WithError(trErr).Debug("set_decision_id_trailer_error")
+			}
+		}
+
 		if err != nil {
 			return nil, err
 		}
@@ -80,7 +90,7 @@ func UnaryServerInterceptor(application string, opts ...Option) grpc.UnaryServer
 		}
 
 		// TODO: pass along authz information through context
-		return grpcUnaryHandler(newCtx, grpcReq)
+		return grpcUnaryHandler(ContextWithLookupMemo(newCtx), grpcReq)
 	}
 }
 
@@ -100,13 +110,17 @@ func StreamServerInterceptor(application string, opts ...Option) grpc.StreamServ
 		for _, auther := range cfg.authorizer {
 			ok, newCtx, err = auther.Evaluate(stream.Context(), info.FullMethod, info, auther.OpaQuery)
 			if err != nil {
-				logger.WithError(err).WithField("authorizer", auther).Error("unable_authorize")
+				authzLogger(logger, newCtx).WithError(err).WithField("authorizer", auther).Error("unable_authorize")
 			}
 			if ok {
 				break
 			}
 		}
 
+		if md := cfg.decisionIDMetadata(newCtx); md != nil {
+			stream.SetTrailer(md)
+		}
+
 		if err != nil {
 			return err
 		}
@@ -117,13 +131,24 @@ func StreamServerInterceptor(application string, opts ...Option) grpc.StreamServ
 		}
 
 		// TODO: pass along authz information through context
+		// Lookups are not memoized for the stream (see ContextWithLookupMemo),
+		// as streams may outlive the JWT
 		wrapped := wrapServerStream(stream)
 		wrapped.WrappedCtx = newCtx
 		return grpcStreamHandler(srv, wrapped)
 	}
 }
 
-// FromContext retrieves authZ information from the Context
+// authzLogger adds the AuthzResult fields (eg: request_id, decision_id) in ctx, if any, to logger
+func authzLogger(logger *logrus.Entry, ctx context.Context) *logrus.Entry {
+	if result, ok := AuthzResultFromContext(ctx); ok {
+		return logger.WithFields(result.LogFields())
+	}
+	return logger
+}
+
+// FromContext retrieves authZ information from the Context.
+// For DefaultAuthorizer, this is the *AuthzResult (see AuthzResultFromContext).
 func FromContext(ctx context.Context) interface{} {
 	return ctx.Value(authZKey)
 }
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -18,9 +21,11 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
 	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+	atlas_claims "github.com/infobloxopen/atlas-claims"
 )
 
 var netDialErr = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
@@ -58,6 +63,10 @@ func TestConnFailure(t *testing.T) {
 	if e := opa_client.ErrServiceUnavailable; !errors.Is(err, e) {
 		t.Errorf("got: %s wanted: %s", err, e)
 	}
+
+	if st := status.Convert(err); st.Code() != codes.Unavailable || st.Message() != opa_client.ErrServiceUnavailable.Message {
+		t.Errorf("got status: %v wanted: opaque %s status", st, codes.Unavailable)
+	}
 }
 
 func TestMockOPA(t *testing.T) {
@@ -392,8 +401,225 @@ func TestStreamServerInterceptorMockOpaClient(t *testing.T) {
 
 		if (tm.expErr == nil) && gotErr != nil {
 			t.Errorf("%d: expErr=nil, gotErr=%s", idx, gotErr)
-		} else if (tm.expErr != nil) && (tm.expErr != gotErr) {
+		} else if (tm.expErr != nil) && !errors.Is(gotErr, tm.expErr) {
 			t.Errorf("%d: expErr=%s, gotErr=%s", idx, tm.expErr, gotErr)
 		}
 	}
 }
+
+type mockServerTransportStream struct {
+	grpc.ServerTransportStream
+	trailer metadata.MD
+}
+
+func (m *mockServerTransportStream) Method() string {
+	return "FakeMethod"
+}
+
+func (m *mockServerTransportStream) SetTrailer(md metadata.MD) error {
+	m.trailer = metadata.Join(m.trailer, md)
+	return nil
+}
+
+func TestDecisionIDTrailer(t *testing.T) {
+	testMap := []struct {
+		name          string
+		opts          []Option
+		respJSON      string
+		expectErr     error
+		expectAllow   bool
+		expectTrailer []string
+	}{
+		{
+			name:          "allowed, trailer option",
+			opts:          []Option{WithDecisionIDTrailer("")},
+			respJSON:      `{"result": {"allow": true}, "decision_id": "decision-1"}`,
+			expectAllow:   true,
+			expectTrailer: []string{"decision-1"},
+		},
+		{
+			name:          "denied, custom trailer key",
+			opts:          []Option{WithDecisionIDTrailer("x-decision-id")},
+			respJSON:      `{"result": {"allow": false}, "decision_id": "decision-2"}`,
+			expectErr:     ErrForbidden,
+			expectTrailer: []string{"decision-2"},
+		},
+		{
+			name:          "allowed, no trailer option",
+			respJSON:      `{"result": {"allow": true}, "decision_id": "decision-3"}`,
+			expectAllow:   true,
+			expectTrailer: nil,
+		},
+		{
+			name:          "allowed, no decision_id",
+			opts:          []Option{WithDecisionIDTrailer("")},
+			respJSON:      `{"result": {"allow": true}}`,
+			expectAllow:   true,
+			expectTrailer: nil,
+		},
+	}
+
+	for _, tm := range testMap {
+		t.Run(tm.name, func(t *testing.T) {
+			var gotResult *AuthzResult
+			grpcUnaryHandler := func(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+				gotResult, _ = AuthzResultFromContext(ctx)
+				return nil, nil
+			}
+
+			opaEvaltor := func(ctx context.Context, decisionDocument string, opaReq, opaResp interface{}) error {
+				return json.Unmarshal([]byte(tm.respJSON), opaResp)
+			}
+
+			opts := append([]Option{
+				WithOpaEvaluator(opaEvaltor),
+				WithClaimsVerifier(NullClaimsVerifier),
+			}, tm.opts...)
+			interceptor := UnaryServerInterceptor("app", opts...)
+
+			srvStream := &mockServerTransportStream{}
+			ctx := grpc.NewContextWithServerTransportStream(context.Background(), srvStream)
+			ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(logrus.StandardLogger()))
+
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "FakeMethod"}, grpcUnaryHandler)
+			if err != tm.expectErr {
+				t.Errorf("got err: %v wanted: %v", err, tm.expectErr)
+			}
+
+			if tm.expectAllow && (gotResult == nil || !gotResult.Allow) {
+				t.Errorf("got AuthzResult: %#v wanted Allow", gotResult)
+			}
+
+			key := DefaultDecisionIDTrailer
+			for _, opt := range tm.opts {
+				cfg := &Config{}
+				opt(cfg)
+				key = cfg.decisionIDTrailerKey
+			}
+			if gotTrailer := srvStream.trailer.Get(key); !reflect.DeepEqual(gotTrailer, tm.expectTrailer) {
+				t.Errorf("got trailer: %#v wanted: %#v", gotTrailer, tm.expectTrailer)
+			}
+		})
+	}
+}
+
+// opaErrTransport responds to every OPA request with an OPA error
+type opaErrTransport struct {
+	status int
+	body   string
+}
+
+func (t *opaErrTransport) RoundTrip(httpReq *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: t.status,
+		Body:       io.NopCloser(strings.NewReader(t.body)),
+		Header:     http.Header{},
+		Request:    httpReq,
+	}, nil
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	allowJSON := `{"allow": true}`
+	validJWT, err := atlas_claims.BuildJwt(&atlas_claims.Claims{AccountId: "40"}, "some-hmac-key-we-dont-care", time.Hour)
+	if err != nil {
+		t.Fatalf("FAIL: BuildJwt() unexpected err=%v", err)
+	}
+
+	testMap := []struct {
+		name      string
+		opts      []Option
+		jwt       string
+		expectErr error
+		expCode   codes.Code
+	}{
+		{
+			name:      "missing credentials",
+			opts:      []Option{WithOpaEvaluator(mockJSONEvaluator(allowJSON))},
+			expectErr: ErrNoCredentials,
+			expCode:   codes.Unauthenticated,
+		},
+		{
+			name:      "invalid JWT",
+			opts:      []Option{WithOpaEvaluator(mockJSONEvaluator(allowJSON))},
+			jwt:       "not.a.jwt",
+			expectErr: ErrInvalidJWT,
+			expCode:   codes.Unauthenticated,
+		},
+		{
+			name:      "denied",
+			opts:      []Option{WithOpaEvaluator(mockJSONEvaluator(`{"allow": false}`))},
+			jwt:       validJWT,
+			expectErr: ErrForbidden,
+			expCode:   codes.PermissionDenied,
+		},
+		{
+			name:      "OPA unavailable",
+			opts:      []Option{WithHTTPClient(&http.Client{Transport: &connFailTransport{}})},
+			jwt:       validJWT,
+			expectErr: opa_client.ErrServiceUnavailable,
+			expCode:   codes.Unavailable,
+		},
+		{
+			name: "OPA evaluation error",
+			opts: []Option{WithHTTPClient(&http.Client{Transport: &opaErrTransport{
+				status: http.StatusInternalServerError,
+				body:   `{"code": "internal_error", "message": "secret policy detail"}`,
+			}})},
+			jwt:       validJWT,
+			expectErr: opa_client.ErrEvaluation,
+			expCode:   codes.Internal,
+		},
+	}
+
+	grpcUnaryHandler := func(ctx context.Context, grpcReq interface{}) (interface{}, error) {
+		return nil, nil
+	}
+
+	for _, tm := range testMap {
+		t.Run(tm.name, func(t *testing.T) {
+			interceptor := UnaryServerInterceptor("app", tm.opts...)
+
+			ctx := context.WithValue(context.Background(), utils_test.TestingTContextKey, t)
+			if len(tm.jwt) > 0 {
+				ctx = utils_test.ContextWithJWT(ctx, tm.jwt)
+			}
+
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "FakeMethod"}, grpcUnaryHandler)
+			if !errors.Is(err, tm.expectErr) {
+				t.Errorf("FAIL: got err: %v wanted: %v", err, tm.expectErr)
+			}
+
+			var typedErr *opa_client.Error
+			if !errors.As(err, &typedErr) {
+				t.Errorf("FAIL: got err type: %T wanted: *opa_client.Error", err)
+			}
+
+			st := status.Convert(err)
+			if st.Code() != tm.expCode {
+				t.Errorf("FAIL: got code: %v wanted: %v", st.Code(), tm.expCode)
+			}
+			if strings.Contains(st.Message(), "secret") {
+				t.Errorf("FAIL: status message not redacted: %q", st.Message())
+			}
+		})
+	}
+
+	// Authorizer not allowing without error is an undefined decision
+	interceptor := UnaryServerInterceptor("app",
+		WithAuthorizer(&mockAuthorizer{
+			evaluate: func(ctx context.Context, fullMethod string, grpcReq interface{}, opaEvaluator OpaEvaluator) (bool, context.Context, error) {
+				return false, ctx, nil
+			},
+		}),
+	)
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "FakeMethod"}, grpcUnaryHandler)
+	if !errors.Is(err, opa_client.ErrUndefined) || status.Code(err) != codes.PermissionDenied {
+		t.Errorf("FAIL: got err: %v wanted: %v", err, opa_client.ErrUndefined)
+	}
+}
+
+func mockJSONEvaluator(respJSON string) OpaEvaluator {
+	return func(ctx context.Context, decisionDocument string, opaReq, opaResp interface{}) error {
+		return json.Unmarshal([]byte(respJSON), opaResp)
+	}
+}
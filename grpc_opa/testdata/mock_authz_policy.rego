@@ -333,3 +333,55 @@ test_filter_compartment_api {
 # curl -X GET  -H 'Content-Type: application/json' http://localhost:8181/v1/data/authz/rbac/acct_entitlements_api | jq .
 # curl -X POST -H 'Content-Type: application/json' http://localhost:8181/v1/data/authz/rbac/acct_entitlements_api | jq .
 
+
+group_endpoint_permissions := {
+	"custom-admin-group": {
+		"TagService.ListTags": {"ddi.tag": ["list", "read"]},
+		"TagService.DeleteTag": {"ddi.tag": ["delete"]},
+	},
+	"user": {
+		"TagService.ListTags": {"ddi.tag": ["list"]},
+		"UserService.GetUser": {"iam.user": ["read"]},
+	},
+}
+
+effective_permissions_all[endpoint] = type_verbs {
+	some endpoint
+	group_endpoint_permissions[merged_input.groups[_]][endpoint]
+	type_verbs := {typ: verbs |
+		some typ
+		group_endpoint_permissions[merged_input.groups[_]][endpoint][typ]
+		verbs := sort({verb | verb := group_endpoint_permissions[merged_input.groups[_]][endpoint][typ][_]})
+	}
+}
+
+effective_permissions = perms {
+	is_array(input.endpoints)
+	count(input.endpoints) > 0
+	perms := {endpoint: type_verbs |
+		endpoint := input.endpoints[_]
+		type_verbs := effective_permissions_all[endpoint]
+	}
+} else = effective_permissions_all {
+	true
+}
+
+effective_permissions_test_fn(groups, endpoints, exp_map) {
+	got_map := effective_permissions with input as {
+		"groups": groups,
+		"endpoints": endpoints,
+	}
+	trace(sprintf("got_map: %v", [got_map]))
+	trace(sprintf("exp_map: %v", [exp_map]))
+	got_map == exp_map
+}
+
+test_effective_permissions {
+	effective_permissions_test_fn(["custom-admin-group", "user"], [],
+		{"TagService.ListTags": {"ddi.tag": ["list", "read"]},
+		 "TagService.DeleteTag": {"ddi.tag": ["delete"]},
+		 "UserService.GetUser": {"iam.user": ["read"]}})
+
+	effective_permissions_test_fn(["user"], ["TagService.ListTags", "TagService.DeleteTag"],
+		{"TagService.ListTags": {"ddi.tag": ["list"]}})
+}
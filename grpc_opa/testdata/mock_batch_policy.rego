@@ -0,0 +1,23 @@
+package batch_eval
+
+# Test rego for BatchEvaluate.
+# batch_validate_v1 returns one validate_v1 result per input.inputs element.
+
+permitted = {
+	"read": {"ddi.ipam", "ddi.dns"},
+	"write": {"ddi.dns"},
+}
+
+allowed(inp) = r {
+	r := count({1 | permitted[inp.verb][inp.type]}) > 0
+}
+
+obligations(inp) = [["ctx.owner == \"bob\""]] {
+	inp.verb == "write"
+} else = [] {
+	true
+}
+
+validate_v1 = {"allow": allowed(input), "obligations": obligations(input)}
+
+batch_validate_v1 = [r | inp := input.inputs[_]; r := {"allow": allowed(inp), "obligations": obligations(inp)}]
@@ -0,0 +1,22 @@
+package partial_eval
+
+# Test rego for PartialEvaluate.
+# input.resource is treated as unknown, so its conditions
+# are returned by OPA Compile API as residual queries.
+
+default allow = false
+
+allow {
+	input.application == "partial-app"
+	input.resource.owner == "bob"
+}
+
+allow {
+	input.application == "partial-app"
+	10 < input.resource.size
+	input.resource.tags["datacenter"] != "dc-1"
+}
+
+allow {
+	input.application == "unconditional-app"
+}
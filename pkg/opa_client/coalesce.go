@@ -0,0 +1,106 @@
+package opa_client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CoalesceIgnoredHeaders are the forwarded HTTP headers left out of CoalesceKey:
+// per-request correlation and trace headers, which differ for every request
+// without changing the response. Coalesced requests are sent to OPA
+// with the values of these headers of the first request only.
+var CoalesceIgnoredHeaders = []string{
+	"x-request-id",
+	"request-id",
+	"traceparent",
+	"tracestate",
+}
+
+// Coalescer coalesces identical concurrent (in-flight) OPA requests,
+// so that only one request is sent to OPA and its response is shared among all waiters.
+// The zero value is ready to use.
+type Coalescer struct {
+	group singleflight.Group
+
+	mu      sync.Mutex
+	waiters int
+}
+
+// CoalesceKey returns the canonical key identifying a request to document with postReqBody,
+// the QueryOptions in ctx, and the incoming gRPC metadata in ctx forwarded by policy
+// except CoalesceIgnoredHeaders, since they may change the response
+func CoalesceKey(ctx context.Context, policy HeaderPolicy, document string, postReqBody []byte) string {
+	h := sha256.New()
+	h.Write([]byte(document))
+	h.Write([]byte{0})
+	h.Write(postReqBody)
+	h.Write([]byte{0})
+
+	if qryOpts, ok := QueryOptionsFromContext(ctx); ok {
+		h.Write([]byte(qryOpts.Encode()))
+	}
+	h.Write([]byte{0})
+
+	hdrs := policy.forwardedHeaders(ctx, "http")
+	names := make([]string, 0, len(hdrs))
+	for name := range hdrs {
+		if !containsFold(CoalesceIgnoredHeaders, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Write([]byte(name))
+		for _, v := range hdrs[name] {
+			h.Write([]byte{0})
+			h.Write([]byte(v))
+		}
+		h.Write([]byte{0, 0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Do executes fn, unless an identical request (same key) is already in-flight,
+// in which case it waits for and returns the in-flight request's response instead.
+// fn is called with a context that is not canceled when the first caller's ctx is canceled,
+// since other waiters may still be waiting for its response.
+// Each caller stops waiting when its own ctx is done, returning ctx.Err().
+// Returns whether the response was shared with other callers.
+func (c *Coalescer) Do(ctx context.Context, key string, fn func(context.Context) ([]byte, error)) ([]byte, bool, error) {
+	sharedCtx := context.WithoutCancel(ctx)
+
+	// Counted with the same lock, so that callers counted have joined the in-flight request
+	c.mu.Lock()
+	resCh := c.group.DoChan(key, func() (interface{}, error) {
+		return fn(sharedCtx)
+	})
+	c.waiters++
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.waiters--
+		c.mu.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case res := <-resCh:
+		bs, _ := res.Val.([]byte)
+		return bs, res.Shared, res.Err
+	}
+}
+
+// Waiters returns the number of callers waiting for in-flight requests
+func (c *Coalescer) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.waiters
+}
@@ -0,0 +1,67 @@
+package opa_client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/open-policy-agent/opa/server/types"
+)
+
+const (
+	// CompileApiPath is the OPA Compile API path
+	CompileApiPath = "v1/compile"
+)
+
+// Compiler is the opa client interface for the OPA Compile API (partial evaluation)
+type Compiler interface {
+	Compile(ctx context.Context, req *CompileRequest) (*CompileResult, error)
+}
+
+// CompileRequest is the request payload for the OPA Compile API
+type CompileRequest struct {
+	// Query is the query to partially evaluate, eg: "data.authz.rbac.validate_v1.allow == true"
+	Query string `json:"query"`
+	// Input is the known input document
+	Input interface{} `json:"input,omitempty"`
+	// Unknowns are the references to treat as unknown, eg: "input.resource"
+	Unknowns []string `json:"unknowns,omitempty"`
+}
+
+// CompileResult is the partial evaluation result returned by the OPA Compile API.
+// No residual Queries means the query can never be true.
+// A residual query with no expressions means the query is unconditionally true.
+type CompileResult = types.PartialEvaluationResultV1
+
+// compileResponse is the data type json.Unmarshaled from OPA Compile API
+type compileResponse struct {
+	Result *CompileResult `json:"result"`
+}
+
+// Compile partially evaluates req.Query, treating req.Unknowns as unknown,
+// and returns the residual queries.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#compile-api
+func (c *Client) Compile(ctx context.Context, req *CompileRequest) (*CompileResult, error) {
+	postReqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp compileResponse
+	respRdrFn := func(rdr io.Reader) error {
+		dec := json.NewDecoder(rdr)
+		return dec.Decode(&resp)
+	}
+
+	err = c.CustomQueryStream(ctx, CompileApiPath, postReqBody, respRdrFn)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Result == nil {
+		return &CompileResult{}, nil
+	}
+
+	return resp.Result, nil
+}
@@ -1,6 +1,7 @@
 package opa_client
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/open-policy-agent/opa/server/types"
@@ -10,10 +11,78 @@ import (
 
 var (
 	// Opaque errors to reveal less details in upstream client
-	ErrServiceUnavailable = types.NewErrorV1("ServiceUnavailable", "connection refused")
-	ErrUnknown            = types.NewErrorV1("Unknown", "unknown error")
+
+	// ErrServiceUnavailable is returned when OPA cannot be reached
+	ErrServiceUnavailable = NewError(codes.Unavailable, "connection refused")
+	// ErrEvaluation is returned when OPA fails to evaluate the policy
+	ErrEvaluation = NewError(codes.Internal, "policy evaluation error")
+	// ErrUndefined is returned when the OPA decision (or document) is undefined.
+	// An undefined decision is not an authorization, so it fails closed as PermissionDenied.
+	ErrUndefined = NewError(codes.PermissionDenied, "undefined decision")
+	// ErrUnknown is returned for any other OPA error
+	ErrUnknown = NewError(codes.Unknown, "unknown error")
 )
 
+// Error is a typed error with a stable gRPC code.
+//
+// Errors wrapping an underlying cause (see Wrap) match their sentinel error with errors.Is,
+// and the cause can be retrieved with errors.Unwrap or errors.As.
+// The gRPC status (see GRPCStatus) only contains the code and the sentinel message,
+// so the cause is logged but never sent to gRPC clients.
+type Error struct {
+	Code    codes.Code
+	Message string
+	Err     error
+
+	sentinel *Error
+}
+
+// NewError returns a new sentinel *Error
+func NewError(code codes.Code, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Wrap returns a new *Error with the same code and message as e, wrapping the cause err
+func (e *Error) Wrap(err error) *Error {
+	sentinel := e.sentinel
+	if sentinel == nil {
+		sentinel = e
+	}
+	return &Error{
+		Code:     e.Code,
+		Message:  e.Message,
+		Err:      err,
+		sentinel: sentinel,
+	}
+}
+
+// Error implements error interface, including the cause (if any)
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the cause (if any)
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is allows errors.Is(err, sentinel) for errors returned by sentinel.Wrap
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && (t == e || t == e.sentinel)
+}
+
+// GRPCStatus allows status.Code/status.FromError, excluding the cause from the message
+func (e *Error) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Message)
+}
+
 // ErrorV1 implements missing errors.Unwrap functionality
 // TODO: issue opened with OPA https://github.com/open-policy-agent/opa/issues/2633
 type ErrorV1 struct {
@@ -70,13 +139,21 @@ func opaErrToGrpcErr(errV1 *types.ErrorV1) error {
 	return status.Error(grpcCodeFromOPACode(errV1.Code), errV1.Message)
 }
 
-// GRPCError translates opa encodes errors to gRPC status errors
+// GRPCError translates opa encodes errors to gRPC status errors.
+// *Error errors are returned as is, since they already have a gRPC code.
 func GRPCError(err error) error {
+	var typedErr *Error
+	if errors.As(err, &typedErr) {
+		return typedErr
+	}
+
 	switch tErr := err.(type) {
 	case *types.ErrorV1:
 		return opaErrToGrpcErr(tErr)
 	case *ErrorV1:
 		return status.Error(grpcCodeFromOPACode(tErr.Code), tErr.Message)
+	case *ResponseTooLargeError:
+		return status.Error(codes.ResourceExhausted, tErr.Error())
 	}
 
 	return status.Error(codes.Unknown, err.Error())
@@ -0,0 +1,120 @@
+package opa_client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// RedactedHeaderValue replaces the value of redacted headers forwarded to OPA
+	RedactedHeaderValue = "redacted"
+)
+
+var (
+	// DefaultAllowedHeaders are the incoming gRPC metadata keys forwarded to OPA
+	// by DefaultHeaderPolicy: request correlation and trace propagation only.
+	DefaultAllowedHeaders = []string{
+		"x-request-id",
+		"request-id",
+		"traceparent",
+		"tracestate",
+	}
+
+	// DefaultDeniedHeaders are never forwarded to OPA by DefaultHeaderPolicy,
+	// even if they are also allowed.
+	DefaultDeniedHeaders = []string{
+		"authorization",
+		"set-authorization",
+		"cookie",
+		"grpcgateway-cookie",
+		"proxy-authorization",
+	}
+)
+
+// HeaderPolicy controls which incoming gRPC metadata is forwarded
+// to OPA as HTTP request headers by CustomQueryStream.
+//
+// Metadata keys are matched case-insensitively. Deny takes precedence
+// over Allow and ForwardAll. Rename maps a metadata key to the HTTP header
+// name sent to OPA. Redact forwards the header with RedactedHeaderValue
+// in place of its value.
+type HeaderPolicy struct {
+	// ForwardAll forwards every metadata key not in Deny
+	ForwardAll bool
+	Allow      []string
+	Deny       []string
+	Rename     map[string]string
+	Redact     []string
+}
+
+// DefaultHeaderPolicy returns the HeaderPolicy used unless overridden
+// with WithHeaderPolicy or WithForwardAllHeaders.
+func DefaultHeaderPolicy() HeaderPolicy {
+	return HeaderPolicy{
+		Allow: append([]string(nil), DefaultAllowedHeaders...),
+		Deny:  append([]string(nil), DefaultDeniedHeaders...),
+	}
+}
+
+// ForwardAllHeaderPolicy returns a HeaderPolicy that forwards all metadata,
+// which was the behavior prior to HeaderPolicy.
+func ForwardAllHeaderPolicy() HeaderPolicy {
+	return HeaderPolicy{ForwardAll: true}
+}
+
+// header returns the HTTP header name to forward metadata key as,
+// whether its value must be redacted, and whether it may be forwarded at all.
+func (p HeaderPolicy) header(key string) (string, bool, bool) {
+	key = strings.ToLower(key)
+
+	if containsFold(p.Deny, key) {
+		return "", false, false
+	}
+	if !p.ForwardAll && !containsFold(p.Allow, key) {
+		return "", false, false
+	}
+
+	name := key
+	for from, to := range p.Rename {
+		if strings.EqualFold(from, key) {
+			name = to
+			break
+		}
+	}
+
+	return name, containsFold(p.Redact, key), true
+}
+
+// forwardedHeaders returns the HTTP headers forwarded to Opa (at URL scheme)
+// for the incoming gRPC metadata in ctx
+func (p HeaderPolicy) forwardedHeaders(ctx context.Context, scheme string) http.Header {
+	hdrs := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key := range md {
+		name, redact, ok := p.header(key)
+		if !ok {
+			continue
+		}
+		for _, v := range md.Get(key) {
+			if redact {
+				v = RedactedHeaderValue
+			}
+			if checkHeader(scheme, name, v) {
+				hdrs.Add(name, v)
+			}
+		}
+	}
+	return hdrs
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -14,7 +14,6 @@ import (
 
 	"github.com/open-policy-agent/opa/server/types"
 	"golang.org/x/net/http/httpguts"
-	"google.golang.org/grpc/metadata"
 )
 
 const (
@@ -22,14 +21,13 @@ const (
 	contentType    = "application/json"
 )
 
-var (
-	ErrUndefined = errors.New("undefined decision")
-)
-
 // Client implements the Clienter interface
 type Client struct {
-	cli     *http.Client
-	address string
+	cli          *http.Client
+	address      string
+	headerPolicy HeaderPolicy
+	coalescer    *Coalescer
+	maxRespSize  int64
 }
 
 // Clienter is the opa client interface
@@ -50,8 +48,9 @@ type Option func(c *Client)
 func New(address string, opts ...Option) Clienter {
 
 	c := &Client{
-		cli:     http.DefaultClient,
-		address: address,
+		cli:          http.DefaultClient,
+		address:      address,
+		headerPolicy: DefaultHeaderPolicy(),
 	}
 
 	for _, opt := range opts {
@@ -70,6 +69,40 @@ func WithHTTPClient(cli *http.Client) Option {
 	}
 }
 
+// WithHeaderPolicy overrides the default HeaderPolicy controlling which
+// incoming gRPC metadata is forwarded to Opa as HTTP headers
+func WithHeaderPolicy(policy HeaderPolicy) Option {
+	return func(c *Client) {
+		c.headerPolicy = policy
+	}
+}
+
+// WithForwardAllHeaders forwards all incoming gRPC metadata to Opa as HTTP headers.
+// This leaks credentials and client-controlled headers to Opa and its decision logs,
+// and should only be used where that is acceptable.
+func WithForwardAllHeaders() Option {
+	return WithHeaderPolicy(ForwardAllHeaderPolicy())
+}
+
+// WithRequestCoalescing coalesces identical concurrent CustomQuery/CustomQueryBytes
+// requests (same document, request body, QueryOptions and forwarded headers
+// except CoalesceIgnoredHeaders) into a single request to Opa,
+// sharing the response among all waiters.
+func WithRequestCoalescing() Option {
+	return func(c *Client) {
+		c.coalescer = &Coalescer{}
+	}
+}
+
+// WithMaxResponseSize limits the size in bytes of Opa responses.
+// Responses exceeding the limit fail with *ResponseTooLargeError.
+// Zero (the default) means unlimited.
+func WithMaxResponseSize(maxBytes int64) Option {
+	return func(c *Client) {
+		c.maxRespSize = maxBytes
+	}
+}
+
 // do handles errors connecting to OPA
 func (c *Client) do(req *http.Request) (*http.Response, error) {
 	resp, err := c.cli.Do(req)
@@ -82,6 +115,12 @@ func (c *Client) do(req *http.Request) (*http.Response, error) {
 	return resp, err
 }
 
+// HeaderPolicy returns the HeaderPolicy controlling which
+// incoming gRPC metadata is forwarded to Opa as HTTP headers
+func (c *Client) HeaderPolicy() HeaderPolicy {
+	return c.headerPolicy
+}
+
 // String implements fmt.Stringer interface
 func (c Client) String() string {
 	return fmt.Sprintf(`opa_client.Client{address:"%s"}`, c.address)
@@ -113,6 +152,9 @@ type StreamReaderFn func(io.Reader) error
 
 // CustomQueryStream requests evaluation at a document of the caller's choice
 // StreamReaderFn is supplied to directly read/parse from non-error OPA response stream.
+// Incoming gRPC metadata in ctx is forwarded as HTTP headers according to the HeaderPolicy.
+// QueryOptions in ctx (see ContextWithQueryOptions) are sent as URL query parameters.
+// The OPA response stream is limited to the size configured with WithMaxResponseSize.
 //
 // https://www.openpolicyagent.org/docs/latest/rest-api/#query-api
 func (c *Client) CustomQueryStream(ctx context.Context, document string, postReqBody []byte, respRdrFn StreamReaderFn) error {
@@ -123,13 +165,13 @@ func (c *Client) CustomQueryStream(ctx context.Context, document string, postReq
 		return err
 	}
 
-	md, _ := metadata.FromIncomingContext(ctx)
-	for key := range md {
-		val := md.Get(key)
-		for _, v := range val {
-			if checkHeader(req.URL.Scheme, key, v) {
-				req.Header.Add(key, v)
-			}
+	if qryOpts, ok := QueryOptionsFromContext(ctx); ok {
+		req.URL.RawQuery = qryOpts.Encode()
+	}
+
+	for name, vals := range c.headerPolicy.forwardedHeaders(ctx, req.URL.Scheme) {
+		for _, v := range vals {
+			req.Header.Add(name, v)
 		}
 	}
 
@@ -139,17 +181,22 @@ func (c *Client) CustomQueryStream(ctx context.Context, document string, postReq
 	if err != nil {
 		return err
 	}
-	defer postResp.Body.Close()
+	defer closeBody(postResp.Body)
+
+	if c.maxRespSize > 0 && postResp.ContentLength > c.maxRespSize {
+		return &ResponseTooLargeError{Limit: c.maxRespSize}
+	}
+	body := newLimitedReader(postResp.Body, c.maxRespSize)
 
 	// Successful code, decode as document
 	if postResp.StatusCode >= 200 && postResp.StatusCode < 400 {
 		if respRdrFn != nil {
-			err = respRdrFn(postResp.Body)
+			err = respRdrFn(body)
 		}
 		return err
 	}
 
-	bs, err := ioutil.ReadAll(postResp.Body)
+	bs, err := ioutil.ReadAll(body)
 	if err != nil {
 		return err
 	}
@@ -174,21 +221,36 @@ func (c *Client) CustomQueryBytes(ctx context.Context, document string, reqData
 		return nil, err
 	}
 
-	var bs []byte
-	respRdrFn := func(rdr io.Reader) error {
-		allBytes, err := ioutil.ReadAll(rdr)
-		if err == nil {
-			bs = allBytes
+	return c.customQueryBytes(ctx, document, postReqBody)
+}
+
+// customQueryBytes returns the non-error OPA response bytes,
+// coalescing identical concurrent requests if WithRequestCoalescing.
+func (c *Client) customQueryBytes(ctx context.Context, document string, postReqBody []byte) ([]byte, error) {
+	queryFn := func(ctx context.Context) ([]byte, error) {
+		var bs []byte
+		respRdrFn := func(rdr io.Reader) error {
+			allBytes, err := ioutil.ReadAll(rdr)
+			if err == nil {
+				bs = allBytes
+			}
+			return err
 		}
-		return err
+
+		err := c.CustomQueryStream(ctx, document, postReqBody, respRdrFn)
+		if err != nil {
+			return nil, err
+		}
+
+		return bs, nil
 	}
 
-	err = c.CustomQueryStream(ctx, document, postReqBody, respRdrFn)
-	if err != nil {
-		return nil, err
+	if c.coalescer == nil {
+		return queryFn(ctx)
 	}
 
-	return bs, nil
+	bs, _, err := c.coalescer.Do(ctx, CoalesceKey(ctx, c.headerPolicy, document, postReqBody), queryFn)
+	return bs, err
 }
 
 // CustomQuery requests evaluation at a document of the caller's choice
@@ -199,6 +261,15 @@ func (c *Client) CustomQuery(ctx context.Context, document string, reqData, resp
 		return err
 	}
 
+	if c.coalescer != nil {
+		bs, err := c.customQueryBytes(ctx, document, postReqBody)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(bs))
+		return dec.Decode(resp)
+	}
+
 	respRdrFn := func(rdr io.Reader) error {
 		dec := json.NewDecoder(rdr)
 		return dec.Decode(resp)
@@ -216,46 +287,3 @@ func checkHeader(scheme, key, val string) bool {
 
 	return httpguts.ValidHeaderFieldName(key) && httpguts.ValidHeaderFieldValue(val)
 }
-
-// UploadRegoPolicy creates/updates an OPA policy.
-// Intended for unit-testing.
-//
-// https://www.openpolicyagent.org/docs/latest/rest-api/#create-or-update-a-policy
-func (c *Client) UploadRegoPolicy(ctx context.Context, policyID string, policyRego []byte, resp interface{}) error {
-
-	ref := fmt.Sprintf("%s/v1/policies/%s", c.Address(), policyID)
-
-	req, err := http.NewRequest("PUT", ref, bytes.NewBuffer(policyRego))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "text/plain")
-
-	putResp, err := c.do(req)
-	if err != nil {
-		return err
-	}
-	defer putResp.Body.Close()
-	bs, _ := ioutil.ReadAll(putResp.Body)
-
-	buf := bytes.NewBuffer(bs)
-	copy := buf.String()
-	dec := json.NewDecoder(buf)
-
-	// Successful code, decode as document
-	if putResp.StatusCode >= 200 && putResp.StatusCode < 400 {
-		if resp == nil {
-			return nil
-		}
-		return dec.Decode(resp)
-	}
-
-	// unsuccessful code, attempt to decode as types.ErrorV1
-	var opaErrV1 types.ErrorV1
-	if err := dec.Decode(&opaErrV1); err != nil {
-		return fmt.Errorf("unparseable error from OPA: StatusCode=%d: `%s`", putResp.StatusCode, copy)
-	}
-
-	return &opaErrV1
-}
@@ -1,7 +1,21 @@
 package opa_client
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/server/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestCheckHeaders(t *testing.T) {
@@ -34,3 +48,348 @@ func TestCheckHeaders(t *testing.T) {
 		}
 	}
 }
+
+func TestHeaderPolicy(t *testing.T) {
+	md := metadata.Pairs(
+		"authorization", "Bearer secret",
+		"cookie", "session=secret",
+		"x-request-id", "reqid-1",
+		"x-tenant", "tenant-1",
+		"x-custom", "custom-1",
+	)
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		expect http.Header
+	}{
+		{
+			name: "default",
+			expect: http.Header{
+				"X-Request-Id": {"reqid-1"},
+			},
+		},
+		{
+			name: "forward all",
+			opts: []Option{WithForwardAllHeaders()},
+			expect: http.Header{
+				"Authorization": {"Bearer secret"},
+				"Cookie":        {"session=secret"},
+				"X-Request-Id":  {"reqid-1"},
+				"X-Tenant":      {"tenant-1"},
+				"X-Custom":      {"custom-1"},
+			},
+		},
+		{
+			name: "allow deny rename redact",
+			opts: []Option{WithHeaderPolicy(HeaderPolicy{
+				Allow:  []string{"X-Tenant", "x-custom", "authorization"},
+				Deny:   []string{"authorization"},
+				Rename: map[string]string{"x-tenant": "x-opa-tenant"},
+				Redact: []string{"x-custom"},
+			})},
+			expect: http.Header{
+				"X-Opa-Tenant": {"tenant-1"},
+				"X-Custom":     {RedactedHeaderValue},
+			},
+		},
+	}
+
+	for _, tm := range tests {
+		var actual http.Header
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actual = r.Header.Clone()
+			w.Write([]byte(`{}`))
+		}))
+
+		cli := New(svr.URL, tm.opts...)
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		if err := cli.CustomQuery(ctx, "v1/data/test", nil, &map[string]interface{}{}); err != nil {
+			t.Errorf("%s: unexpected err: %v", tm.name, err)
+		}
+		svr.Close()
+
+		for k := range tm.expect {
+			if !reflect.DeepEqual(tm.expect[k], actual[k]) {
+				t.Errorf("%s: header %s got: %v wanted: %v", tm.name, k, actual[k], tm.expect[k])
+			}
+		}
+		for _, k := range []string{"Authorization", "Cookie", "X-Request-Id", "X-Tenant", "X-Custom"} {
+			if _, ok := tm.expect[k]; !ok && actual.Get(k) != "" {
+				t.Errorf("%s: unexpected header %s: %v", tm.name, k, actual[k])
+			}
+		}
+	}
+}
+
+func TestQueryOptionsEncode(t *testing.T) {
+	tests := []struct {
+		opts   QueryOptions
+		expect string
+	}{
+		{
+			opts:   QueryOptions{},
+			expect: "",
+		},
+		{
+			opts:   QueryOptions{Explain: "off"},
+			expect: "",
+		},
+		{
+			opts:   QueryOptions{Explain: "notes", Metrics: true},
+			expect: "explain=notes&metrics=true",
+		},
+		{
+			opts:   QueryOptions{Instrument: true, Provenance: true, StrictBuiltinErrors: true},
+			expect: "instrument=true&provenance=true&strict-builtin-errors=true",
+		},
+	}
+	for _, tm := range tests {
+		if actual := tm.opts.Encode(); actual != tm.expect {
+			t.Errorf("got: %q wanted: %q", actual, tm.expect)
+		}
+	}
+}
+
+func TestRequestCoalescing(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Write([]byte(`{"result": {"allow": true}}`))
+	}))
+	defer svr.Close()
+
+	cli := New(svr.URL, WithRequestCoalescing())
+
+	// Canceled waiter returns early without affecting other waiters
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	canceledErr := make(chan error)
+	go func() {
+		var resp map[string]interface{}
+		canceledErr <- cli.CustomQuery(canceledCtx, "v1/data/test", map[string]int{"a": 1}, &resp)
+	}()
+
+	const waiters = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var resp map[string]interface{}
+			err := cli.CustomQuery(context.Background(), "v1/data/test", map[string]int{"a": 1}, &resp)
+			if err == nil && resp["result"] == nil {
+				err = fmt.Errorf("unexpected resp: %#v", resp)
+			}
+			errs <- err
+		}()
+	}
+
+	// Wait for the single request to reach the server
+	for atomic.LoadInt32(&hits) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-canceledErr; err != context.Canceled {
+		t.Errorf("canceled waiter got: %v wanted: %v", err, context.Canceled)
+	}
+
+	// Release the response once the remaining waiters joined the in-flight request
+	for cli.(*Client).coalescer.Waiters() < waiters {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected err: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("got %d OPA requests, wanted 1", n)
+	}
+
+	// Different request body is not coalesced
+	var resp map[string]interface{}
+	if err := cli.CustomQuery(context.Background(), "v1/data/test", map[string]int{"a": 2}, &resp); err != nil {
+		t.Errorf("unexpected err: %v", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("got %d OPA requests, wanted 2", n)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	policy := HeaderPolicy{Allow: append([]string{"x-tenant"}, DefaultAllowedHeaders...), Deny: DefaultDeniedHeaders}
+	baseCtx := context.Background()
+	baseKey := CoalesceKey(baseCtx, policy, "v1/data/test", []byte(`{"a":1}`))
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		document   string
+		body       string
+		expectSame bool
+	}{
+		{
+			name:       "same",
+			ctx:        baseCtx,
+			document:   "v1/data/test",
+			body:       `{"a":1}`,
+			expectSame: true,
+		},
+		{
+			name:     "different document",
+			ctx:      baseCtx,
+			document: "v1/data/other",
+			body:     `{"a":1}`,
+		},
+		{
+			name:     "different body",
+			ctx:      baseCtx,
+			document: "v1/data/test",
+			body:     `{"a":2}`,
+		},
+		{
+			name:     "query options",
+			ctx:      ContextWithQueryOptions(baseCtx, QueryOptions{Metrics: true}),
+			document: "v1/data/test",
+			body:     `{"a":1}`,
+		},
+		{
+			name:     "forwarded header",
+			ctx:      metadata.NewIncomingContext(baseCtx, metadata.Pairs("x-tenant", "t1")),
+			document: "v1/data/test",
+			body:     `{"a":1}`,
+		},
+		{
+			name:       "per-request headers",
+			ctx:        metadata.NewIncomingContext(baseCtx, metadata.Pairs("x-request-id", "reqid-1", "traceparent", "00-abc-01")),
+			document:   "v1/data/test",
+			body:       `{"a":1}`,
+			expectSame: true,
+		},
+		{
+			name:       "not forwarded header",
+			ctx:        metadata.NewIncomingContext(baseCtx, metadata.Pairs("authorization", "bearer abc", "x-other", "1")),
+			document:   "v1/data/test",
+			body:       `{"a":1}`,
+			expectSame: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := CoalesceKey(tt.ctx, policy, tt.document, []byte(tt.body))
+			if (key == baseKey) != tt.expectSame {
+				t.Errorf("got same key: %v wanted: %v", key == baseKey, tt.expectSame)
+			}
+		})
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	body := `{"result": {"allow": true, "padding": "0123456789012345678901234567890123456789"}}`
+
+	tests := []struct {
+		name      string
+		limit     int64
+		status    int
+		chunked   bool
+		expectErr error
+	}{
+		{
+			name:   "unlimited",
+			status: http.StatusOK,
+		},
+		{
+			name:   "under limit",
+			limit:  int64(len(body)),
+			status: http.StatusOK,
+		},
+		{
+			name:      "content-length over limit",
+			limit:     32,
+			status:    http.StatusOK,
+			expectErr: ErrResponseTooLarge,
+		},
+		{
+			name:      "chunked over limit",
+			limit:     32,
+			status:    http.StatusOK,
+			chunked:   true,
+			expectErr: ErrResponseTooLarge,
+		},
+		{
+			name:      "error response over limit",
+			limit:     32,
+			status:    http.StatusInternalServerError,
+			chunked:   true,
+			expectErr: ErrResponseTooLarge,
+		},
+	}
+
+	for _, tm := range tests {
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tm.status)
+			if tm.chunked {
+				// Flushing before the body is complete omits Content-Length
+				for i := 0; i < len(body); i += 16 {
+					end := i + 16
+					if end > len(body) {
+						end = len(body)
+					}
+					w.Write([]byte(body[i:end]))
+					w.(http.Flusher).Flush()
+				}
+				return
+			}
+			w.Write([]byte(body))
+		}))
+
+		cli := New(svr.URL, WithMaxResponseSize(tm.limit))
+		var resp map[string]interface{}
+		err := cli.CustomQuery(context.Background(), "v1/data/test", nil, &resp)
+		svr.Close()
+
+		if !errors.Is(err, tm.expectErr) {
+			t.Errorf("%s: got err: %v wanted: %v", tm.name, err, tm.expectErr)
+		}
+		if tm.expectErr == nil && resp["result"] == nil {
+			t.Errorf("%s: unexpected resp: %#v", tm.name, resp)
+		}
+		if tm.expectErr != nil {
+			if code := status.Code(GRPCError(err)); code != codes.ResourceExhausted {
+				t.Errorf("%s: got code: %v wanted: %v", tm.name, code, codes.ResourceExhausted)
+			}
+		}
+	}
+}
+
+func TestTypedError(t *testing.T) {
+	cause := NewErrorV1(types.CodeEvaluation, errors.New("secret policy detail"))
+	err := fmt.Errorf("query: %w", ErrEvaluation.Wrap(cause))
+
+	if !errors.Is(err, ErrEvaluation) {
+		t.Errorf("errors.Is(%v, ErrEvaluation) = false wanted true", err)
+	}
+	if errors.Is(err, ErrUnknown) {
+		t.Errorf("errors.Is(%v, ErrUnknown) = true wanted false", err)
+	}
+
+	var opaErr *ErrorV1
+	if !errors.As(err, &opaErr) || opaErr.Code != types.CodeEvaluation {
+		t.Errorf("errors.As(%v, *ErrorV1) failed to find cause", err)
+	}
+
+	grpcErr := GRPCError(err)
+	st := status.Convert(grpcErr)
+	if st.Code() != codes.Internal || st.Message() != ErrEvaluation.Message {
+		t.Errorf("got status: %v wanted: %s %q", st, codes.Internal, ErrEvaluation.Message)
+	}
+}
@@ -321,3 +321,61 @@ func (m *MockDecisionInputer) GetDecisionInput(ctx context.Context, fullMethod s
 	}
 	return &decInp, nil
 }
+
+func TestCustomQueryResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(logrus.StandardLogger()))
+
+	done := make(chan struct{})
+	clienter := utils_test.StartOpa(ctx, t, done)
+	cli, ok := clienter.(*opa_client.Client)
+	if !ok {
+		t.Fatal("Unable to convert interface to (*Client)")
+		return
+	}
+
+	// Errors above here will leak containers
+	defer func() {
+		cancel()
+		// Wait for container to be shutdown
+		<-done
+	}()
+
+	policyRego, err := ioutil.ReadFile("testdata/custom_query_test.rego")
+	if err != nil {
+		t.Fatalf("ReadFile fatal err: %#v", err)
+		return
+	}
+
+	err = cli.UploadRegoPolicy(ctx, "custom_query_test_policyid", policyRego, nil)
+	if err != nil {
+		t.Fatalf("OpaUploadPolicy fatal err: %#v", err)
+		return
+	}
+
+	opaQry := "v1/data/custom_query_test/map_map_arr"
+	opaReq := map[string]interface{}{"input": map[string]interface{}{}}
+
+	resp, err := cli.CustomQueryResponse(ctx, opaQry, opaReq)
+	if err != nil {
+		t.Fatalf("CustomQueryResponse FAIL: err=%#v", err)
+	}
+	if len(resp.Result) == 0 || len(resp.Metrics) > 0 || resp.Provenance != nil || len(resp.Explanation) > 0 {
+		t.Errorf("CustomQueryResponse(no QueryOptions) FAIL: resp=%#v", resp)
+	}
+
+	qryCtx := opa_client.ContextWithQueryOptions(ctx, opa_client.QueryOptions{
+		Explain:    "full",
+		Metrics:    true,
+		Provenance: true,
+	})
+	resp, err = cli.CustomQueryResponse(qryCtx, opaQry, opaReq)
+	if err != nil {
+		t.Fatalf("CustomQueryResponse FAIL: err=%#v", err)
+	}
+	if len(resp.Result) == 0 || len(resp.Metrics) == 0 || resp.Provenance == nil || len(resp.Explanation) == 0 {
+		t.Errorf("CustomQueryResponse(QueryOptions) FAIL: resp=%#v", resp)
+	}
+	t.Logf("resp.LogFields()=%v", resp.LogFields())
+}
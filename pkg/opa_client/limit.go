@@ -0,0 +1,72 @@
+package opa_client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// maxDrainSize is the maximum number of unread response bytes
+// drained before closing, to keep the connection reusable
+const maxDrainSize = 64 * 1024
+
+// ErrResponseTooLarge is matched by errors.Is for any *ResponseTooLargeError
+var ErrResponseTooLarge = errors.New("OPA response too large")
+
+// ResponseTooLargeError is returned when an OPA response exceeds
+// the maximum response size configured with WithMaxResponseSize
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+// Error implements error interface
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("%s: exceeds maximum size of %d bytes", ErrResponseTooLarge, e.Limit)
+}
+
+// Is allows errors.Is(err, ErrResponseTooLarge)
+func (e *ResponseTooLargeError) Is(target error) bool {
+	return target == ErrResponseTooLarge
+}
+
+// limitedReader reads from rdr, returning *ResponseTooLargeError
+// if more than limit bytes are available
+type limitedReader struct {
+	rdr       io.Reader
+	limit     int64
+	remaining int64
+}
+
+func newLimitedReader(rdr io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return rdr
+	}
+	return &limitedReader{rdr: rdr, limit: limit, remaining: limit}
+}
+
+// Read implements io.Reader interface
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, &ResponseTooLargeError{Limit: l.limit}
+	}
+
+	// Read one extra byte to detect exceeding the limit
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.rdr.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), &ResponseTooLargeError{Limit: l.limit}
+	}
+	return n, err
+}
+
+// closeBody drains up to maxDrainSize unread bytes of the response body before closing it.
+// Closing an unread body drops the keep-alive connection while Opa may still be writing.
+func closeBody(body io.ReadCloser) {
+	io.CopyN(ioutil.Discard, body, maxDrainSize)
+	body.Close()
+}
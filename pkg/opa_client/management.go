@@ -0,0 +1,233 @@
+package opa_client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/open-policy-agent/opa/server/types"
+)
+
+const (
+	jsonPatchContentType = "application/json-patch+json"
+	regoContentType      = "text/plain"
+)
+
+// Manager is the opa client interface for the OPA Policy, Data, Health and Status management APIs.
+// Intended for operational tooling and integration tests, not for authorization requests.
+type Manager interface {
+	ListPolicies(ctx context.Context) ([]Policy, error)
+	GetPolicy(ctx context.Context, policyID string) (*Policy, error)
+	UploadRegoPolicy(ctx context.Context, policyID string, policyRego []byte, resp interface{}) error
+	DeletePolicy(ctx context.Context, policyID string) error
+
+	GetDocument(ctx context.Context, path string, resp interface{}) error
+	PutDocument(ctx context.Context, path string, doc interface{}) error
+	PatchDocument(ctx context.Context, path string, patches []PatchOp) error
+	DeleteDocument(ctx context.Context, path string) error
+
+	BundlesHealth(ctx context.Context) error
+	Status(ctx context.Context, resp interface{}) error
+}
+
+// Policy is a policy module returned by the OPA Policy API
+type Policy struct {
+	ID  string `json:"id"`
+	Raw string `json:"raw"`
+}
+
+// PatchOp is a JSON Patch (RFC 6902) operation for PatchDocument
+type PatchOp struct {
+	Op    string      `json:"op"` // "add", "remove" or "replace"
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// resultResponse is the data type json.Unmarshaled from OPA management API responses
+type resultResponse struct {
+	Result *json.RawMessage `json:"result"`
+}
+
+// ListPolicies lists all policy modules.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#list-policies
+func (c *Client) ListPolicies(ctx context.Context) ([]Policy, error) {
+	var resp struct {
+		Result []Policy `json:"result"`
+	}
+	err := c.manage(ctx, http.MethodGet, "v1/policies", "", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
+
+// GetPolicy gets a policy module.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#get-a-policy
+func (c *Client) GetPolicy(ctx context.Context, policyID string) (*Policy, error) {
+	var resp struct {
+		Result *Policy `json:"result"`
+	}
+	err := c.manage(ctx, http.MethodGet, policyPath(policyID), "", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
+
+// UploadRegoPolicy creates/updates an OPA policy.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#create-or-update-a-policy
+func (c *Client) UploadRegoPolicy(ctx context.Context, policyID string, policyRego []byte, resp interface{}) error {
+	return c.manage(ctx, http.MethodPut, policyPath(policyID), regoContentType, policyRego, resp)
+}
+
+// DeletePolicy deletes a policy module.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#delete-a-policy
+func (c *Client) DeletePolicy(ctx context.Context, policyID string) error {
+	return c.manage(ctx, http.MethodDelete, policyPath(policyID), "", nil, nil)
+}
+
+// GetDocument gets the document at path (eg: "authz/rbac/account_service_features")
+// and decodes it into resp.
+// Returns ErrUndefined if the document is undefined.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#get-a-document
+func (c *Client) GetDocument(ctx context.Context, path string, resp interface{}) error {
+	var rr resultResponse
+	err := c.manage(ctx, http.MethodGet, dataPath(path), "", nil, &rr)
+	if err != nil {
+		return err
+	}
+	if rr.Result == nil {
+		return ErrUndefined
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(*rr.Result, resp)
+}
+
+// PutDocument creates/overwrites the document at path.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#create-or-overwrite-a-document
+func (c *Client) PutDocument(ctx context.Context, path string, doc interface{}) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return c.manage(ctx, http.MethodPut, dataPath(path), contentType, body, nil)
+}
+
+// PatchDocument applies JSON Patch operations to the document at path.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#patch-a-document
+func (c *Client) PatchDocument(ctx context.Context, path string, patches []PatchOp) error {
+	body, err := json.Marshal(patches)
+	if err != nil {
+		return err
+	}
+	return c.manage(ctx, http.MethodPatch, dataPath(path), jsonPatchContentType, body, nil)
+}
+
+// DeleteDocument deletes the document at path.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#delete-a-document
+func (c *Client) DeleteDocument(ctx context.Context, path string) error {
+	return c.manage(ctx, http.MethodDelete, dataPath(path), "", nil, nil)
+}
+
+// BundlesHealth returns nil error if OPA is healthy and all configured bundles are activated.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#health-api
+func (c *Client) BundlesHealth(ctx context.Context) error {
+	return c.manage(ctx, http.MethodGet, "health?bundles", "", nil, nil)
+}
+
+// Status gets the OPA status report (requires the OPA status plugin to be enabled)
+// and decodes its result into resp.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#status-api
+func (c *Client) Status(ctx context.Context, resp interface{}) error {
+	var rr resultResponse
+	err := c.manage(ctx, http.MethodGet, "v1/status", "", nil, &rr)
+	if err != nil {
+		return err
+	}
+	if rr.Result == nil || resp == nil {
+		return nil
+	}
+	return json.Unmarshal(*rr.Result, resp)
+}
+
+// policyPath returns the Policy API path of policyID
+func policyPath(policyID string) string {
+	return "v1/policies/" + escapePath(policyID)
+}
+
+// dataPath returns the Data API path of the document path
+func dataPath(path string) string {
+	return "v1/data/" + escapePath(strings.TrimPrefix(path, "/"))
+}
+
+// escapePath escapes each '/'-separated segment of path,
+// so that segments containing eg: '?', '#' or '%' are not misinterpreted
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// manage sends a management API request to OPA.
+// A successful response body, if any, is decoded into resp (if non-nil).
+func (c *Client) manage(ctx context.Context, method, path, reqContentType string, body []byte, resp interface{}) error {
+	ref := fmt.Sprintf("%s/%s", c.Address(), path)
+
+	req, err := http.NewRequestWithContext(ctx, method, ref, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	if len(reqContentType) > 0 {
+		req.Header.Set("Content-Type", reqContentType)
+	}
+
+	mgmtResp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(mgmtResp.Body)
+	bs, err := ioutil.ReadAll(newLimitedReader(mgmtResp.Body, c.maxRespSize))
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(bs)
+	copy := buf.String()
+	dec := json.NewDecoder(buf)
+
+	// Successful code, decode as document
+	if mgmtResp.StatusCode >= 200 && mgmtResp.StatusCode < 400 {
+		if resp == nil || len(bs) == 0 {
+			return nil
+		}
+		return dec.Decode(resp)
+	}
+
+	// unsuccessful code, attempt to decode as types.ErrorV1
+	var opaErrV1 types.ErrorV1
+	if err := dec.Decode(&opaErrV1); err != nil {
+		return fmt.Errorf("unparseable error from OPA: StatusCode=%d: `%s`", mgmtResp.StatusCode, copy)
+	}
+
+	return &opaErrV1
+}
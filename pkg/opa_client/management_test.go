@@ -0,0 +1,141 @@
+package opa_client_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/infobloxopen/atlas-authz-middleware/pkg/opa_client"
+	"github.com/infobloxopen/atlas-authz-middleware/utils_test"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	logrus "github.com/sirupsen/logrus"
+)
+
+func TestManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, utils_test.TestingTContextKey, t)
+	ctx = ctxlogrus.ToContext(ctx, logrus.NewEntry(logrus.StandardLogger()))
+
+	done := make(chan struct{})
+	clienter := utils_test.StartOpa(ctx, t, done)
+	mgr, ok := clienter.(opa_client.Manager)
+	if !ok {
+		t.Fatal("Unable to convert interface to Manager")
+		return
+	}
+
+	// Errors above here will leak containers
+	defer func() {
+		cancel()
+		// Wait for container to be shutdown
+		<-done
+	}()
+
+	policyRego, err := ioutil.ReadFile("testdata/custom_query_test.rego")
+	if err != nil {
+		t.Fatalf("ReadFile fatal err: %#v", err)
+		return
+	}
+
+	if err := mgr.UploadRegoPolicy(ctx, "manager_test_policyid", policyRego, nil); err != nil {
+		t.Fatalf("UploadRegoPolicy fatal err: %#v", err)
+	}
+
+	policies, err := mgr.ListPolicies(ctx)
+	if err != nil || len(policies) != 1 || policies[0].ID != "manager_test_policyid" {
+		t.Errorf("ListPolicies FAIL: policies=%#v err=%#v", policies, err)
+	}
+
+	policy, err := mgr.GetPolicy(ctx, "manager_test_policyid")
+	if err != nil || policy == nil || policy.Raw != string(policyRego) {
+		t.Errorf("GetPolicy FAIL: policy=%#v err=%#v", policy, err)
+	}
+
+	if err := mgr.BundlesHealth(ctx); err != nil {
+		t.Errorf("BundlesHealth FAIL: err=%#v", err)
+	}
+
+	////////////////////////////////////////////////////////////////
+
+	feats := map[string]map[string][]string{
+		"2001016": {"environment": {"ac"}},
+	}
+	if err := mgr.PutDocument(ctx, "entitlements/account_service_features", feats); err != nil {
+		t.Fatalf("PutDocument fatal err: %#v", err)
+	}
+
+	err = mgr.PatchDocument(ctx, "entitlements/account_service_features", []opa_client.PatchOp{
+		{Op: "add", Path: "/2001040", Value: map[string][]string{"wheel": {"abs"}}},
+		{Op: "replace", Path: "/2001016/environment", Value: []string{"ac", "heated-seats"}},
+	})
+	if err != nil {
+		t.Fatalf("PatchDocument fatal err: %#v", err)
+	}
+
+	var actualFeats map[string]map[string][]string
+	expectFeats := map[string]map[string][]string{
+		"2001016": {"environment": {"ac", "heated-seats"}},
+		"2001040": {"wheel": {"abs"}},
+	}
+	if err := mgr.GetDocument(ctx, "/entitlements/account_service_features", &actualFeats); err != nil {
+		t.Errorf("GetDocument FAIL: err=%#v", err)
+	}
+	if !reflect.DeepEqual(expectFeats, actualFeats) {
+		t.Errorf("GetDocument FAIL\nexpectFeats=%#v\nactualFeats=%#v", expectFeats, actualFeats)
+	}
+
+	if err := mgr.DeleteDocument(ctx, "entitlements/account_service_features"); err != nil {
+		t.Errorf("DeleteDocument FAIL: err=%#v", err)
+	}
+	err = mgr.GetDocument(ctx, "entitlements/account_service_features", &actualFeats)
+	if !errors.Is(err, opa_client.ErrUndefined) {
+		t.Errorf("GetDocument after delete FAIL: expected ErrUndefined, got err=%#v", err)
+	}
+
+	////////////////////////////////////////////////////////////////
+
+	if err := mgr.DeletePolicy(ctx, "manager_test_policyid"); err != nil {
+		t.Errorf("DeletePolicy FAIL: err=%#v", err)
+	}
+	if _, err := mgr.GetPolicy(ctx, "manager_test_policyid"); err == nil {
+		t.Errorf("GetPolicy after delete FAIL: expected err")
+	}
+}
+
+func TestManagerPathEscape(t *testing.T) {
+	var gotPaths []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.Method+" "+r.URL.EscapedPath()+"?"+r.URL.RawQuery)
+		w.Write([]byte(`{"result": {}}`))
+	}))
+	defer svr.Close()
+
+	ctx := context.Background()
+	mgr := opa_client.New(svr.URL).(opa_client.Manager)
+
+	mgr.GetPolicy(ctx, "authz/rbac policy?v=1#x")
+	mgr.UploadRegoPolicy(ctx, "100%.rego", []byte("package x"), nil)
+	mgr.DeletePolicy(ctx, "a/b")
+	mgr.GetDocument(ctx, "/entitlements/acct 2001016/features?x", nil)
+	mgr.PutDocument(ctx, "entitlements/a#b", map[string]string{})
+	mgr.PatchDocument(ctx, "entitlements/50%", nil)
+	mgr.DeleteDocument(ctx, "entitlements/a/b")
+
+	expectPaths := []string{
+		"GET /v1/policies/authz/rbac%20policy%3Fv=1%23x?",
+		"PUT /v1/policies/100%25.rego?",
+		"DELETE /v1/policies/a/b?",
+		"GET /v1/data/entitlements/acct%202001016/features%3Fx?",
+		"PUT /v1/data/entitlements/a%23b?",
+		"PATCH /v1/data/entitlements/50%25?",
+		"DELETE /v1/data/entitlements/a/b?",
+	}
+	if !reflect.DeepEqual(expectPaths, gotPaths) {
+		t.Errorf("FAIL:\nexpectPaths=%q\ngotPaths=%q", expectPaths, gotPaths)
+	}
+}
@@ -0,0 +1,115 @@
+package opa_client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+
+	"github.com/open-policy-agent/opa/server/types"
+)
+
+// queryOptionsKey is the context.Context key type for QueryOptions
+type queryOptionsKey struct{}
+
+// QueryOptions are the OPA Query API URL query parameters.
+// They are supplied per-call in the context with ContextWithQueryOptions.
+//
+// https://www.openpolicyagent.org/docs/latest/rest-api/#get-a-document-with-input
+type QueryOptions struct {
+	// Explain is one of: "notes", "fails", "full", "debug" ("" or "off" for none)
+	Explain             types.ExplainModeV1
+	Metrics             bool
+	Instrument          bool
+	Provenance          bool
+	StrictBuiltinErrors bool
+}
+
+// ContextWithQueryOptions returns a new context containing QueryOptions,
+// which are used by subsequent queries with the context.
+func ContextWithQueryOptions(ctx context.Context, opts QueryOptions) context.Context {
+	return context.WithValue(ctx, queryOptionsKey{}, opts)
+}
+
+// QueryOptionsFromContext returns the QueryOptions in the context, if any
+func QueryOptionsFromContext(ctx context.Context) (QueryOptions, bool) {
+	opts, ok := ctx.Value(queryOptionsKey{}).(QueryOptions)
+	return opts, ok
+}
+
+// Encode returns the QueryOptions URL-encoded as query parameters
+func (o QueryOptions) Encode() string {
+	vals := url.Values{}
+	if len(o.Explain) > 0 && o.Explain != types.ExplainOffV1 {
+		vals.Set(types.ParamExplainV1, string(o.Explain))
+	}
+	if o.Metrics {
+		vals.Set(types.ParamMetricsV1, "true")
+	}
+	if o.Instrument {
+		vals.Set(types.ParamInstrumentV1, "true")
+	}
+	if o.Provenance {
+		vals.Set(types.ParamProvenanceV1, "true")
+	}
+	if o.StrictBuiltinErrors {
+		vals.Set(types.ParamStrictBuiltinErrors, "true")
+	}
+	return vals.Encode()
+}
+
+// QueryResponse is the typed envelope of an OPA Query API response.
+// Metrics, Provenance and Explanation are only returned if requested with QueryOptions.
+// DecisionID is only returned if OPA decision logging is enabled.
+type QueryResponse struct {
+	Result      json.RawMessage     `json:"result,omitempty"`
+	DecisionID  string              `json:"decision_id,omitempty"`
+	Metrics     types.MetricsV1     `json:"metrics,omitempty"`
+	Provenance  *types.ProvenanceV1 `json:"provenance,omitempty"`
+	Explanation types.TraceV1       `json:"explanation,omitempty"`
+	Warning     *types.Warning      `json:"warning,omitempty"`
+}
+
+// LogFields returns the non-empty envelope fields (excluding Result) for logging
+func (r *QueryResponse) LogFields() map[string]interface{} {
+	fields := map[string]interface{}{}
+	if len(r.DecisionID) > 0 {
+		fields["decision_id"] = r.DecisionID
+	}
+	if len(r.Metrics) > 0 {
+		fields["metrics"] = r.Metrics
+	}
+	if r.Provenance != nil {
+		fields["provenance"] = r.Provenance
+	}
+	if len(r.Explanation) > 0 {
+		fields["explanation"] = string(r.Explanation)
+	}
+	if r.Warning != nil {
+		fields["warning"] = r.Warning
+	}
+	return fields
+}
+
+// CustomQueryResponse requests evaluation at a document of the caller's choice,
+// and returns the non-error OPA response as typed QueryResponse envelope.
+// The Result is left as raw JSON for the caller to decode.
+func (c *Client) CustomQueryResponse(ctx context.Context, document string, reqData interface{}) (*QueryResponse, error) {
+	postReqBody, err := json.Marshal(reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp QueryResponse
+	respRdrFn := func(rdr io.Reader) error {
+		dec := json.NewDecoder(rdr)
+		return dec.Decode(&resp)
+	}
+
+	err = c.CustomQueryStream(ctx, document, postReqBody, respRdrFn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
@@ -3,6 +3,7 @@ package utils_test
 import (
 	"context"
 	"net"
+	"net/http"
 	"os"
 	"testing"
 	"time"
@@ -61,6 +62,10 @@ func StartOpa(ctx context.Context, t *testing.T, done chan struct{}) opa_client.
 	go func() {
 		<-ctx.Done()
 
+		// Unused connections dialed by concurrent requests would otherwise
+		// hold up the shutdown until the server considers them idle
+		http.DefaultClient.CloseIdleConnections()
+
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
 		defer cancel()
 		if err := opaSvr.Shutdown(shutdownCtx); err != nil {